@@ -0,0 +1,275 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"common/banking_data"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	CACHE_POLICY_LRU = "lru"
+	CACHE_POLICY_LFU = "lfu"
+)
+
+var (
+	cacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "banking_provider_cache_hits_total",
+		Help: "The total number of provider results served from the cache",
+	}, []string{"institution"})
+	cacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "banking_provider_cache_misses_total",
+		Help: "The total number of provider calls not found in the cache, bypasses included",
+	}, []string{"institution"})
+	cacheEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "banking_provider_cache_evictions_total",
+		Help: "The total number of provider results evicted from a full cache",
+	}, []string{"institution"})
+)
+
+type CacheSettings struct {
+	TTL     string `json:"ttl"`
+	MaxSize int    `json:"maxSize"`
+	// Policy picks the entry evicted from a full cache, lru (the default) or lfu
+	Policy string `json:"policy"`
+}
+
+type cacheEntry struct {
+	key       string
+	scores    []banking_data.PeriodScore
+	expiresAt time.Time
+	freq      int
+	elem      *list.Element
+}
+
+// ResultCache keeps provider results by user, banking institution and credentials for a TTL, so only callers
+// holding the same credentials are served the cached result.
+// LRU keeps a single recency list, LFU keeps a recency list per use count so evictions stay O(1).
+type ResultCache struct {
+	bankingInstitutionId string
+	ttl                  time.Duration
+	maxSize              int
+	policy               string
+	now                  func() time.Time
+	// credentialsKey keys the hash of the credentials in the cache keys, it never leaves the process
+	credentialsKey []byte
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	recency *list.List
+	freqs   map[int]*list.List
+	minFreq int
+}
+
+func NewResultCache(bankingInstitutionId string, settings CacheSettings) (*ResultCache, error) {
+	ttl, err := time.ParseDuration(settings.TTL)
+	if err != nil || ttl <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid cache ttl %q", settings.TTL))
+	}
+	if settings.MaxSize < 1 {
+		return nil, errors.New("Cache maxSize must be positive")
+	}
+	policy := settings.Policy
+	if policy == "" {
+		policy = CACHE_POLICY_LRU
+	}
+	if policy != CACHE_POLICY_LRU && policy != CACHE_POLICY_LFU {
+		return nil, errors.New(fmt.Sprintf("Unknown cache policy %s", policy))
+	}
+	credentialsKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, credentialsKey); err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't generate the cache credentials key: %v", err))
+	}
+	return &ResultCache{
+		bankingInstitutionId: bankingInstitutionId,
+		ttl:                  ttl,
+		maxSize:              settings.MaxSize,
+		policy:               policy,
+		now:                  time.Now,
+		credentialsKey:       credentialsKey,
+		entries:              make(map[string]*cacheEntry),
+		recency:              list.New(),
+		freqs:                make(map[int]*list.List),
+	}, nil
+}
+
+// cacheKey holds a keyed hash of the credentials instead of the credentials themselves
+func (c *ResultCache) cacheKey(req *core.ProviderRequest) string {
+	mac := hmac.New(sha256.New, c.credentialsKey)
+	// Maps are marshalled with sorted keys, equal credentials always give the same hash
+	creds, _ := json.Marshal(req.Credentials)
+	mac.Write(creds)
+	return req.BankingInstitutionId + "\x00" + req.UserId + "\x00" + string(mac.Sum(nil))
+}
+
+// copyScores keeps callers from modifying the cached slice
+func copyScores(scores []banking_data.PeriodScore) []banking_data.PeriodScore {
+	return append([]banking_data.PeriodScore(nil), scores...)
+}
+
+func (c *ResultCache) Get(req *core.ProviderRequest) ([]banking_data.PeriodScore, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[c.cacheKey(req)]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(entry)
+		return nil, false
+	}
+	c.touch(entry)
+	return copyScores(entry.scores), true
+}
+
+func (c *ResultCache) Set(req *core.ProviderRequest, scores []banking_data.PeriodScore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := c.cacheKey(req)
+	if entry, ok := c.entries[key]; ok {
+		entry.scores = copyScores(scores)
+		entry.expiresAt = c.now().Add(c.ttl)
+		c.touch(entry)
+		return
+	}
+	if len(c.entries) >= c.maxSize {
+		c.evict()
+	}
+	entry := &cacheEntry{
+		key:       key,
+		scores:    copyScores(scores),
+		expiresAt: c.now().Add(c.ttl),
+		freq:      1,
+	}
+	c.entries[key] = entry
+	if c.policy == CACHE_POLICY_LRU {
+		entry.elem = c.recency.PushFront(entry)
+	} else {
+		entry.elem = c.freqList(1).PushFront(entry)
+		c.minFreq = 1
+	}
+}
+
+func (c *ResultCache) freqList(freq int) *list.List {
+	l, ok := c.freqs[freq]
+	if !ok {
+		l = list.New()
+		c.freqs[freq] = l
+	}
+	return l
+}
+
+// touch records a use of the entry, must be called holding the lock
+func (c *ResultCache) touch(entry *cacheEntry) {
+	if c.policy == CACHE_POLICY_LRU {
+		c.recency.MoveToFront(entry.elem)
+		return
+	}
+	current := c.freqs[entry.freq]
+	current.Remove(entry.elem)
+	if current.Len() == 0 {
+		delete(c.freqs, entry.freq)
+		if c.minFreq == entry.freq {
+			c.minFreq++
+		}
+	}
+	entry.freq++
+	entry.elem = c.freqList(entry.freq).PushFront(entry)
+}
+
+// remove must be called holding the lock
+func (c *ResultCache) remove(entry *cacheEntry) {
+	delete(c.entries, entry.key)
+	if c.policy == CACHE_POLICY_LRU {
+		c.recency.Remove(entry.elem)
+		return
+	}
+	current := c.freqs[entry.freq]
+	current.Remove(entry.elem)
+	if current.Len() == 0 {
+		delete(c.freqs, entry.freq)
+		if c.minFreq == entry.freq {
+			c.resetMinFreq()
+		}
+	}
+}
+
+func (c *ResultCache) resetMinFreq() {
+	c.minFreq = 0
+	for freq := range c.freqs {
+		if c.minFreq == 0 || freq < c.minFreq {
+			c.minFreq = freq
+		}
+	}
+}
+
+// evict drops the least recently (LRU) or least frequently (LFU) used entry, must be called holding the lock
+func (c *ResultCache) evict() {
+	var victim *list.Element
+	if c.policy == CACHE_POLICY_LRU {
+		victim = c.recency.Back()
+	} else if l, ok := c.freqs[c.minFreq]; ok {
+		victim = l.Back()
+	}
+	if victim == nil {
+		return
+	}
+	c.remove(victim.Value.(*cacheEntry))
+	cacheEvictions.WithLabelValues(c.bankingInstitutionId).Inc()
+}
+
+type cachedProvider struct {
+	provider core.BankingInfoProvider
+	cache    *ResultCache
+	request  *core.ProviderRequest
+}
+
+func (p *cachedProvider) Query(ctx context.Context) ([]banking_data.PeriodScore, error) {
+	span := oteltrace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Bool("cache.bypass", p.request.BypassCache))
+	if !p.request.BypassCache {
+		if scores, ok := p.cache.Get(p.request); ok {
+			cacheHits.WithLabelValues(p.request.BankingInstitutionId).Inc()
+			span.SetAttributes(attribute.Bool("cache.hit", true))
+			return scores, nil
+		}
+	}
+	cacheMisses.WithLabelValues(p.request.BankingInstitutionId).Inc()
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	scores, err := p.provider.Query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// A forced refresh still updates the cache for the next requests
+	p.cache.Set(p.request, scores)
+	return scores, nil
+}
+
+func withCache(factory core.ProviderFactory, cache *ResultCache) core.ProviderFactory {
+	return func(req *core.ProviderRequest) (core.BankingInfoProvider, error) {
+		provider, err := factory(req)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedProvider{
+			provider: provider,
+			cache:    cache,
+			request:  req,
+		}, nil
+	}
+}
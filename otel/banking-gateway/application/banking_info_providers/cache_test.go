@@ -0,0 +1,40 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"common/banking_data"
+	"testing"
+)
+
+func TestResultCacheIsKeyedByCredentials(t *testing.T) {
+	cache, err := NewResultCache(t.Name(), CacheSettings{TTL: "1m", MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &core.ProviderRequest{
+		UserId:               "user",
+		BankingInstitutionId: "bank",
+		Credentials:          map[string]string{"username": "user", "password": "secret"},
+	}
+	cache.Set(owner, []banking_data.PeriodScore{{Year: 2022, Month: 1, Score: 1}})
+
+	if _, ok := cache.Get(&core.ProviderRequest{
+		UserId:               "user",
+		BankingInstitutionId: "bank",
+		Credentials:          map[string]string{"password": "secret", "username": "user"},
+	}); !ok {
+		t.Fatal("the same credentials missed the cache")
+	}
+	for name, creds := range map[string]map[string]string{
+		"wrong password": {"username": "user", "password": "guess"},
+		"no credentials": nil,
+	} {
+		if _, ok := cache.Get(&core.ProviderRequest{
+			UserId:               "user",
+			BankingInstitutionId: "bank",
+			Credentials:          creds,
+		}); ok {
+			t.Errorf("%s: served the cached result", name)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"common/banking_data"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+type CircuitState int
+
+const (
+	CIRCUIT_CLOSED CircuitState = iota
+	CIRCUIT_HALF_OPEN
+	CIRCUIT_OPEN
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CIRCUIT_CLOSED:
+		return "closed"
+	case CIRCUIT_HALF_OPEN:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+var (
+	circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "banking_provider_circuit_state",
+		Help: "State of the circuit breaker of each banking institution, 0 closed, 1 half-open, 2 open",
+	}, []string{"institution"})
+	circuitTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "banking_provider_circuit_transitions_total",
+		Help: "The total number of state changes of the circuit breaker of each banking institution",
+	}, []string{"institution", "from", "to"})
+	circuitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "banking_provider_circuit_rejections_total",
+		Help: "The total number of provider calls rejected by an open circuit breaker",
+	}, []string{"institution"})
+)
+
+type CircuitBreakerSettings struct {
+	// FailureThreshold is the number of consecutive failures that opens the circuit
+	FailureThreshold int `json:"failureThreshold"`
+	// OpenTimeout is how long the circuit stays open before letting trial calls through
+	OpenTimeout string `json:"openTimeout"`
+	// HalfOpenMaxCalls is the number of concurrent trial calls while half-open
+	HalfOpenMaxCalls int `json:"halfOpenMaxCalls"`
+}
+
+func defaultCircuitBreakerSettings() CircuitBreakerSettings {
+	return CircuitBreakerSettings{
+		FailureThreshold: 5,
+		OpenTimeout:      "30s",
+		HalfOpenMaxCalls: 1,
+	}
+}
+
+// mergeCircuitBreakerSettings keeps the defaults of the settings left empty in the config
+func mergeCircuitBreakerSettings(defaults, settings CircuitBreakerSettings) CircuitBreakerSettings {
+	if settings.FailureThreshold != 0 {
+		defaults.FailureThreshold = settings.FailureThreshold
+	}
+	if settings.OpenTimeout != "" {
+		defaults.OpenTimeout = settings.OpenTimeout
+	}
+	if settings.HalfOpenMaxCalls != 0 {
+		defaults.HalfOpenMaxCalls = settings.HalfOpenMaxCalls
+	}
+	return defaults
+}
+
+// CircuitBreaker stops calling a banking institution after consecutive failures and
+// probes it again once the open timeout expires
+type CircuitBreaker struct {
+	institutionId    string
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenMaxCalls int
+	now              func() time.Time
+
+	mu            sync.Mutex
+	state         CircuitState
+	failures      int
+	openedAt      time.Time
+	halfOpenCalls int
+}
+
+func NewCircuitBreaker(institutionId string, settings CircuitBreakerSettings) (*CircuitBreaker, error) {
+	openTimeout, err := time.ParseDuration(settings.OpenTimeout)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid circuit breaker openTimeout: %v", err))
+	}
+	if settings.FailureThreshold < 1 || settings.HalfOpenMaxCalls < 1 {
+		return nil, errors.New("Circuit breaker failureThreshold and halfOpenMaxCalls must be positive")
+	}
+	circuitState.WithLabelValues(institutionId).Set(float64(CIRCUIT_CLOSED))
+	return &CircuitBreaker{
+		institutionId:    institutionId,
+		failureThreshold: settings.FailureThreshold,
+		openTimeout:      openTimeout,
+		halfOpenMaxCalls: settings.HalfOpenMaxCalls,
+		now:              time.Now,
+	}, nil
+}
+
+// transition must be called holding the lock
+func (b *CircuitBreaker) transition(ctx context.Context, to CircuitState) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	b.halfOpenCalls = 0
+	if to == CIRCUIT_OPEN {
+		b.openedAt = b.now()
+	}
+	if to == CIRCUIT_CLOSED {
+		b.failures = 0
+	}
+	circuitState.WithLabelValues(b.institutionId).Set(float64(to))
+	circuitTransitions.WithLabelValues(b.institutionId, from.String(), to.String()).Inc()
+	oteltrace.SpanFromContext(ctx).AddEvent("circuitBreakerStateChange", oteltrace.WithAttributes(
+		attribute.String("circuit.institution", b.institutionId),
+		attribute.String("circuit.from", from.String()),
+		attribute.String("circuit.to", to.String()),
+	))
+	log.Println(fmt.Sprintf("Circuit breaker of bankingInstitutionId=%s went from %s to %s", b.institutionId, from, to))
+}
+
+// allow reserves a call or fails fast with ErrInstitutionUnavailable
+func (b *CircuitBreaker) allow(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CIRCUIT_OPEN && b.now().Sub(b.openedAt) >= b.openTimeout {
+		b.transition(ctx, CIRCUIT_HALF_OPEN)
+	}
+	switch b.state {
+	case CIRCUIT_OPEN:
+	case CIRCUIT_HALF_OPEN:
+		if b.halfOpenCalls < b.halfOpenMaxCalls {
+			b.halfOpenCalls++
+			return nil
+		}
+	default:
+		return nil
+	}
+	circuitRejections.WithLabelValues(b.institutionId).Inc()
+	oteltrace.SpanFromContext(ctx).AddEvent("circuitBreakerRejected", oteltrace.WithAttributes(
+		attribute.String("circuit.institution", b.institutionId),
+		attribute.String("circuit.state", b.state.String()),
+	))
+	return fmt.Errorf("%w: %s, circuit breaker is %s", core.ErrInstitutionUnavailable, b.institutionId, b.state)
+}
+
+func (b *CircuitBreaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state == CIRCUIT_HALF_OPEN {
+			b.transition(ctx, CIRCUIT_CLOSED)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == CIRCUIT_HALF_OPEN || b.failures >= b.failureThreshold {
+		b.transition(ctx, CIRCUIT_OPEN)
+	}
+}
+
+// classify records the outcome of a call, only the failures of the institution count. Our own cancellations and
+// deadlines, rejected credentials, 4xx responses or missing statements end the call without a verdict
+func (b *CircuitBreaker) classify(ctx context.Context, err error) {
+	switch {
+	case err == nil:
+		b.record(ctx, nil)
+	case ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		b.release()
+	case errors.Is(err, core.ErrInstitutionFailure):
+		b.record(ctx, err)
+	default:
+		b.release()
+	}
+}
+
+// release gives back a call reserved by allow that ended without a verdict on the institution
+func (b *CircuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CIRCUIT_HALF_OPEN && b.halfOpenCalls > 0 {
+		b.halfOpenCalls--
+	}
+}
+
+type circuitBreakerProvider struct {
+	provider core.BankingInfoProvider
+	breaker  *CircuitBreaker
+}
+
+func (p *circuitBreakerProvider) Query(ctx context.Context) ([]banking_data.PeriodScore, error) {
+	if err := p.breaker.allow(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := p.provider.Query(ctx)
+	p.breaker.classify(ctx, err)
+	return resp, err
+}
+
+func withCircuitBreaker(factory core.ProviderFactory, breaker *CircuitBreaker) core.ProviderFactory {
+	return func(req *core.ProviderRequest) (core.BankingInfoProvider, error) {
+		provider, err := factory(req)
+		if err != nil {
+			return nil, err
+		}
+		return &circuitBreakerProvider{
+			provider: provider,
+			breaker:  breaker,
+		}, nil
+	}
+}
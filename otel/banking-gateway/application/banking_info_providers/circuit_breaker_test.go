@@ -0,0 +1,93 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"common/banking_data"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type failingProvider struct {
+	err error
+}
+
+func (p *failingProvider) Query(ctx context.Context) ([]banking_data.PeriodScore, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, p.err
+}
+
+func newTestBreaker(t *testing.T) *CircuitBreaker {
+	t.Helper()
+	breaker, err := NewCircuitBreaker(t.Name(), CircuitBreakerSettings{
+		FailureThreshold: 2,
+		OpenTimeout:      "1m",
+		HalfOpenMaxCalls: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return breaker
+}
+
+func TestCircuitBreakerOnlyCountsInstitutionFailures(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	ignored := map[string]struct {
+		ctx context.Context
+		err error
+	}{
+		"rejected credentials": {context.Background(), errors.New("Bank responded with status 401")},
+		"missing statement":    {context.Background(), errors.New("No statements found for user 1")},
+		"our deadline":         {expired, nil},
+	}
+	for name, test := range ignored {
+		t.Run(name, func(t *testing.T) {
+			breaker := newTestBreaker(t)
+			provider := &circuitBreakerProvider{provider: &failingProvider{err: test.err}, breaker: breaker}
+			for i := 0; i < 5; i++ {
+				if _, err := provider.Query(test.ctx); errors.Is(err, core.ErrInstitutionUnavailable) {
+					t.Fatalf("call %d was rejected by the breaker", i)
+				}
+			}
+		})
+	}
+
+	breaker := newTestBreaker(t)
+	provider := &circuitBreakerProvider{provider: &failingProvider{err: fmt.Errorf("%w: status 503", core.ErrInstitutionFailure)}, breaker: breaker}
+	provider.Query(context.Background())
+	provider.Query(context.Background())
+	if _, err := provider.Query(context.Background()); !errors.Is(err, core.ErrInstitutionUnavailable) {
+		t.Fatalf("Query() after two institution failures = %v, want ErrInstitutionUnavailable", err)
+	}
+}
+
+func TestHTTPProviderClassifiesInstitutionFailures(t *testing.T) {
+	for status, failure := range map[int]bool{
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusUnauthorized:        false,
+		http.StatusNotFound:            false,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		provider := newTestHTTPProvider(t, fmt.Sprintf(`{"urlTemplate": "%s"}`, server.URL), nil)
+		_, err := provider.Query(context.Background())
+		server.Close()
+		if errors.Is(err, core.ErrInstitutionFailure) != failure {
+			t.Errorf("status %d: Query() = %v, institution failure %v", status, err, failure)
+		}
+	}
+
+	provider := newTestHTTPProvider(t, `{"urlTemplate": "http://127.0.0.1:1"}`, nil)
+	if _, err := provider.Query(context.Background()); !errors.Is(err, core.ErrInstitutionFailure) {
+		t.Errorf("transport error: Query() = %v, want an institution failure", err)
+	}
+}
@@ -0,0 +1,338 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"banking-gateway/core/constants"
+	"bytes"
+	"common/banking_data"
+	"common/telemetry"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	AUTH_NONE   = ""
+	AUTH_BASIC  = "basic"
+	AUTH_BEARER = "bearer"
+	AUTH_HEADER = "header"
+)
+
+// HTTPAuthSettings describes how requests are authenticated against the bank API.
+// Basic auth uses the username and password of the request credentials, bearer and header
+// auth use the value of ValueEnv or, when empty, the "token" of the request credentials.
+type HTTPAuthSettings struct {
+	Type     string `json:"type"`
+	Header   string `json:"header"`
+	ValueEnv string `json:"valueEnv"`
+}
+
+// HTTPMappingSettings holds the dotted paths used to read the period scores out of the JSON response
+type HTTPMappingSettings struct {
+	Items  string `json:"items"`
+	Year   string `json:"year"`
+	Month  string `json:"month"`
+	Period string `json:"period"`
+	Score  string `json:"score"`
+}
+
+type HTTPSettings struct {
+	URLTemplate string              `json:"urlTemplate"`
+	Method      string              `json:"method"`
+	Headers     map[string]string   `json:"headers"`
+	Auth        HTTPAuthSettings    `json:"auth"`
+	Timeout     string              `json:"timeout"`
+	Mapping     HTTPMappingSettings `json:"mapping"`
+}
+
+// HTTPProvider queries a bank REST API and maps its JSON response into period scores
+type HTTPProvider struct {
+	Client      *http.Client
+	URLTemplate *template.Template
+	Method      string
+	Headers     map[string]string
+	Auth        HTTPAuthSettings
+	Mapping     HTTPMappingSettings
+	Request     *core.ProviderRequest
+}
+
+type urlTemplateData struct {
+	UserId               string
+	BankingInstitutionId string
+}
+
+func parseHTTPSettings(settings json.RawMessage) (*HTTPSettings, *template.Template, time.Duration, error) {
+	cfg := HTTPSettings{
+		Method:  http.MethodGet,
+		Timeout: "10s",
+		Mapping: HTTPMappingSettings{
+			Year:  "year",
+			Month: "month",
+			Score: "score",
+		},
+	}
+	if len(settings) > 0 {
+		if err := json.Unmarshal(settings, &cfg); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	if cfg.URLTemplate == "" {
+		return nil, nil, 0, errors.New("urlTemplate is required")
+	}
+	urlTemplate, err := template.New("url").Option("missingkey=error").Parse(cfg.URLTemplate)
+	if err != nil {
+		return nil, nil, 0, errors.New(fmt.Sprintf("Invalid urlTemplate: %v", err))
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, nil, 0, errors.New(fmt.Sprintf("Invalid timeout: %v", err))
+	}
+	switch cfg.Auth.Type {
+	case AUTH_NONE, AUTH_BASIC, AUTH_BEARER:
+	case AUTH_HEADER:
+		if cfg.Auth.Header == "" {
+			return nil, nil, 0, errors.New("auth header name is required for header auth")
+		}
+	default:
+		return nil, nil, 0, errors.New(fmt.Sprintf("Unknown auth type %s", cfg.Auth.Type))
+	}
+	return &cfg, urlTemplate, timeout, nil
+}
+
+func newHTTPFactory(settings json.RawMessage) (core.ProviderFactory, error) {
+	cfg, urlTemplate, timeout, err := parseHTTPSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	return func(req *core.ProviderRequest) (core.BankingInfoProvider, error) {
+		return &HTTPProvider{
+			Client:      client,
+			URLTemplate: urlTemplate,
+			Method:      cfg.Method,
+			Headers:     cfg.Headers,
+			Auth:        cfg.Auth,
+			Mapping:     cfg.Mapping,
+			Request:     req,
+		}, nil
+	}, nil
+}
+
+func (p *HTTPProvider) buildURL() (string, error) {
+	var buf bytes.Buffer
+	err := p.URLTemplate.Execute(&buf, urlTemplateData{
+		UserId:               url.PathEscape(p.Request.UserId),
+		BankingInstitutionId: url.PathEscape(p.Request.BankingInstitutionId),
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Couldn't render url template: %v", err))
+	}
+	return buf.String(), nil
+}
+
+func (p *HTTPProvider) authenticate(req *http.Request) error {
+	secret := func() string {
+		if p.Auth.ValueEnv != "" {
+			return os.Getenv(p.Auth.ValueEnv)
+		}
+		return p.Request.Credentials["token"]
+	}
+	switch p.Auth.Type {
+	case AUTH_BASIC:
+		req.SetBasicAuth(p.Request.Credentials["username"], p.Request.Credentials["password"])
+	case AUTH_BEARER:
+		token := secret()
+		if token == "" {
+			return errors.New("Missing bearer token")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case AUTH_HEADER:
+		value := secret()
+		if value == "" {
+			return errors.New(fmt.Sprintf("Missing value for auth header %s", p.Auth.Header))
+		}
+		req.Header.Set(p.Auth.Header, value)
+	}
+	return nil
+}
+
+func (p *HTTPProvider) Query(ctx context.Context) ([]banking_data.PeriodScore, error) {
+	target, err := p.buildURL()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, p.Method, target, nil)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't build bank request: %v", err))
+	}
+	req.Header.Set("Accept", "application/json")
+	for key, value := range p.Headers {
+		req.Header.Set(key, value)
+	}
+	if err := p.authenticate(req); err != nil {
+		return nil, err
+	}
+
+	ctx, span := telemetry.Tracer(ctx, constants.APP_NAME).Start(ctx, fmt.Sprintf("HTTP %s", p.Method),
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+		oteltrace.WithAttributes(attribute.String("req.bankingInstitutionId", p.Request.BankingInstitutionId)),
+	)
+	defer span.End()
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if ctx.Err() != nil {
+			// Cancelled or out of time on our side, the institution is not to blame
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: bank request failed: %v", core.ErrInstitutionFailure, err)
+	}
+	defer res.Body.Close()
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(res.StatusCode)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(res.StatusCode, oteltrace.SpanKindClient))
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		span.RecordError(err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: couldn't read bank response: %v", core.ErrInstitutionFailure, err)
+	}
+	if res.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("%w: bank responded with status %d", core.ErrInstitutionFailure, res.StatusCode)
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, errors.New(fmt.Sprintf("Bank responded with status %d", res.StatusCode))
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		span.RecordError(err)
+		return nil, errors.New(fmt.Sprintf("Bank response is not valid json: %v", err))
+	}
+	scores, err := p.Mapping.mapScores(payload)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("resp.periods", len(scores)))
+	return scores, nil
+}
+
+func (m *HTTPMappingSettings) mapScores(payload interface{}) ([]banking_data.PeriodScore, error) {
+	rawItems, err := lookupPath(payload, m.Items)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := rawItems.([]interface{})
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Expected a list of scores at %q", m.Items))
+	}
+
+	scores := make([]banking_data.PeriodScore, 0, len(items))
+	for i, item := range items {
+		var periodScore banking_data.PeriodScore
+		if m.Period != "" {
+			period, err := lookupString(item, m.Period)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Item %d: %v", i, err))
+			}
+			parsed, err := time.Parse("2006-01", period)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Item %d: invalid period %q", i, period))
+			}
+			periodScore.Year, periodScore.Month = parsed.Year(), int(parsed.Month())
+		} else {
+			year, err := lookupNumber(item, m.Year)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Item %d: %v", i, err))
+			}
+			month, err := lookupNumber(item, m.Month)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Item %d: %v", i, err))
+			}
+			periodScore.Year, periodScore.Month = int(year), int(month)
+		}
+		if periodScore.Month < 1 || periodScore.Month > 12 {
+			return nil, errors.New(fmt.Sprintf("Item %d: invalid month %d", i, periodScore.Month))
+		}
+		score, err := lookupNumber(item, m.Score)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Item %d: %v", i, err))
+		}
+		periodScore.Score = score
+		scores = append(scores, periodScore)
+	}
+	return scores, nil
+}
+
+// lookupPath walks a decoded json document following a dotted path, an empty path returns the document
+func lookupPath(doc interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return doc, nil
+	}
+	current := doc
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Cannot read %q, %q is not an object", path, key))
+		}
+		if current, ok = object[key]; !ok {
+			return nil, errors.New(fmt.Sprintf("Missing field %q", path))
+		}
+	}
+	return current, nil
+}
+
+func lookupString(doc interface{}, path string) (string, error) {
+	value, err := lookupPath(doc, path)
+	if err != nil {
+		return "", err
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Field %q is not a string", path))
+	}
+	return str, nil
+}
+
+func lookupNumber(doc interface{}, path string) (float64, error) {
+	value, err := lookupPath(doc, path)
+	if err != nil {
+		return 0, err
+	}
+	switch number := value.(type) {
+	case float64:
+		return number, nil
+	case string:
+		parsed, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("Field %q is not a number", path))
+		}
+		return parsed, nil
+	default:
+		return 0, errors.New(fmt.Sprintf("Field %q is not a number", path))
+	}
+}
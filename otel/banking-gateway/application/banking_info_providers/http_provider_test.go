@@ -0,0 +1,157 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHTTPProvider(t *testing.T, settings string, creds map[string]string) core.BankingInfoProvider {
+	t.Helper()
+	factory, err := newHTTPFactory(json.RawMessage(settings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := factory(&core.ProviderRequest{
+		UserId:               "user 1",
+		BankingInstitutionId: "bank",
+		Credentials:          creds,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestHTTPProviderMapsTheResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/users/user%201/scores" {
+			t.Errorf("path = %s", r.URL.EscapedPath())
+		}
+		fmt.Fprint(w, `{"data": {"scores": [{"period": "2022-01", "value": 0.5}, {"period": "2022-02", "value": "0.75"}]}}`)
+	}))
+	defer server.Close()
+
+	provider := newTestHTTPProvider(t, fmt.Sprintf(`{
+		"urlTemplate": "%s/users/{{.UserId}}/scores",
+		"mapping": {"items": "data.scores", "period": "period", "score": "value"}
+	}`, server.URL), nil)
+	scores, err := provider.Query(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 2 || scores[0].Year != 2022 || scores[0].Month != 1 || scores[0].Score != 0.5 || scores[1].Score != 0.75 {
+		t.Fatalf("scores = %+v", scores)
+	}
+}
+
+func TestHTTPProviderFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	provider := newTestHTTPProvider(t, fmt.Sprintf(`{"urlTemplate": "%s"}`, server.URL), nil)
+	_, err := provider.Query(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("Query() = %v, want a 503 error", err)
+	}
+}
+
+func TestHTTPProviderFailsOnMalformedBody(t *testing.T) {
+	for name, body := range map[string]string{
+		"invalid json":  `{"scores": [`,
+		"missing items": `{"other": []}`,
+		"invalid month": `{"scores": [{"year": 2022, "month": 13, "score": 1}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}))
+			defer server.Close()
+
+			provider := newTestHTTPProvider(t, fmt.Sprintf(`{"urlTemplate": "%s", "mapping": {"items": "scores"}}`, server.URL), nil)
+			if _, err := provider.Query(context.Background()); err == nil {
+				t.Fatal("Query() succeeded")
+			}
+		})
+	}
+}
+
+func TestHTTPProviderTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	provider := newTestHTTPProvider(t, fmt.Sprintf(`{"urlTemplate": "%s", "timeout": "50ms"}`, server.URL), nil)
+	start := time.Now()
+	// The timeout of the provider is a failure of the institution
+	if _, err := provider.Query(context.Background()); !errors.Is(err, core.ErrInstitutionFailure) {
+		t.Fatalf("Query() = %v, want an institution failure", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Query() took %v", elapsed)
+	}
+}
+
+func TestHTTPProviderSendsCredentials(t *testing.T) {
+	tests := map[string]struct {
+		auth  string
+		creds map[string]string
+		check func(r *http.Request) bool
+	}{
+		"basic": {
+			auth:  `{"type": "basic"}`,
+			creds: map[string]string{"username": "jdoe", "password": "secret"},
+			check: func(r *http.Request) bool {
+				user, password, ok := r.BasicAuth()
+				return ok && user == "jdoe" && password == "secret"
+			},
+		},
+		"bearer": {
+			auth:  `{"type": "bearer"}`,
+			creds: map[string]string{"token": "abc"},
+			check: func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer abc" },
+		},
+		"header": {
+			auth:  `{"type": "header", "header": "X-Api-Key"}`,
+			creds: map[string]string{"token": "abc"},
+			check: func(r *http.Request) bool { return r.Header.Get("X-Api-Key") == "abc" },
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !test.check(r) || r.Header.Get("X-Client") != "gateway" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(w, `[]`)
+			}))
+			defer server.Close()
+
+			provider := newTestHTTPProvider(t, fmt.Sprintf(`{"urlTemplate": "%s", "headers": {"X-Client": "gateway"}, "auth": %s}`, server.URL, test.auth), test.creds)
+			if _, err := provider.Query(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	provider := newTestHTTPProvider(t, `{"urlTemplate": "http://127.0.0.1:1", "auth": {"type": "bearer"}}`, nil)
+	if _, err := provider.Query(context.Background()); err == nil || !strings.Contains(err.Error(), "Missing bearer token") {
+		t.Fatalf("Query() without a token = %v", err)
+	}
+}
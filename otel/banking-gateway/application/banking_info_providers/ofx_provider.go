@@ -0,0 +1,289 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"banking-gateway/core/constants"
+	"bytes"
+	"common/banking_data"
+	"common/telemetry"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var statementExtensions = []string{".ofx", ".qfx"}
+
+// OFXSettings points the provider to the statements of the users, either a directory holding
+// <userId>.ofx, <userId>.qfx or a <userId>/ folder of statements, or a path template of a single file
+type OFXSettings struct {
+	Directory    string `json:"directory"`
+	PathTemplate string `json:"pathTemplate"`
+}
+
+// OFXProvider turns the transactions of exported OFX/QFX statements into monthly net cash flow scores
+type OFXProvider struct {
+	Directory    string
+	PathTemplate *template.Template
+	Request      *core.ProviderRequest
+}
+
+// ofxTransaction is a STMTTRN aggregate of a statement
+type ofxTransaction struct {
+	Id     string
+	Posted time.Time
+	Amount float64
+}
+
+func newOFXFactory(settings json.RawMessage) (core.ProviderFactory, error) {
+	var cfg OFXSettings
+	if len(settings) > 0 {
+		if err := json.Unmarshal(settings, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	if (cfg.Directory == "") == (cfg.PathTemplate == "") {
+		return nil, errors.New("exactly one of directory or pathTemplate is required")
+	}
+	var pathTemplate *template.Template
+	if cfg.PathTemplate != "" {
+		var err error
+		pathTemplate, err = template.New("path").Option("missingkey=error").Parse(cfg.PathTemplate)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid pathTemplate: %v", err))
+		}
+	}
+	return func(req *core.ProviderRequest) (core.BankingInfoProvider, error) {
+		return &OFXProvider{
+			Directory:    cfg.Directory,
+			PathTemplate: pathTemplate,
+			Request:      req,
+		}, nil
+	}, nil
+}
+
+func (p *OFXProvider) statementFiles() ([]string, error) {
+	// The user id ends up in a path, don't let it walk out of the configured location
+	if p.Request.UserId == "" || strings.ContainsAny(p.Request.UserId, `/\`) || strings.Contains(p.Request.UserId, "..") {
+		return nil, errors.New(fmt.Sprintf("Invalid user id for statement lookup: %q", p.Request.UserId))
+	}
+
+	if p.PathTemplate != nil {
+		var buf bytes.Buffer
+		if err := p.PathTemplate.Execute(&buf, urlTemplateData{
+			UserId:               p.Request.UserId,
+			BankingInstitutionId: p.Request.BankingInstitutionId,
+		}); err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't render path template: %v", err))
+		}
+		return []string{buf.String()}, nil
+	}
+
+	var files []string
+	for _, ext := range statementExtensions {
+		file := filepath.Join(p.Directory, p.Request.UserId+ext)
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	userDir := filepath.Join(p.Directory, p.Request.UserId)
+	entries, err := ioutil.ReadDir(userDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New(fmt.Sprintf("Couldn't list statements of %s: %v", userDir, err))
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && isStatement(entry.Name()) {
+			files = append(files, filepath.Join(userDir, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New(fmt.Sprintf("No statements found for user %s", p.Request.UserId))
+	}
+	return files, nil
+}
+
+func isStatement(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, statementExt := range statementExtensions {
+		if ext == statementExt {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *OFXProvider) Query(ctx context.Context) ([]banking_data.PeriodScore, error) {
+	_, span := telemetry.Tracer(ctx, constants.APP_NAME).Start(ctx, "readStatements")
+	defer span.End()
+
+	files, err := p.statementFiles()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	// Overlapping statements repeat transactions, FITID identifies them
+	seen := make(map[string]bool)
+	var transactions []ofxTransaction
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			span.RecordError(err)
+			return nil, errors.New(fmt.Sprintf("Couldn't read statement %s: %v", file, err))
+		}
+		fileTransactions, err := parseOFX(data)
+		if err != nil {
+			span.RecordError(err)
+			return nil, errors.New(fmt.Sprintf("Couldn't parse statement %s: %v", file, err))
+		}
+		for _, transaction := range fileTransactions {
+			if transaction.Id != "" {
+				if seen[transaction.Id] {
+					continue
+				}
+				seen[transaction.Id] = true
+			}
+			transactions = append(transactions, transaction)
+		}
+	}
+
+	scores := monthlyNetFlow(transactions)
+	span.SetAttributes(
+		attribute.Int("statements.files", len(files)),
+		attribute.Int("statements.transactions", len(transactions)),
+		attribute.Int("resp.periods", len(scores)),
+	)
+	return scores, nil
+}
+
+// monthlyNetFlow adds up the transaction amounts of every month
+func monthlyNetFlow(transactions []ofxTransaction) []banking_data.PeriodScore {
+	byPeriod := make(map[[2]int]float64)
+	for _, transaction := range transactions {
+		year, month, _ := transaction.Posted.Date()
+		byPeriod[[2]int{year, int(month)}] += transaction.Amount
+	}
+	scores := make([]banking_data.PeriodScore, 0, len(byPeriod))
+	for period, amount := range byPeriod {
+		scores = append(scores, banking_data.PeriodScore{
+			Year:  period[0],
+			Month: period[1],
+			Score: math.Round(amount*100) / 100,
+		})
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Year != scores[j].Year {
+			return scores[i].Year < scores[j].Year
+		}
+		return scores[i].Month < scores[j].Month
+	})
+	return scores
+}
+
+// parseOFX reads the STMTTRN aggregates of both SGML (OFX 1.x) and XML (OFX 2.x) statements.
+// SGML leaf elements have no closing tags, so the value of an element is the text up to the next tag.
+func parseOFX(data []byte) ([]ofxTransaction, error) {
+	content := string(data)
+	start := strings.Index(strings.ToUpper(content), "<OFX>")
+	if start < 0 {
+		return nil, errors.New("missing <OFX> element")
+	}
+	content = content[start:]
+
+	var transactions []ofxTransaction
+	var current map[string]string
+	for len(content) > 0 {
+		open := strings.IndexByte(content, '<')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(content[open:], '>')
+		if end < 0 {
+			return nil, errors.New("unterminated tag")
+		}
+		tag := strings.ToUpper(strings.TrimSpace(content[open+1 : open+end]))
+		content = content[open+end+1:]
+
+		next := strings.IndexByte(content, '<')
+		if next < 0 {
+			next = len(content)
+		}
+		value := strings.TrimSpace(content[:next])
+
+		switch {
+		case tag == "STMTTRN":
+			current = make(map[string]string)
+		case tag == "/STMTTRN":
+			if current == nil {
+				return nil, errors.New("unexpected </STMTTRN>")
+			}
+			transaction, err := newOFXTransaction(current)
+			if err != nil {
+				return nil, err
+			}
+			transactions = append(transactions, transaction)
+			current = nil
+		case current != nil && !strings.HasPrefix(tag, "/") && value != "":
+			current[tag] = value
+		}
+	}
+	if current != nil {
+		return nil, errors.New("unterminated <STMTTRN>")
+	}
+	return transactions, nil
+}
+
+func newOFXTransaction(fields map[string]string) (ofxTransaction, error) {
+	posted, err := parseOFXDate(fields["DTPOSTED"])
+	if err != nil {
+		return ofxTransaction{}, err
+	}
+	amount, err := parseOFXAmount(fields["TRNAMT"])
+	if err != nil {
+		return ofxTransaction{}, errors.New(fmt.Sprintf("invalid TRNAMT %q", fields["TRNAMT"]))
+	}
+	return ofxTransaction{
+		Id:     fields["FITID"],
+		Posted: posted,
+		Amount: amount,
+	}, nil
+}
+
+// parseOFXAmount reads a TRNAMT, a single comma is the decimal separator of amounts without a dot, any other comma
+// separates thousands
+func parseOFXAmount(value string) (float64, error) {
+	if !strings.Contains(value, ".") && strings.Count(value, ",") == 1 {
+		value = strings.Replace(value, ",", ".", 1)
+	} else {
+		value = strings.ReplaceAll(value, ",", "")
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// parseOFXDate only keeps the day of an OFX datetime such as 20220315120000.000[-5:EST]
+func parseOFXDate(value string) (time.Time, error) {
+	if len(value) < 8 {
+		return time.Time{}, errors.New(fmt.Sprintf("invalid DTPOSTED %q", value))
+	}
+	posted, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return time.Time{}, errors.New(fmt.Sprintf("invalid DTPOSTED %q", value))
+	}
+	return posted, nil
+}
@@ -0,0 +1,23 @@
+package banking_info_providers
+
+import "testing"
+
+func TestParseOFXAmount(t *testing.T) {
+	for value, want := range map[string]float64{
+		"-12.50":        -12.5,
+		"-12,50":        -12.5,
+		"1,234.56":      1234.56,
+		"1,234,567.89":  1234567.89,
+		"1,234,567":     1234567,
+		"+1000":         1000,
+		"-1,000,000.00": -1000000,
+	} {
+		got, err := parseOFXAmount(value)
+		if err != nil || got != want {
+			t.Errorf("parseOFXAmount(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	if _, err := parseOFXAmount("12.5.0"); err == nil {
+		t.Error("parseOFXAmount(\"12.5.0\") succeeded")
+	}
+}
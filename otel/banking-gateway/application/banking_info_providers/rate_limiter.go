@@ -0,0 +1,205 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"common/banking_data"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+var (
+	rateLimitWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "banking_provider_rate_limit_wait_seconds",
+		Help:    "Time provider calls waited for the rate limit and in-flight cap of their banking institution",
+		Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"institution"})
+	rateLimitThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "banking_provider_throttled_total",
+		Help: "The total number of provider calls deferred because of the quota of their banking institution",
+	}, []string{"institution", "reason"})
+	providerInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "banking_provider_in_flight",
+		Help: "Provider calls currently running for each banking institution",
+	}, []string{"institution"})
+)
+
+type RateLimitSettings struct {
+	// RequestsPerSecond is the token bucket refill rate, zero disables the rate limit
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// Burst is the token bucket size, it defaults to one second worth of requests
+	Burst int `json:"burst"`
+	// MaxInFlight caps the concurrent calls to the institution, zero means no cap
+	MaxInFlight int `json:"maxInFlight"`
+	// MaxWait is how long a call may wait for a token or a slot before it is deferred
+	MaxWait string `json:"maxWait"`
+}
+
+// RateLimiter enforces the quota of a banking institution with a token bucket and a cap of in-flight calls
+type RateLimiter struct {
+	institutionId string
+	rate          float64
+	burst         float64
+	maxWait       time.Duration
+	slots         chan struct{}
+	now           func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(institutionId string, settings RateLimitSettings) (*RateLimiter, error) {
+	maxWait := time.Duration(0)
+	if settings.MaxWait != "" {
+		var err error
+		if maxWait, err = time.ParseDuration(settings.MaxWait); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid rate limit maxWait: %v", err))
+		}
+	}
+	if settings.RequestsPerSecond < 0 || settings.Burst < 0 || settings.MaxInFlight < 0 {
+		return nil, errors.New("Rate limit settings can't be negative")
+	}
+	burst := float64(settings.Burst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(settings.RequestsPerSecond))
+	}
+	limiter := &RateLimiter{
+		institutionId: institutionId,
+		rate:          settings.RequestsPerSecond,
+		burst:         burst,
+		maxWait:       maxWait,
+		now:           time.Now,
+		tokens:        burst,
+	}
+	limiter.last = limiter.now()
+	if settings.MaxInFlight > 0 {
+		limiter.slots = make(chan struct{}, settings.MaxInFlight)
+	}
+	return limiter, nil
+}
+
+// reserve takes a token and returns how long to wait for it, a wait over maxWait takes nothing
+func (l *RateLimiter) reserve() (time.Duration, bool) {
+	if l.rate == 0 {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if wait > l.maxWait {
+		return wait, false
+	}
+	// Borrow the token, the caller sleeps until it is refilled
+	l.tokens--
+	return wait, true
+}
+
+func (l *RateLimiter) throttled(reason string, retryAfter time.Duration) error {
+	rateLimitThrottled.WithLabelValues(l.institutionId, reason).Inc()
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return &core.ThrottledError{
+		BankingInstitutionId: l.institutionId,
+		RetryAfter:           retryAfter,
+		Reason:               reason,
+	}
+}
+
+// acquire waits for a token and an in-flight slot, the returned func frees the slot
+func (l *RateLimiter) acquire(ctx context.Context) (func(), time.Duration, error) {
+	start := l.now()
+	wait, ok := l.reserve()
+	if !ok {
+		return nil, 0, l.throttled("rate", wait)
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, l.now().Sub(start), ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if l.slots == nil {
+		return func() {}, l.now().Sub(start), nil
+	}
+
+	release := func() {
+		<-l.slots
+		providerInFlight.WithLabelValues(l.institutionId).Dec()
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		remaining := l.maxWait - l.now().Sub(start)
+		if remaining <= 0 {
+			return nil, l.now().Sub(start), l.throttled("concurrency", l.maxWait)
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			return nil, l.now().Sub(start), l.throttled("concurrency", l.maxWait)
+		case <-ctx.Done():
+			return nil, l.now().Sub(start), ctx.Err()
+		}
+	}
+	providerInFlight.WithLabelValues(l.institutionId).Inc()
+	return release, l.now().Sub(start), nil
+}
+
+type rateLimitedProvider struct {
+	provider core.BankingInfoProvider
+	limiter  *RateLimiter
+}
+
+func (p *rateLimitedProvider) Query(ctx context.Context) ([]banking_data.PeriodScore, error) {
+	release, waited, err := p.limiter.acquire(ctx)
+	rateLimitWait.WithLabelValues(p.limiter.institutionId).Observe(waited.Seconds())
+	span := oteltrace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int64("ratelimit.wait_ms", waited.Milliseconds()))
+	if err != nil {
+		var throttled *core.ThrottledError
+		if errors.As(err, &throttled) {
+			span.AddEvent("rateLimitThrottled", oteltrace.WithAttributes(
+				attribute.String("ratelimit.reason", throttled.Reason),
+				attribute.Int64("ratelimit.retry_after_ms", throttled.RetryAfter.Milliseconds()),
+			))
+		}
+		return nil, err
+	}
+	defer release()
+	return p.provider.Query(ctx)
+}
+
+func withRateLimit(factory core.ProviderFactory, limiter *RateLimiter) core.ProviderFactory {
+	return func(req *core.ProviderRequest) (core.BankingInfoProvider, error) {
+		provider, err := factory(req)
+		if err != nil {
+			return nil, err
+		}
+		return &rateLimitedProvider{
+			provider: provider,
+			limiter:  limiter,
+		}, nil
+	}
+}
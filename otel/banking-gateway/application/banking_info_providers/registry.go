@@ -0,0 +1,109 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	DEFAULT_PROVIDERS_CONFIG = "config/providers.json"
+)
+
+// InstitutionConfig binds a banking institution id to a provider implementation
+type InstitutionConfig struct {
+	Id             string                  `json:"id"`
+	Provider       string                  `json:"provider"`
+	Settings       json.RawMessage         `json:"settings"`
+	CircuitBreaker *CircuitBreakerSettings `json:"circuitBreaker"`
+	RateLimit      *RateLimitSettings      `json:"rateLimit"`
+	Cache          *CacheSettings          `json:"cache"`
+}
+
+type Config struct {
+	Institutions []InstitutionConfig `json:"institutions"`
+}
+
+// providerBuilder turns the settings of an institution into a factory of providers
+type providerBuilder func(settings json.RawMessage) (core.ProviderFactory, error)
+
+var builders = map[string]providerBuilder{
+	"simulator": newSimulatorFactory,
+	"http":      newHTTPFactory,
+	"ofx":       newOFXFactory,
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't read providers config %s: %v", path, err))
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't parse providers config %s: %v", path, err))
+	}
+	return &cfg, nil
+}
+
+func NewRegistry(cfg *Config) (*core.Registry, error) {
+	registry := core.NewRegistry()
+	for _, institution := range cfg.Institutions {
+		if institution.Id == "" {
+			return nil, errors.New("Banking institution without id in providers config")
+		}
+		builder, ok := builders[institution.Provider]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown provider %s for banking institution %s", institution.Provider, institution.Id))
+		}
+		factory, err := builder(institution.Settings)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't configure banking institution %s: %v", institution.Id, err))
+		}
+
+		breakerSettings := defaultCircuitBreakerSettings()
+		if institution.CircuitBreaker != nil {
+			breakerSettings = mergeCircuitBreakerSettings(breakerSettings, *institution.CircuitBreaker)
+		}
+		breaker, err := NewCircuitBreaker(institution.Id, breakerSettings)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't configure banking institution %s: %v", institution.Id, err))
+		}
+		factory = withCircuitBreaker(factory, breaker)
+
+		// Throttled calls never reach the breaker, they say nothing about the institution health
+		if institution.RateLimit != nil {
+			limiter, err := NewRateLimiter(institution.Id, *institution.RateLimit)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Couldn't configure banking institution %s: %v", institution.Id, err))
+			}
+			factory = withRateLimit(factory, limiter)
+		}
+
+		// Cache hits neither spend the quota nor count for the breaker
+		if institution.Cache != nil {
+			cache, err := NewResultCache(institution.Id, *institution.Cache)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Couldn't configure banking institution %s: %v", institution.Id, err))
+			}
+			factory = withCache(factory, cache)
+		}
+		registry.Register(institution.Id, factory)
+	}
+	return registry, nil
+}
+
+// NewRegistryFromEnv builds the registry from the file set in BANKING_PROVIDERS_CONFIG
+func NewRegistryFromEnv() (*core.Registry, error) {
+	path := os.Getenv("BANKING_PROVIDERS_CONFIG")
+	if path == "" {
+		path = DEFAULT_PROVIDERS_CONFIG
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRegistry(cfg)
+}
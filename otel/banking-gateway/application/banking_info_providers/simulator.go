@@ -0,0 +1,190 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"common/banking_data"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	SCENARIO_PRIME           = "prime"
+	SCENARIO_SUBPRIME        = "subprime"
+	SCENARIO_THIN_FILE       = "thin-file"
+	SCENARIO_VOLATILE_INCOME = "volatile-income"
+	SCENARIO_OVERDRAFT_HEAVY = "overdraft-heavy"
+	// SCENARIO_AUTO picks the scenario of each user from its id
+	SCENARIO_AUTO = "auto"
+)
+
+// Scenario describes the monthly cash flow of a simulated customer
+type Scenario struct {
+	Income               float64
+	IncomeVolatility     float64
+	Spending             float64
+	SpendingVolatility   float64
+	OverdraftProbability float64
+	OverdraftFee         float64
+	// HistoryMonths limits how far back the customer has data, zero means since StartFromYear
+	HistoryMonths int
+}
+
+var scenarios = map[string]Scenario{
+	SCENARIO_PRIME: {
+		Income:             5200,
+		IncomeVolatility:   0.03,
+		Spending:           3600,
+		SpendingVolatility: 0.08,
+	},
+	SCENARIO_SUBPRIME: {
+		Income:               2400,
+		IncomeVolatility:     0.1,
+		Spending:             2450,
+		SpendingVolatility:   0.15,
+		OverdraftProbability: 0.15,
+		OverdraftFee:         35,
+	},
+	SCENARIO_THIN_FILE: {
+		Income:             2800,
+		IncomeVolatility:   0.05,
+		Spending:           2500,
+		SpendingVolatility: 0.1,
+		HistoryMonths:      4,
+	},
+	SCENARIO_VOLATILE_INCOME: {
+		Income:             4000,
+		IncomeVolatility:   0.6,
+		Spending:           3300,
+		SpendingVolatility: 0.1,
+	},
+	SCENARIO_OVERDRAFT_HEAVY: {
+		Income:               3000,
+		IncomeVolatility:     0.05,
+		Spending:             3350,
+		SpendingVolatility:   0.12,
+		OverdraftProbability: 0.6,
+		OverdraftFee:         35,
+	},
+}
+
+var scenarioNames = []string{
+	SCENARIO_PRIME,
+	SCENARIO_SUBPRIME,
+	SCENARIO_THIN_FILE,
+	SCENARIO_VOLATILE_INCOME,
+	SCENARIO_OVERDRAFT_HEAVY,
+}
+
+type simulatorSettings struct {
+	Scenario      string `json:"scenario"`
+	StartFromYear int    `json:"startFromYear"`
+	// Now pins the clock to a 2006-01-02 date, so the simulated history doesn't move with the current month
+	Now string `json:"now"`
+}
+
+// Simulator derives the banking history of a user from its id and a scenario, the same
+// user, scenario and clock always give the same scores
+type Simulator struct {
+	UserId        string
+	Scenario      string
+	StartFromYear int
+	// Clock returns the current time, the last simulated month is the one before it
+	Clock func() time.Time
+}
+
+func newSimulatorFactory(settings json.RawMessage) (core.ProviderFactory, error) {
+	cfg := simulatorSettings{
+		Scenario:      SCENARIO_PRIME,
+		StartFromYear: 2015,
+	}
+	if len(settings) > 0 {
+		if err := json.Unmarshal(settings, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := scenarios[cfg.Scenario]; !ok && cfg.Scenario != SCENARIO_AUTO {
+		return nil, errors.New(fmt.Sprintf("Unknown simulator scenario %s", cfg.Scenario))
+	}
+	clock := time.Now
+	if cfg.Now != "" {
+		now, err := time.Parse("2006-01-02", cfg.Now)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid simulator now %q, expected a 2006-01-02 date", cfg.Now))
+		}
+		clock = func() time.Time { return now }
+	}
+	return func(req *core.ProviderRequest) (core.BankingInfoProvider, error) {
+		return &Simulator{
+			UserId:        req.UserId,
+			Scenario:      cfg.Scenario,
+			StartFromYear: cfg.StartFromYear,
+			Clock:         clock,
+		}, nil
+	}, nil
+}
+
+func hashOf(parts ...string) uint64 {
+	h := fnv.New64a()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+func (s *Simulator) scenarioName() string {
+	if s.Scenario != SCENARIO_AUTO {
+		return s.Scenario
+	}
+	return scenarioNames[hashOf(s.UserId)%uint64(len(scenarioNames))]
+}
+
+// vary moves value randomly up to volatility times itself in both directions
+func vary(rng *rand.Rand, value, volatility float64) float64 {
+	return value * (1 + volatility*(2*rng.Float64()-1))
+}
+
+func (s *Simulator) Query(ctx context.Context) ([]banking_data.PeriodScore, error) {
+	name := s.scenarioName()
+	scenario, ok := scenarios[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown simulator scenario %s", name))
+	}
+
+	year, month, _ := s.Clock().Date()
+	end := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	start := time.Date(s.StartFromYear, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if scenario.HistoryMonths > 0 {
+		// Thin files still differ between users by a few months of history
+		historyMonths := scenario.HistoryMonths + int(hashOf(s.UserId, name)%3)
+		if historyStart := end.AddDate(0, -historyMonths, 0); historyStart.After(start) {
+			start = historyStart
+		}
+	}
+
+	var resp []banking_data.PeriodScore
+	for period := start; period.Before(end); period = period.AddDate(0, 1, 0) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// Every month has its own seed, so a month's score doesn't depend on the queried range
+		rng := rand.New(rand.NewSource(int64(hashOf(s.UserId, name, period.Format("2006-01")))))
+		score := vary(rng, scenario.Income, scenario.IncomeVolatility) - vary(rng, scenario.Spending, scenario.SpendingVolatility)
+		if rng.Float64() < scenario.OverdraftProbability {
+			overdrafts := 1 + rng.Intn(4)
+			score -= float64(overdrafts) * scenario.OverdraftFee
+		}
+		resp = append(resp, banking_data.PeriodScore{
+			Year:  period.Year(),
+			Month: int(period.Month()),
+			Score: math.Round(score*100) / 100,
+		})
+	}
+	return resp, nil
+}
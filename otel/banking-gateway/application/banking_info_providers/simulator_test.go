@@ -0,0 +1,35 @@
+package banking_info_providers
+
+import (
+	core "banking-gateway/core/banking_info_providers"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestSimulatorUsesTheConfiguredClock(t *testing.T) {
+	factory, err := newSimulatorFactory(json.RawMessage(`{"scenario": "prime", "startFromYear": 2021, "now": "2022-03-15"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := factory(&core.ProviderRequest{UserId: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, err := provider.Query(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := scores[len(scores)-1]
+	if len(scores) != 14 || last.Year != 2022 || last.Month != 2 {
+		t.Fatalf("got %d scores ending at %d-%d, want 14 ending at 2022-2", len(scores), last.Year, last.Month)
+	}
+	again, _ := provider.Query(context.Background())
+	if again[len(again)-1] != last {
+		t.Fatalf("the same clock gave %+v and %+v", last, again[len(again)-1])
+	}
+
+	if _, err := newSimulatorFactory(json.RawMessage(`{"now": "March"}`)); err == nil {
+		t.Fatal("newSimulatorFactory() accepted an invalid now")
+	}
+}
@@ -1,11 +1,22 @@
 package controllers
 
 import (
-	msgbroker "banking-gateway/application/msg-broker"
-
 	"github.com/gofiber/fiber/v2"
 )
 
+// HealthReporter is implemented by the message broker clients
+type HealthReporter interface {
+	IsReady() bool
+	IsHealthy() bool
+}
+
+var brokers []HealthReporter
+
+// WatchBrokers sets the clients checked by the probes
+func WatchBrokers(clients ...HealthReporter) {
+	brokers = clients
+}
+
 // Ready godoc
 // @Summary Readiness probe
 // @Description Readiness of the jwk service
@@ -13,10 +24,15 @@ import (
 // @Success 200
 // @Router /readiness [get]
 func ReadinessProbe(c *fiber.Ctx) error {
-	if msgbroker.IsInitialized {
-		return c.SendStatus(200)
+	if len(brokers) == 0 {
+		return c.SendStatus(500)
 	}
-	return c.SendStatus(500)
+	for _, broker := range brokers {
+		if !broker.IsReady() {
+			return c.SendStatus(500)
+		}
+	}
+	return c.SendStatus(200)
 }
 
 // Healthy godoc
@@ -26,8 +42,13 @@ func ReadinessProbe(c *fiber.Ctx) error {
 // @Success 200
 // @Router /healthz [get]
 func Healthz(c *fiber.Ctx) error {
-	if msgbroker.IsHealthy {
-		return c.SendStatus(200)
+	if len(brokers) == 0 {
+		return c.SendStatus(500)
+	}
+	for _, broker := range brokers {
+		if !broker.IsHealthy() {
+			return c.SendStatus(500)
+		}
 	}
-	return c.SendStatus(500)
+	return c.SendStatus(200)
 }
@@ -0,0 +1,55 @@
+// Package bolt_queue runs the messaging clients over the queues of a bbolt file, shared by the services of the machine
+package bolt_queue
+
+import (
+	"banking-gateway/application/msg-broker/queue_client"
+	"common/queue"
+	"common/queue/bolt_queue"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_VISIBILITY_TIMEOUT = time.Second * 15
+	DEFAULT_MAX_RECEIVE_COUNT  = 5
+)
+
+// New runs the client over the queues named by BANKING_REQUESTS_QUEUE_NAME, BANKING_RESPONSES_QUEUE_NAME and
+// BANKING_REQUESTS_DLQ_NAME in the file of BOLT_QUEUE_PATH. BOLT_QUEUE_VISIBILITY_TIMEOUT is how long a received
+// message stays invisible, BOLT_QUEUE_MAX_RECEIVE_COUNT how many times it is received before moving to the dead letter queue.
+func New() (*queue_client.Client, error) {
+	visibilityTimeout := DEFAULT_VISIBILITY_TIMEOUT
+	if value := os.Getenv("BOLT_QUEUE_VISIBILITY_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid BOLT_QUEUE_VISIBILITY_TIMEOUT %q, expected a positive duration", value))
+		}
+		visibilityTimeout = parsed
+	}
+	maxReceiveCount := DEFAULT_MAX_RECEIVE_COUNT
+	if value := os.Getenv("BOLT_QUEUE_MAX_RECEIVE_COUNT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid BOLT_QUEUE_MAX_RECEIVE_COUNT %q, expected a positive number", value))
+		}
+		maxReceiveCount = parsed
+	}
+	store, err := bolt_queue.OpenFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	var deadLetters queue.Backend
+	if dlqName := os.Getenv("BANKING_REQUESTS_DLQ_NAME"); dlqName != "" {
+		deadLetters = store.Queue(dlqName)
+	}
+	return queue_client.NewClient(
+		store.Queue(queue_client.QueueName("BANKING_REQUESTS_QUEUE_NAME", queue_client.DEFAULT_REQUESTS_QUEUE_NAME)),
+		store.Queue(queue_client.QueueName("BANKING_RESPONSES_QUEUE_NAME", queue_client.DEFAULT_RESPONSES_QUEUE_NAME)),
+		deadLetters,
+		visibilityTimeout,
+		maxReceiveCount,
+	), nil
+}
@@ -0,0 +1,74 @@
+package bolt_queue
+
+import (
+	"banking-gateway/application/msg-broker/queue_client"
+	"banking-gateway/application/tracing"
+	msg_broker_iface "banking-gateway/core/msg_broker"
+	"common/banking_data"
+	"common/queue/bolt_queue"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFailingMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), bolt_queue.DEFAULT_FILENAME)
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	t.Setenv("BOLT_QUEUE_PATH", path)
+	t.Setenv("BOLT_QUEUE_VISIBILITY_TIMEOUT", "50ms")
+	t.Setenv("BOLT_QUEUE_MAX_RECEIVE_COUNT", "2")
+	t.Setenv("BANKING_REQUESTS_DLQ_NAME", "banking-requests-dlq")
+	tracing.NewProvider()
+	client, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(msg_broker_iface.BankingDataRequest{
+		Version:              banking_data.SCHEMA_VERSION,
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	if _, err := client.Requests().Send(body, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dead letter queue is read through a store of its own, as another process would
+	store, err := bolt_queue.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	attempts := 0
+	go func() {
+		defer close(stopped)
+		client.Recv(ctx, func(ctx context.Context, req *msg_broker_iface.BankingDataRequest) error {
+			attempts++
+			return errors.New("banking institution failed")
+		})
+	}()
+	ctxReceive, cancelReceive := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelReceive()
+	msgs, err := store.Queue("banking-requests-dlq").Receive(ctxReceive, 1, time.Minute)
+	cancel()
+	<-stopped
+	if err != nil {
+		t.Fatalf("expected the message in the dead letter queue: %v", err)
+	}
+
+	headers := msgs[0].Headers
+	if headers["FailureReason"] != queue_client.QUARANTINE_MAX_RECEIVES || headers["ReceiveCount"] != "2" || headers["Attempts"] != "2" {
+		t.Fatalf("unexpected dead letter headers %v", headers)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+	ctxEmpty, cancelEmpty := context.WithTimeout(context.Background(), 2*bolt_queue.POLL_INTERVAL)
+	defer cancelEmpty()
+	if _, err := client.Requests().Receive(ctxEmpty, 1, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the quarantined message to leave the requests queue, got %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+// Package jetstream implements the messaging clients over NATS JetStream, the streams, headers and heartbeat come
+// from common/jetstream_broker.
+package jetstream
+
+import (
+	"banking-gateway/application/tracing"
+	"banking-gateway/core/constants"
+	msg_broker_iface "banking-gateway/core/msg_broker"
+	"common/jetstream_broker"
+	"common/telemetry"
+	"common/worker_pool"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Quarantine reasons, sent as the FailureReason header of the dead letter
+	QUARANTINE_MALFORMED       = "malformed"
+	QUARANTINE_MAX_RECEIVES    = "max_receives_exceeded"
+	MAX_FAILURE_MESSAGE_LENGTH = 1024
+)
+
+var (
+	opsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "total_jetstream_requests_processed",
+		Help: "The total number of processed events for banking calls received from jetstream",
+	})
+)
+
+// Client implements msg_broker.Client over the subjects named by BANKING_REQUESTS_QUEUE_NAME and
+// BANKING_RESPONSES_QUEUE_NAME, failed messages move to BANKING_REQUESTS_DLQ_NAME when it is set
+type Client struct {
+	conn         *nats.Conn
+	js           nats.JetStreamContext
+	requests     string
+	responses    string
+	deadLetters  string
+	subscription *nats.Subscription
+	settings     jetstream_broker.Settings
+	// lastFetchFail is set by the fetching goroutine and read by the probes, 1 while fetching fails
+	lastFetchFail int32
+	redactor      *telemetry.Redactor
+}
+
+func New() (*Client, error) {
+	settings, err := jetstream_broker.SettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	conn, js, err := jetstream_broker.Connect()
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{
+		conn:        conn,
+		js:          js,
+		requests:    os.Getenv("BANKING_REQUESTS_QUEUE_NAME"),
+		responses:   os.Getenv("BANKING_RESPONSES_QUEUE_NAME"),
+		deadLetters: os.Getenv("BANKING_REQUESTS_DLQ_NAME"),
+		settings:    settings,
+		redactor:    telemetry.NewRedactorFromEnv(),
+	}
+	if err := jetstream_broker.EnsureStream(js, client.responses); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if client.deadLetters != "" {
+		if err := jetstream_broker.EnsureStream(js, client.deadLetters); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	client.subscription, err = jetstream_broker.Subscribe(js, client.requests, constants.APP_NAME, settings.AckWait)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// IsReady is true while the connection is open, it may be reconnecting
+func (c *Client) IsReady() bool {
+	return !c.conn.IsClosed()
+}
+
+// IsHealthy is false while disconnected or fetching from the requests stream fails
+func (c *Client) IsHealthy() bool {
+	return c.conn.IsConnected() && atomic.LoadInt32(&c.lastFetchFail) == 0
+}
+
+func (c *Client) Send(ctx context.Context, resp *msg_broker_iface.BankingDataResponse) error {
+	tp := tracing.NewProvider()
+	ctxCall, span := tp.GetTracer().Start(ctx, "sentResponse", oteltrace.WithAttributes(
+		attribute.String("req.userId", resp.Data.UserId),
+		attribute.String("req.bankingInstitutionId", resp.Data.BankingInstitutionId),
+	))
+	defer span.End()
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		span.RecordError(err)
+		return errors.New(fmt.Sprintf("Cannot marshall message data: %v", err))
+	}
+
+	log.Println(fmt.Sprintf("Sent banking data response bankingInstitutionId=%s userId=%s", resp.Data.BankingInstitutionId, resp.Data.UserId))
+	if err := jetstream_broker.Publish(ctxCall, c.js, c.responses, data, nil); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) Recv(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error) error {
+	pool, err := worker_pool.NewFromEnv("banking_requests")
+	if err != nil {
+		return err
+	}
+	tp := tracing.NewProvider()
+	log.Println(fmt.Sprintf("Listening subject: %s", c.requests))
+	for ctx.Err() == nil {
+		// Fetching pauses while all the workers are busy and the queue is full
+		free, err := pool.WaitForCapacity(ctx)
+		if err != nil {
+			break
+		}
+		if free > jetstream_broker.MAX_MESSAGES {
+			free = jetstream_broker.MAX_MESSAGES
+		}
+		receivedAt := time.Now()
+		ctxFetch, cancel := context.WithTimeout(ctx, c.settings.FetchWait)
+		msgs, err := c.subscription.Fetch(free, nats.Context(ctxFetch))
+		cancel()
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil && !jetstream_broker.IsFetchTimeout(err) {
+			// Record error in a new span
+			atomic.StoreInt32(&c.lastFetchFail, 1)
+			_, span := tp.GetTracer().Start(context.Background(), "receiveBankingMsgs")
+			log.Println(fmt.Sprintf("Couldn't recieve message : %v", err))
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+			span.End()
+			jetstream_broker.SleepCtx(ctx, jetstream_broker.RECV_ERROR_BACKOFF)
+			continue
+		}
+		atomic.StoreInt32(&c.lastFetchFail, 0)
+
+		for _, msg := range msgs {
+			msg := msg
+			var req msg_broker_iface.BankingDataRequest
+			var reqErr error
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				reqErr = errors.New(fmt.Sprintf("Unknown message format, cannot parse the json body: %v", err))
+			} else if err := req.Validate(); err != nil {
+				reqErr = errors.New(fmt.Sprintf("Invalid banking data request %s: %v", jetstream_broker.MessageId(msg), err))
+			}
+
+			// The message is not tied to ctx, once received it is processed even if fetching stops
+			ctxSpan, span := tp.GetTracer().Start(jetstream_broker.ProducerContext(msg, req.TracingInformation.Traceparent, req.TracingInformation.Tracestate), "processBankingMsg",
+				oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+				oteltrace.WithAttributes(
+					semconv.MessagingSystemKey.String(jetstream_broker.MESSAGING_SYSTEM),
+					semconv.MessagingDestinationKey.String(c.requests),
+					semconv.MessagingOperationProcess,
+					semconv.MessagingMessageIDKey.String(jetstream_broker.MessageId(msg)),
+					attribute.Int("messaging.receive_count", jetstream_broker.ReceiveCount(msg)),
+				),
+			)
+			if reqErr != nil {
+				// Retrying won't make the message valid, move it out of the way right away
+				log.Println(fmt.Sprintf("Couldn't recieve message : %v", reqErr))
+				span.RecordError(reqErr)
+				span.SetStatus(codes.Error, "invalid message")
+				c.quarantine(ctxSpan, msg, QUARANTINE_MALFORMED, reqErr)
+				span.End()
+				continue
+			}
+
+			// The message is kept from redelivery from the moment it's fetched, time queued in the pool counts too
+			heartbeat := jetstream_broker.StartHeartbeat(ctxSpan, msg, c.settings.AckWait, receivedAt, c.settings.MaxProcessingTime)
+
+			err = pool.Submit(func() {
+				c.processMsg(ctxSpan, handlerFunc, msg, &req, heartbeat)
+			})
+			if err != nil {
+				heartbeat.Stop()
+				// The message is redelivered once the ack wait expires
+				log.Println(fmt.Sprintf("Couldn't schedule message %s : %v", jetstream_broker.MessageId(msg), err))
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				span.End()
+			}
+		}
+	}
+
+	log.Println("Stopping fetching because a context kill signal was sent, waiting for in-flight messages")
+	pool.Close()
+	return nil
+}
+
+func (c *Client) processMsg(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error, msg *nats.Msg, req *msg_broker_iface.BankingDataRequest, heartbeat *jetstream_broker.ProgressHeartbeat) {
+	span := oteltrace.SpanFromContext(ctx)
+	defer span.End()
+	defer heartbeat.Stop()
+
+	// The heartbeat stops extending the ack wait at the deadline, stop working on the message by then
+	ctxHandler, cancel := context.WithDeadline(ctx, heartbeat.Deadline)
+	defer cancel()
+
+	log.Println(fmt.Sprintf("Recieved banking data request %s bankingInstitutionId=%s userId=%s", jetstream_broker.MessageId(msg), req.BankingInstitutionId, req.UserId))
+	ctxHandler = msg_broker_iface.WithDelivery(ctxHandler, msg_broker_iface.Delivery{Attempt: jetstream_broker.ReceiveCount(msg), MaxAttempts: c.settings.MaxReceiveCount})
+	err := callHandler(ctxHandler, handlerFunc, req)
+	// Stop extending before acking, a progress update after the ack would be rejected
+	heartbeat.Stop()
+	var deferErr *msg_broker_iface.DeferError
+	switch {
+	case err == nil:
+		if err := msg.AckSync(); err != nil {
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't ack message %s : %v", jetstream_broker.MessageId(msg), err)))
+			log.Println(fmt.Sprintf("Couldn't ack message %s : %v", jetstream_broker.MessageId(msg), err))
+		}
+		opsProcessed.Inc()
+	case errors.As(err, &deferErr):
+		// Deferrals aren't failures, they never quarantine the message by themselves. JetStream still counts the
+		// deferred deliveries in NumDelivered, JETSTREAM_MAX_RECEIVE_COUNT must leave room for them
+		span.AddEvent("messageDeferred", oteltrace.WithAttributes(
+			attribute.Int64("messaging.defer_seconds", int64(deferErr.Delay.Seconds())),
+			attribute.String("messaging.defer_reason", deferErr.Reason.Error()),
+		))
+		if err := msg.NakWithDelay(deferErr.Delay); err != nil {
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't defer message %s : %v", jetstream_broker.MessageId(msg), err)))
+			log.Println(fmt.Sprintf("Couldn't defer message %s : %v", jetstream_broker.MessageId(msg), err))
+		}
+	default:
+		newErr := errors.New(fmt.Sprintf("Couldn't process message %s :%v", jetstream_broker.MessageId(msg), err))
+		log.Println(newErr)
+		span.RecordError(newErr)
+		if errors.Is(err, context.DeadlineExceeded) {
+			span.SetStatus(codes.Error, "processing timed out")
+		}
+		// The deadline of the handler may have passed, quarantine with the context of the span
+		if jetstream_broker.ReceiveCount(msg) >= c.settings.MaxReceiveCount && c.quarantine(ctx, msg, QUARANTINE_MAX_RECEIVES, err) == nil {
+			return
+		}
+		// Like an SQS message whose visibility timeout expires, the message comes back after the ack wait
+		if err := msg.NakWithDelay(c.settings.AckWait); err != nil {
+			log.Println(fmt.Sprintf("Couldn't nak message %s : %v", jetstream_broker.MessageId(msg), err))
+		}
+	}
+}
+
+// quarantine publishes the message to the dead letter subject and terminates it, without one the message is redelivered
+func (c *Client) quarantine(ctx context.Context, msg *nats.Msg, reason string, cause error) error {
+	if c.deadLetters == "" {
+		err := errors.New(fmt.Sprintf("No dead letter queue configured, message %s stays in its stream", jetstream_broker.MessageId(msg)))
+		log.Println(err)
+		return err
+	}
+	// Errors may quote what they failed on, the headers outlive the logs and the traces
+	failure := c.redactor.String(cause.Error())
+	if len(failure) > MAX_FAILURE_MESSAGE_LENGTH {
+		failure = failure[:MAX_FAILURE_MESSAGE_LENGTH]
+	}
+	header := nats.Header{}
+	header.Set("FailureReason", reason)
+	header.Set("FailureMessage", failure)
+	header.Set("SourceQueue", c.requests)
+	header.Set("SourceMessageId", jetstream_broker.MessageId(msg))
+	header.Set("ReceiveCount", strconv.Itoa(jetstream_broker.ReceiveCount(msg)))
+	if err := jetstream_broker.Publish(ctx, c.js, c.deadLetters, msg.Data, header); err != nil {
+		log.Println(fmt.Sprintf("Couldn't quarantine message %s : %v", jetstream_broker.MessageId(msg), err))
+		return err
+	}
+	log.Println(fmt.Sprintf("Quarantined message %s reason=%s receiveCount=%d", jetstream_broker.MessageId(msg), reason, jetstream_broker.ReceiveCount(msg)))
+	// Term stops the redeliveries, the server drops the message from the work queue
+	if err := msg.Term(); err != nil {
+		log.Println(fmt.Sprintf("Couldn't terminate quarantined message %s : %v", jetstream_broker.MessageId(msg), err))
+	}
+	return nil
+}
+
+// callHandler turns a panic of the handler into an error, so a poison message counts as a failed attempt
+func callHandler(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error, req *msg_broker_iface.BankingDataRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("handler panicked: %v", r))
+		}
+	}()
+	return handlerFunc(ctx, req)
+}
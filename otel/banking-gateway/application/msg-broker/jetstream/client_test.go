@@ -0,0 +1,292 @@
+package jetstream
+
+import (
+	"banking-gateway/application/tracing"
+	msg_broker_iface "banking-gateway/core/msg_broker"
+	"common/banking_data"
+	"common/jetstream_broker"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TEST_ACK_WAIT          = 300 * time.Millisecond
+	TEST_MAX_RECEIVE_COUNT = 3
+)
+
+// newTestClient runs a JetStream server of its own and connects a client to it
+func newTestClient(t *testing.T) *Client {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsserver.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	t.Setenv("NATS_URL", srv.ClientURL())
+	t.Setenv("BANKING_REQUESTS_QUEUE_NAME", "banking-requests")
+	t.Setenv("BANKING_RESPONSES_QUEUE_NAME", "banking-responses")
+	t.Setenv("BANKING_REQUESTS_DLQ_NAME", "banking-requests-dlq")
+	t.Setenv("JETSTREAM_ACK_WAIT", TEST_ACK_WAIT.String())
+	t.Setenv("JETSTREAM_FETCH_WAIT", "50ms")
+	t.Setenv("JETSTREAM_MAX_RECEIVE_COUNT", strconv.Itoa(TEST_MAX_RECEIVE_COUNT))
+	tracing.NewProvider()
+	client, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.conn.Close)
+	return client
+}
+
+func publishRequest(t *testing.T, client *Client, ctx context.Context) {
+	body, _ := json.Marshal(msg_broker_iface.BankingDataRequest{
+		Version:              banking_data.SCHEMA_VERSION,
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	if err := jetstream_broker.Publish(ctx, client.js, client.requests, body, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// delivery is a call of the handler
+type delivery struct {
+	at          time.Time
+	lastAttempt bool
+	spanContext oteltrace.SpanContext
+}
+
+// recvUntil runs Recv with handler until done returns true for the deliveries so far
+func recvUntil(t *testing.T, client *Client, handler func(ctx context.Context, attempt int) error, done func([]delivery) bool) []delivery {
+	var mu sync.Mutex
+	var deliveries []delivery
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Recv(ctx, func(ctx context.Context, req *msg_broker_iface.BankingDataRequest) error {
+			mu.Lock()
+			deliveries = append(deliveries, delivery{
+				at:          time.Now(),
+				lastAttempt: msg_broker_iface.LastAttempt(ctx),
+				spanContext: oteltrace.SpanContextFromContext(ctx),
+			})
+			attempt := len(deliveries)
+			mu.Unlock()
+			return handler(ctx, attempt)
+		})
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		finished := done(append([]delivery(nil), deliveries...))
+		mu.Unlock()
+		if finished {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !done(deliveries) {
+		t.Fatalf("timed out after %d deliveries", len(deliveries))
+	}
+	return deliveries
+}
+
+// pendingMessages counts the messages of the stream of the queue, acked and terminated messages leave a work queue
+func pendingMessages(t *testing.T, client *Client, queueName string) uint64 {
+	info, err := client.js.StreamInfo(jetstream_broker.StreamName(queueName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.State.Msgs
+}
+
+// waitForEmptyStream waits until the acks reach the server
+func waitForEmptyStream(t *testing.T, client *Client, queueName string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for pendingMessages(t, client, queueName) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the messages of %s to be acknowledged", queueName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func count(n int) func([]delivery) bool {
+	return func(deliveries []delivery) bool { return len(deliveries) >= n }
+}
+
+func TestAckedMessageIsNotRedelivered(t *testing.T) {
+	client := newTestClient(t)
+	publishRequest(t, client, context.Background())
+
+	recvUntil(t, client, func(ctx context.Context, attempt int) error { return nil }, count(1))
+	waitForEmptyStream(t, client, client.requests)
+}
+
+func TestFailedMessageIsRedeliveredAfterTheAckWait(t *testing.T) {
+	client := newTestClient(t)
+	publishRequest(t, client, context.Background())
+
+	deliveries := recvUntil(t, client, func(ctx context.Context, attempt int) error {
+		if attempt == 1 {
+			return errors.New("banking institution failed")
+		}
+		return nil
+	}, count(2))
+
+	if gap := deliveries[1].at.Sub(deliveries[0].at); gap < TEST_ACK_WAIT {
+		t.Fatalf("expected the redelivery after the ack wait %v, got %v", TEST_ACK_WAIT, gap)
+	}
+	if deliveries[0].lastAttempt || deliveries[1].lastAttempt {
+		t.Fatal("expected attempts before JETSTREAM_MAX_RECEIVE_COUNT not to be the last")
+	}
+	waitForEmptyStream(t, client, client.requests)
+}
+
+func TestDeferredMessageIsRedeliveredAfterItsDelay(t *testing.T) {
+	client := newTestClient(t)
+	publishRequest(t, client, context.Background())
+	delay := 2 * TEST_ACK_WAIT
+
+	deliveries := recvUntil(t, client, func(ctx context.Context, attempt int) error {
+		if attempt == 1 {
+			return &msg_broker_iface.DeferError{Delay: delay, Reason: errors.New("rate limited")}
+		}
+		return nil
+	}, count(2))
+
+	if gap := deliveries[1].at.Sub(deliveries[0].at); gap < delay {
+		t.Fatalf("expected the redelivery after the delay %v, got %v", delay, gap)
+	}
+	waitForEmptyStream(t, client, client.requests)
+}
+
+func TestSlowMessageIsKeptInProgress(t *testing.T) {
+	client := newTestClient(t)
+	publishRequest(t, client, context.Background())
+
+	var finished sync.WaitGroup
+	finished.Add(1)
+	deliveries := recvUntil(t, client, func(ctx context.Context, attempt int) error {
+		if attempt == 1 {
+			defer finished.Done()
+			// The heartbeat tells the server the message is in progress, it is not redelivered meanwhile
+			time.Sleep(3 * TEST_ACK_WAIT)
+		}
+		return nil
+	}, count(1))
+	finished.Wait()
+	waitForEmptyStream(t, client, client.requests)
+
+	if len(deliveries) != 1 {
+		t.Fatalf("expected a single delivery, got %d", len(deliveries))
+	}
+}
+
+func TestFailingMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	client := newTestClient(t)
+	publishRequest(t, client, context.Background())
+
+	deliveries := recvUntil(t, client, func(ctx context.Context, attempt int) error {
+		return errors.New("banking institution failed")
+	}, count(TEST_MAX_RECEIVE_COUNT))
+	waitForEmptyStream(t, client, client.requests)
+
+	if !deliveries[TEST_MAX_RECEIVE_COUNT-1].lastAttempt {
+		t.Fatal("expected the last delivery to be the last attempt")
+	}
+	sub, err := client.js.PullSubscribe(client.deadLetters, "test", nats.BindStream(jetstream_broker.StreamName(client.deadLetters)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := msgs[0].Header
+	if header.Get("FailureReason") != QUARANTINE_MAX_RECEIVES || header.Get("ReceiveCount") != strconv.Itoa(TEST_MAX_RECEIVE_COUNT) {
+		t.Fatalf("unexpected dead letter headers %v", header)
+	}
+}
+
+func TestTraceContextTravelsInTheHeaders(t *testing.T) {
+	client := newTestClient(t)
+	traceID, _ := oteltrace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := oteltrace.SpanIDFromHex("00f067aa0ba902b7")
+	producer := oteltrace.ContextWithSpanContext(context.Background(), oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: oteltrace.FlagsSampled,
+	}))
+	publishRequest(t, client, producer)
+
+	deliveries := recvUntil(t, client, func(ctx context.Context, attempt int) error {
+		return client.Send(ctx, &msg_broker_iface.BankingDataResponse{})
+	}, count(1))
+
+	if got := deliveries[0].spanContext.TraceID(); got != traceID {
+		t.Fatalf("expected the handler to continue trace %s, got %s", traceID, got)
+	}
+	sub, err := client.js.PullSubscribe(client.responses, "test", nats.BindStream(jetstream_broker.StreamName(client.responses)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := otel.GetTextMapPropagator().Extract(context.Background(), jetstream_broker.HeaderCarrier(msgs[0].Header))
+	if got := oteltrace.SpanContextFromContext(response).TraceID(); got != traceID {
+		t.Fatalf("expected the response to carry trace %s, got %s", traceID, got)
+	}
+	// The producer span is the parent of the consumer span, not the one sent on
+	if got := oteltrace.SpanContextFromContext(response).SpanID(); got == spanID {
+		t.Fatal("expected the response to be sent from a span of the consumer")
+	}
+}
+
+func TestTimedOutMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	t.Setenv("JETSTREAM_MAX_PROCESSING_TIME", "100ms")
+	client := newTestClient(t)
+	publishRequest(t, client, context.Background())
+
+	// The handler runs until its deadline, the context it got has expired by the time the message is quarantined
+	recvUntil(t, client, func(ctx context.Context, attempt int) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, count(TEST_MAX_RECEIVE_COUNT))
+	waitForEmptyStream(t, client, client.requests)
+
+	sub, err := client.js.PullSubscribe(client.deadLetters, "test", nats.BindStream(jetstream_broker.StreamName(client.deadLetters)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+	if err != nil {
+		t.Fatalf("expected the timed out message in the dead letter queue: %v", err)
+	}
+	if header := msgs[0].Header; header.Get("FailureReason") != QUARANTINE_MAX_RECEIVES {
+		t.Fatalf("unexpected dead letter headers %v", header)
+	}
+}
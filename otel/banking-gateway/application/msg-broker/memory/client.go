@@ -0,0 +1,52 @@
+// Package memory runs the messaging clients over queues living in the process, they only last as long as the
+// process so producers and consumers must share it.
+package memory
+
+import (
+	"banking-gateway/application/msg-broker/queue_client"
+	"common/queue"
+	"common/queue/memory_queue"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_VISIBILITY_TIMEOUT = time.Second * 15
+	DEFAULT_MAX_RECEIVE_COUNT  = 5
+)
+
+// New runs over the in-process queues named by BANKING_REQUESTS_QUEUE_NAME, BANKING_RESPONSES_QUEUE_NAME and
+// BANKING_REQUESTS_DLQ_NAME. MEMORY_VISIBILITY_TIMEOUT is how long a received message stays invisible and its
+// handler may run, MEMORY_MAX_RECEIVE_COUNT how many times it is received before moving to the dead letter queue.
+func New() (*queue_client.Client, error) {
+	visibilityTimeout := DEFAULT_VISIBILITY_TIMEOUT
+	if value := os.Getenv("MEMORY_VISIBILITY_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid MEMORY_VISIBILITY_TIMEOUT %q, expected a positive duration", value))
+		}
+		visibilityTimeout = parsed
+	}
+	maxReceiveCount := DEFAULT_MAX_RECEIVE_COUNT
+	if value := os.Getenv("MEMORY_MAX_RECEIVE_COUNT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid MEMORY_MAX_RECEIVE_COUNT %q, expected a positive number", value))
+		}
+		maxReceiveCount = parsed
+	}
+	var deadLetters queue.Backend
+	if dlqName := os.Getenv("BANKING_REQUESTS_DLQ_NAME"); dlqName != "" {
+		deadLetters = memory_queue.GetQueue(dlqName)
+	}
+	return queue_client.NewClient(
+		memory_queue.GetQueue(queue_client.QueueName("BANKING_REQUESTS_QUEUE_NAME", queue_client.DEFAULT_REQUESTS_QUEUE_NAME)),
+		memory_queue.GetQueue(queue_client.QueueName("BANKING_RESPONSES_QUEUE_NAME", queue_client.DEFAULT_RESPONSES_QUEUE_NAME)),
+		deadLetters,
+		visibilityTimeout,
+		maxReceiveCount,
+	), nil
+}
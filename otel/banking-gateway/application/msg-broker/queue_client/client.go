@@ -0,0 +1,306 @@
+// Package queue_client implements the messaging clients over queue backends, the ones living in the process
+// or the durable ones of the machine.
+package queue_client
+
+import (
+	"banking-gateway/application/tracing"
+	msg_broker_iface "banking-gateway/core/msg_broker"
+	"common/queue"
+	"common/telemetry"
+	"common/worker_pool"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_REQUESTS_QUEUE_NAME  = "banking-requests"
+	DEFAULT_RESPONSES_QUEUE_NAME = "banking-responses"
+	MAX_MESSAGES                 = 10
+	// RECV_ERROR_BACKOFF keeps a failing backend from being polled in a tight loop
+	RECV_ERROR_BACKOFF = time.Second
+
+	// Quarantine reasons, sent as the FailureReason header of the dead letter
+	QUARANTINE_MALFORMED       = "malformed"
+	QUARANTINE_MAX_RECEIVES    = "max_receives_exceeded"
+	MAX_FAILURE_MESSAGE_LENGTH = 1024
+)
+
+// Client implements msg_broker.Client over backend queues, messages failing maxReceiveCount times
+// move to the dead letter queue when there is one
+type Client struct {
+	requests          queue.Backend
+	responses         queue.Backend
+	deadLetters       queue.Backend
+	visibilityTimeout time.Duration
+	maxReceiveCount   int
+	// lastRecvFail is set by the receiving goroutine and read by the probes, 1 while receiving fails
+	lastRecvFail int32
+	redactor     *telemetry.Redactor
+}
+
+// NewClient consumes requests and sends to responses, deadLetters may be nil
+func NewClient(requests, responses, deadLetters queue.Backend, visibilityTimeout time.Duration, maxReceiveCount int) *Client {
+	return &Client{
+		requests:          requests,
+		responses:         responses,
+		deadLetters:       deadLetters,
+		visibilityTimeout: visibilityTimeout,
+		maxReceiveCount:   maxReceiveCount,
+		redactor:          telemetry.NewRedactorFromEnv(),
+	}
+}
+
+// QueueName reads the name of a queue from the environment
+func QueueName(name, defaultName string) string {
+	if queueName := os.Getenv(name); queueName != "" {
+		return queueName
+	}
+	return defaultName
+}
+
+// IsReady is always true, a backend that can't be reached fails to receive instead
+func (c *Client) IsReady() bool {
+	return true
+}
+
+// IsHealthy is false while receiving from the requests queue fails
+func (c *Client) IsHealthy() bool {
+	return atomic.LoadInt32(&c.lastRecvFail) == 0
+}
+
+// Requests is the queue Recv consumes, to send requests from the same process
+func (c *Client) Requests() queue.Backend {
+	return c.requests
+}
+
+// Responses is the queue Send produces to
+func (c *Client) Responses() queue.Backend {
+	return c.responses
+}
+
+func (c *Client) Send(ctx context.Context, resp *msg_broker_iface.BankingDataResponse) error {
+	tp := tracing.NewProvider()
+	ctxCall, span := tp.GetTracer().Start(ctx, "sentResponse", oteltrace.WithAttributes(
+		attribute.String("req.userId", resp.Data.UserId),
+		attribute.String("req.bankingInstitutionId", resp.Data.BankingInstitutionId),
+	))
+	defer span.End()
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		span.RecordError(err)
+		return errors.New(fmt.Sprintf("Cannot marshall message data: %v", err))
+	}
+
+	log.Println(fmt.Sprintf("Sent banking data response bankingInstitutionId=%s userId=%s", resp.Data.BankingInstitutionId, resp.Data.UserId))
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctxCall, headers)
+	if _, err := c.responses.Send(data, headers); err != nil {
+		span.RecordError(err)
+		return errors.New(fmt.Sprintf("Cannot send message to %s: %v", c.responses.Name(), err))
+	}
+	return nil
+}
+
+// producerContext extracts the trace of the producer from the headers, falling back to the tracing
+// information of the body for messages sent without headers
+func producerContext(msg queue.Message, req msg_broker_iface.BankingDataRequest) context.Context {
+	carrier := propagation.MapCarrier(msg.Headers)
+	if carrier.Get("traceparent") == "" {
+		carrier = propagation.MapCarrier{
+			"traceparent": req.TracingInformation.Traceparent,
+			"tracestate":  req.TracingInformation.Tracestate,
+		}
+	}
+	return otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+}
+
+func (c *Client) Recv(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error) error {
+	pool, err := worker_pool.NewFromEnv("banking_requests")
+	if err != nil {
+		return err
+	}
+	tp := tracing.NewProvider()
+	log.Println(fmt.Sprintf("Listening %s queue: %s", c.requests.System(), c.requests.Name()))
+	for ctx.Err() == nil {
+		// Receiving pauses while all the workers are busy and the queue is full
+		free, err := pool.WaitForCapacity(ctx)
+		if err != nil {
+			break
+		}
+		if free > MAX_MESSAGES {
+			free = MAX_MESSAGES
+		}
+		msgs, err := c.requests.Receive(ctx, free, c.visibilityTimeout)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			// Record error in a new span
+			atomic.StoreInt32(&c.lastRecvFail, 1)
+			_, span := tp.GetTracer().Start(context.Background(), "receiveBankingMsgs")
+			log.Println(fmt.Sprintf("Couldn't recieve message : %v", err))
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+			span.End()
+			sleepCtx(ctx, RECV_ERROR_BACKOFF)
+			continue
+		}
+		atomic.StoreInt32(&c.lastRecvFail, 0)
+		receivedAt := time.Now()
+
+		for _, msg := range msgs {
+			msg := msg
+			var req msg_broker_iface.BankingDataRequest
+			var reqErr error
+			if err := json.Unmarshal(msg.Body, &req); err != nil {
+				reqErr = errors.New(fmt.Sprintf("Unknown message format, cannot parse the json body: %v", err))
+			} else if err := req.Validate(); err != nil {
+				reqErr = errors.New(fmt.Sprintf("Invalid banking data request %s: %v", msg.Id, err))
+			}
+
+			// The message is not tied to ctx, once received it is processed even if receiving stops
+			ctxSpan, span := tp.GetTracer().Start(producerContext(msg, req), "processBankingMsg",
+				oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+				oteltrace.WithAttributes(
+					semconv.MessagingSystemKey.String(c.requests.System()),
+					semconv.MessagingDestinationKey.String(c.requests.Name()),
+					semconv.MessagingOperationProcess,
+					semconv.MessagingMessageIDKey.String(msg.Id),
+					attribute.Int("messaging.receive_count", msg.ReceiveCount),
+				),
+			)
+			if reqErr != nil {
+				// Retrying won't make the message valid, move it out of the way right away
+				log.Println(fmt.Sprintf("Couldn't recieve message : %v", reqErr))
+				span.RecordError(reqErr)
+				span.SetStatus(codes.Error, "invalid message")
+				c.quarantine(msg, QUARANTINE_MALFORMED, reqErr)
+				span.End()
+				continue
+			}
+
+			err = pool.Submit(func() {
+				c.processMsg(ctxSpan, handlerFunc, msg, &req, receivedAt.Add(c.visibilityTimeout))
+			})
+			if err != nil {
+				// The message becomes visible again once the visibility timeout expires
+				log.Println(fmt.Sprintf("Couldn't schedule message %s : %v", msg.Id, err))
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				span.End()
+			}
+		}
+	}
+
+	log.Println("Stopping receiving because a context kill signal was sent, waiting for in-flight messages")
+	pool.Close()
+	return nil
+}
+
+// processMsg gives the handler until the visibility timeout expires, past it the message is redelivered anyway
+func (c *Client) processMsg(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error, msg queue.Message, req *msg_broker_iface.BankingDataRequest, deadline time.Time) {
+	span := oteltrace.SpanFromContext(ctx)
+	defer span.End()
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	log.Println(fmt.Sprintf("Recieved banking data request %s bankingInstitutionId=%s userId=%s", msg.Id, req.BankingInstitutionId, req.UserId))
+	ctx = msg_broker_iface.WithDelivery(ctx, msg_broker_iface.Delivery{Attempt: msg.Attempts, MaxAttempts: c.maxReceiveCount})
+	err := callHandler(ctx, handlerFunc, req)
+	var deferErr *msg_broker_iface.DeferError
+	switch {
+	case err == nil:
+		if err := c.requests.Delete(msg.ReceiptHandle); err != nil {
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't delete message %s : %v", msg.Id, err)))
+			log.Println(fmt.Sprintf("Couldn't delete message %s : %v", msg.Id, err))
+		}
+	case errors.As(err, &deferErr):
+		span.AddEvent("messageDeferred", oteltrace.WithAttributes(
+			attribute.Int64("messaging.defer_seconds", int64(deferErr.Delay.Seconds())),
+			attribute.String("messaging.defer_reason", deferErr.Reason.Error()),
+		))
+		if err := c.requests.Defer(msg.ReceiptHandle, deferErr.Delay); err != nil {
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't defer message %s : %v", msg.Id, err)))
+			log.Println(fmt.Sprintf("Couldn't defer message %s : %v", msg.Id, err))
+		}
+	default:
+		newErr := errors.New(fmt.Sprintf("Couldn't process message %s :%v", msg.Id, err))
+		log.Println(newErr)
+		span.RecordError(newErr)
+		if errors.Is(err, context.DeadlineExceeded) {
+			span.SetStatus(codes.Error, "processing timed out")
+		}
+		if msg.Attempts >= c.maxReceiveCount {
+			c.quarantine(msg, QUARANTINE_MAX_RECEIVES, err)
+		}
+	}
+}
+
+// quarantine moves the message to the dead letter queue, without one it comes back once its visibility timeout expires
+func (c *Client) quarantine(msg queue.Message, reason string, cause error) {
+	if c.deadLetters == nil {
+		log.Println(fmt.Sprintf("No dead letter queue configured, message %s stays in its queue", msg.Id))
+		return
+	}
+	if _, err := c.deadLetters.Send(msg.Body, deadLetterHeaders(msg, c.requests.Name(), reason, c.redactor.String(cause.Error()))); err != nil {
+		log.Println(fmt.Sprintf("Couldn't quarantine message %s : %v", msg.Id, err))
+		return
+	}
+	if err := c.requests.Delete(msg.ReceiptHandle); err != nil {
+		log.Println(fmt.Sprintf("Couldn't delete quarantined message %s : %v", msg.Id, err))
+		return
+	}
+	log.Println(fmt.Sprintf("Quarantined message %s reason=%s attempts=%d", msg.Id, reason, msg.Attempts))
+}
+
+// deadLetterHeaders adds the reason of the quarantine to the headers of the message
+func deadLetterHeaders(msg queue.Message, sourceQueue, reason, failure string) map[string]string {
+	if len(failure) > MAX_FAILURE_MESSAGE_LENGTH {
+		failure = failure[:MAX_FAILURE_MESSAGE_LENGTH]
+	}
+	headers := make(map[string]string, len(msg.Headers)+6)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers["FailureReason"] = reason
+	headers["FailureMessage"] = failure
+	headers["SourceQueue"] = sourceQueue
+	headers["SourceMessageId"] = msg.Id
+	headers["ReceiveCount"] = strconv.Itoa(msg.ReceiveCount)
+	headers["Attempts"] = strconv.Itoa(msg.Attempts)
+	return headers
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// callHandler turns a panic of the handler into an error, so a poison message counts as a failed attempt
+func callHandler(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error, req *msg_broker_iface.BankingDataRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("handler panicked: %v", r))
+		}
+	}()
+	return handlerFunc(ctx, req)
+}
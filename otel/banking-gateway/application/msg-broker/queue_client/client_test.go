@@ -0,0 +1,134 @@
+package queue_client
+
+import (
+	"banking-gateway/application/tracing"
+	msg_broker_iface "banking-gateway/core/msg_broker"
+	"common/banking_data"
+	"common/queue/memory_queue"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// newTestClient runs over queues of its own, so tests don't share messages
+func newTestClient(t *testing.T, visibilityTimeout time.Duration, maxReceiveCount int) (*Client, *memory_queue.Queue) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	tracing.NewProvider()
+	name := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	dlq := memory_queue.GetQueue(name + "-dlq")
+	client := NewClient(
+		memory_queue.GetQueue(name+"-requests"),
+		memory_queue.GetQueue(name+"-responses"),
+		dlq,
+		visibilityTimeout,
+		maxReceiveCount,
+	)
+	return client, dlq
+}
+
+func sendRequest(t *testing.T, client *Client, headers map[string]string) {
+	body, _ := json.Marshal(msg_broker_iface.BankingDataRequest{
+		Version:              banking_data.SCHEMA_VERSION,
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	if _, err := client.Requests().Send(body, headers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recvUntil runs Recv until done is closed or the deadline passes
+func recvUntil(t *testing.T, client *Client, done <-chan struct{}, handler func(ctx context.Context, req *msg_broker_iface.BankingDataRequest) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Recv(ctx, handler)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the messages to be processed")
+	}
+	cancel()
+	<-stopped
+}
+
+func TestFailingMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	client, dlq := newTestClient(t, 20*time.Millisecond, 3)
+	sendRequest(t, client, nil)
+
+	lastAttempts := make(chan bool, 10)
+	done := make(chan struct{})
+	go func() {
+		for dlq.Len() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+	recvUntil(t, client, done, func(ctx context.Context, req *msg_broker_iface.BankingDataRequest) error {
+		lastAttempts <- msg_broker_iface.LastAttempt(ctx)
+		return errors.New("banking institution failed")
+	})
+
+	if len(lastAttempts) != 3 {
+		t.Fatalf("expected 3 attempts before the quarantine, got %d", len(lastAttempts))
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if last := <-lastAttempts; last != (attempt == 3) {
+			t.Fatalf("expected attempt %d to be the last one %v", attempt, attempt == 3)
+		}
+	}
+	msgs, err := dlq.Receive(context.Background(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := msgs[0].Headers
+	if headers["FailureReason"] != QUARANTINE_MAX_RECEIVES || headers["Attempts"] != "3" || headers["ReceiveCount"] != "3" {
+		t.Fatalf("unexpected dead letter headers %v", headers)
+	}
+	if client.Requests().(*memory_queue.Queue).Len() != 0 {
+		t.Fatal("expected the quarantined message to leave the requests queue")
+	}
+}
+
+func TestTraceContextTravelsInTheHeaders(t *testing.T) {
+	client, _ := newTestClient(t, time.Minute, 3)
+	traceID, _ := oteltrace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := oteltrace.SpanIDFromHex("00f067aa0ba902b7")
+	producer := oteltrace.ContextWithSpanContext(context.Background(), oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: oteltrace.FlagsSampled,
+	}))
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(producer, headers)
+	sendRequest(t, client, headers)
+
+	received := make(chan oteltrace.SpanContext, 1)
+	done := make(chan struct{})
+	recvUntil(t, client, done, func(ctx context.Context, req *msg_broker_iface.BankingDataRequest) error {
+		received <- oteltrace.SpanContextFromContext(ctx)
+		close(done)
+		return client.Send(ctx, &msg_broker_iface.BankingDataResponse{})
+	})
+
+	if got := (<-received).TraceID(); got != traceID {
+		t.Fatalf("expected the handler to continue trace %s, got %s", traceID, got)
+	}
+	msgs, err := client.Responses().Receive(context.Background(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msgs[0].Headers))
+	if got := oteltrace.SpanContextFromContext(response).TraceID(); got != traceID {
+		t.Fatalf("expected the response to carry trace %s, got %s", traceID, got)
+	}
+}
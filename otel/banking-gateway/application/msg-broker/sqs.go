@@ -2,6 +2,9 @@ package msgbroker
 
 import (
 	"banking-gateway/application/tracing"
+	"common/sqs_broker"
+	"common/telemetry"
+	"common/worker_pool"
 
 	msg_broker_iface "banking-gateway/core/msg_broker"
 	"context"
@@ -9,8 +12,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
-	"reflect"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,12 +25,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 const (
-	VISIBILITY_TIMEOUT = int32(15)
+	// RECV_ERROR_BACKOFF keeps a failing queue from being polled in a tight loop
+	RECV_ERROR_BACKOFF = time.Second
 )
 
 var (
@@ -33,17 +40,66 @@ var (
 		Name: "total_requests_processed",
 		Help: "The total number of processed events for banking calls",
 	})
+	opsDeferred = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "total_requests_deferred",
+		Help: "The total number of banking calls returned to the queue to be processed later",
+	})
+	opsQuarantined = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "total_requests_quarantined",
+		Help: "The total number of banking calls moved to the dead letter queue",
+	}, []string{"reason"})
 	IsInitialized = false
-	IsHealthy     = false
 )
 
 type SQSClient struct {
 	requestsQueueURL  *string
 	responsesQueueURL *string
-	api               *sqs.Client
+	api               sqs_broker.API
+	waitTimeSeconds   int32
+	maxMessages       int32
+	visibilityTimeout int32
+	maxProcessingTime time.Duration
+	maxReceiveCount   int32
+	deadLetters       *sqs_broker.DeadLetterQueue
+	// lastRecvFail is set by the receiving goroutine and read by the probes, 1 while receiving fails
+	lastRecvFail int32
+}
+
+// receivedMsg is a message of a received batch, err is set when its body is not a valid request
+type receivedMsg struct {
+	req *msg_broker_iface.BankingDataRequest
+	sqs_broker.ReceivedMessage
+	// producerCtx carries the span context and baggage of the producer of the message
+	producerCtx context.Context
+	err         error
+}
+
+// int32FromEnv reads a number between min and max from the environment
+func int32FromEnv(name string, defaultValue, min, max int32) (int32, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || int32(parsed) < min || int32(parsed) > max {
+		return 0, errors.New(fmt.Sprintf("Invalid %s %q, expected a number from %d to %d", name, value, min, max))
+	}
+	return int32(parsed), nil
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid %s %q, expected a positive duration", name, value))
+	}
+	return parsed, nil
 }
 
-func New() msg_broker_iface.Client {
+func New() *SQSClient {
 	endpointUrl := os.Getenv("ENDPOINT_URL")
 	var cfg aws.Config
 	var err error
@@ -69,6 +125,9 @@ func New() msg_broker_iface.Client {
 	reqQueueUrlOutput, err := client.GetQueueUrl(context.TODO(), &sqs.GetQueueUrlInput{
 		QueueName: &requestsQueueName,
 	})
+	if err != nil {
+		panic(err)
+	}
 
 	responsesQueueName := os.Getenv("BANKING_RESPONSES_QUEUE_NAME")
 	respQueueUrlOutput, err := client.GetQueueUrl(context.TODO(), &sqs.GetQueueUrlInput{
@@ -77,142 +136,327 @@ func New() msg_broker_iface.Client {
 	if err != nil {
 		panic(err)
 	}
+
+	// Long polling waits up to 20 seconds for messages instead of returning empty right away
+	waitTimeSeconds, err := int32FromEnv("SQS_WAIT_TIME_SECONDS", 20, 0, 20)
+	if err != nil {
+		panic(err)
+	}
+	maxMessages, err := int32FromEnv("SQS_MAX_MESSAGES", sqs_broker.MAX_BATCH_SIZE, 1, sqs_broker.MAX_BATCH_SIZE)
+	if err != nil {
+		panic(err)
+	}
+	// The heartbeat extends the visibility timeout of a message until it is processed or SQS_MAX_PROCESSING_TIME passes
+	visibilityTimeout, err := int32FromEnv("SQS_VISIBILITY_TIMEOUT", sqs_broker.DEFAULT_VISIBILITY_TIMEOUT, 1, sqs_broker.MAX_SQS_VISIBILITY_TIMEOUT)
+	if err != nil {
+		panic(err)
+	}
+	maxProcessingTime, err := durationFromEnv("SQS_MAX_PROCESSING_TIME", sqs_broker.DEFAULT_MAX_PROCESSING_TIME)
+	if err != nil {
+		panic(err)
+	}
+	// Failed messages are retried until they have been received SQS_MAX_RECEIVE_COUNT times
+	maxReceiveCount, err := int32FromEnv("SQS_MAX_RECEIVE_COUNT", sqs_broker.DEFAULT_MAX_RECEIVE_COUNT, 1, 1000)
+	if err != nil {
+		panic(err)
+	}
+	// Without a dead letter queue failed messages stay in their queue
+	var dlqURL *string
+	if dlqName := os.Getenv("BANKING_REQUESTS_DLQ_NAME"); dlqName != "" {
+		dlqUrlOutput, err := client.GetQueueUrl(context.TODO(), &sqs.GetQueueUrlInput{
+			QueueName: &dlqName,
+		})
+		if err != nil {
+			panic(err)
+		}
+		dlqURL = dlqUrlOutput.QueueUrl
+	}
+	deadLetters := sqs_broker.NewDeadLetterQueue(client, reqQueueUrlOutput.QueueUrl, dlqURL, opsQuarantined)
 	IsInitialized = true
-	IsHealthy = true
 	return &SQSClient{
 		requestsQueueURL:  reqQueueUrlOutput.QueueUrl,
 		responsesQueueURL: respQueueUrlOutput.QueueUrl,
 		api:               client,
+		waitTimeSeconds:   waitTimeSeconds,
+		maxMessages:       maxMessages,
+		visibilityTimeout: visibilityTimeout,
+		maxProcessingTime: maxProcessingTime,
+		maxReceiveCount:   maxReceiveCount,
+		deadLetters:       deadLetters,
 	}
 }
 
-func (c *SQSClient) Send(resp *msg_broker_iface.BankingDataResponse) error {
-	tp := tracing.NewProvider()
-	tracingInfo := resp.Data["tracingInformation"].(map[string]interface{})
-	traceparent := tracingInfo["traceparent"].(string)
-	prop := propagation.TraceContext{}
-	ctxCall := prop.Extract(context.Background(), propagation.MapCarrier{
-		"traceparent": traceparent,
-	})
+// IsReady is true once the queues are resolved
+func (c *SQSClient) IsReady() bool {
+	return IsInitialized
+}
 
-	_, span := tp.GetTracer().Start(ctxCall, "sentResponse", oteltrace.WithAttributes(
-		attribute.String("req.userId", resp.Data["userId"].(string)),
-		attribute.String("req.bankingInstitutionId", resp.Data["bankingInstitutionId"].(string)),
+// IsHealthy is false while receiving from the requests queue fails
+func (c *SQSClient) IsHealthy() bool {
+	return atomic.LoadInt32(&c.lastRecvFail) == 0
+}
+
+func (c *SQSClient) Send(ctx context.Context, resp *msg_broker_iface.BankingDataResponse) error {
+	tp := tracing.NewProvider()
+	ctxCall, span := tp.GetTracer().Start(ctx, "sentResponse", oteltrace.WithAttributes(
+		attribute.String("req.userId", resp.Data.UserId),
+		attribute.String("req.bankingInstitutionId", resp.Data.BankingInstitutionId),
 	))
-	ctx, cancel := context.WithTimeout(ctxCall, time.Second*15)
+	defer span.End()
+	ctxSend, cancel := context.WithTimeout(ctxCall, time.Second*15)
 	defer cancel()
 
 	data, err := json.Marshal(resp)
 	if err != nil {
+		span.RecordError(err)
 		return errors.New(fmt.Sprintf("Cannot marshall message data: %v", err))
 	}
 
-	log.Println(fmt.Printf("Sent banking data response from banking %s and user %s", resp.Data["bankingInstitutionId"], resp.Data["userId"]))
+	log.Println(fmt.Sprintf("Sent banking data response bankingInstitutionId=%s userId=%s", resp.Data.BankingInstitutionId, resp.Data.UserId))
 	stringData := string(data)
-	_, err = c.api.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:    c.responsesQueueURL,
-		MessageBody: &stringData,
+	_, err = c.api.SendMessage(ctxSend, &sqs.SendMessageInput{
+		QueueUrl:                c.responsesQueueURL,
+		MessageBody:             &stringData,
+		MessageAttributes:       telemetry.InjectMessageAttributes(ctxCall, nil),
+		MessageSystemAttributes: telemetry.InjectMessageSystemAttributes(ctxCall),
 	})
 
 	if err != nil {
+		span.RecordError(err)
 		return errors.New(fmt.Sprintf("Cannot send sqs message: %v", err))
 	}
 
-	span.End()
 	return nil
 }
 
-func (c *SQSClient) processMsg(handlerFunc func(msg *msg_broker_iface.BankingDataRequest) error, req *msg_broker_iface.BankingDataRequest, receiptHandle *string, tp *tracing.TracingProvider) error {
-	if req != nil {
-		// Instrument SQS recv
-		log.Println(fmt.Printf("Recieved banking data request %s, from bank %s and user %s", *receiptHandle, req.BankingInstitutionId, req.UserId))
-
-		// Apply the function and then continue the process
-		if err := handlerFunc(req); err == nil {
-			ctxDelete, cancel := context.WithTimeout(context.Background(), time.Second*5)
-			defer cancel()
-			_, err = c.api.DeleteMessage(ctxDelete, &sqs.DeleteMessageInput{
-				QueueUrl:      c.requestsQueueURL,
-				ReceiptHandle: receiptHandle,
-			})
+func (c *SQSClient) processMsg(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error, msg receivedMsg, deleter *sqs_broker.BatchDeleter, heartbeat *sqs_broker.VisibilityHeartbeat) error {
+	span := oteltrace.SpanFromContext(ctx)
+	defer span.End()
+	defer heartbeat.Stop()
 
-			// Idempotent operation dead letter queues not needed
-			if err != nil {
-				// span.RecordError(errors.New(fmt.Sprintf("Couldn't delete message : %v", receiptHandle)))
-				fmt.Println(fmt.Sprintf("Couldn't delete message : %v", receiptHandle))
-			}
+	// The heartbeat stops extending the visibility at the deadline, stop working on the message by then
+	ctxHandler, cancel := context.WithDeadline(ctx, heartbeat.Deadline)
+	defer cancel()
 
-			opsProcessed.Inc()
-		} else {
-			newErr := errors.New(fmt.Sprintf("Couldn't process message %s :%v", *receiptHandle, err))
-			fmt.Println(newErr)
-			// span.RecordError(newErr)
+	req := msg.req
+	receiptHandle := msg.ReceiptHandle
+	// Instrument SQS recv
+	log.Println(fmt.Sprintf("Recieved banking data request %s bankingInstitutionId=%s userId=%s", *receiptHandle, req.BankingInstitutionId, req.UserId))
+
+	// Apply the function and then continue the process
+	ctxHandler = msg_broker_iface.WithDelivery(ctxHandler, msg_broker_iface.Delivery{Attempt: msg.Attempts, MaxAttempts: int(c.maxReceiveCount)})
+	err := callHandler(ctxHandler, handlerFunc, req)
+	// Stop extending before deleting or deferring, an extension in flight would override a deferral
+	heartbeat.Stop()
+	var deferErr *msg_broker_iface.DeferError
+	switch {
+	case err == nil:
+		if err := deleter.Delete(receiptHandle); err != nil {
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't delete message %s : %v", *receiptHandle, err)))
+			log.Println(fmt.Sprintf("Couldn't delete message %s : %v", *receiptHandle, err))
+		}
+
+		opsProcessed.Inc()
+	case errors.As(err, &deferErr):
+		// Deferrals aren't failures, they never quarantine the message
+		c.deferMsg(ctx, msg.ReceivedMessage, deferErr, deleter)
+	default:
+		newErr := errors.New(fmt.Sprintf("Couldn't process message %s :%v", *receiptHandle, err))
+		log.Println(newErr)
+		span.RecordError(newErr)
+		if errors.Is(err, context.DeadlineExceeded) {
+			span.SetStatus(codes.Error, "processing timed out")
+		}
+		// The deadline of the handler may have passed, quarantine with the context of the span
+		if msg.Attempts >= int(c.maxReceiveCount) {
+			c.deadLetters.Quarantine(ctx, msg.ReceivedMessage, sqs_broker.QUARANTINE_MAX_RECEIVES, err, deleter)
 		}
 	}
 	return nil
 }
 
-func (c *SQSClient) Recv(handlerFunc func(msg *msg_broker_iface.BankingDataRequest) error) error {
-	ctx := context.Background()
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Stopping polling because a context kill signal was sent")
-			return nil
-		default:
-			tp := tracing.NewProvider()
-			req, receiptHandle, err := c.recv()
-			if req != nil {
-				traceparent := req.TracingInformation["traceparent"].(string)
-				prop := propagation.TraceContext{}
-				ctxCall := prop.Extract(context.Background(), propagation.MapCarrier{
-					"traceparent": traceparent,
-				})
-
-				fmt.Println(traceparent)
-
-				_, span := tp.GetTracer().Start(ctxCall, "processBankingMsg")
-				if err != nil {
-					// Record error in a new span
-					IsHealthy = false
-					log.Printf(fmt.Sprintf("Couldn't recieve message : %v", err))
-					span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
-					span.End()
-					return err
-				}
-				// Handle process in a goroutine
-
-				IsHealthy = true
-				go c.processMsg(handlerFunc, req, receiptHandle, tp)
+// callHandler turns a panic of the handler into an error, so a poison message counts as a failed attempt
+func callHandler(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error, req *msg_broker_iface.BankingDataRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("handler panicked: %v", r))
+		}
+	}()
+	return handlerFunc(ctx, req)
+}
+
+// deferMsg makes the message visible again once the delay expires, without counting it as processed or as an attempt
+func (c *SQSClient) deferMsg(ctx context.Context, msg sqs_broker.ReceivedMessage, deferErr *msg_broker_iface.DeferError, deleter *sqs_broker.BatchDeleter) {
+	span := oteltrace.SpanFromContext(ctx)
+	receiptHandle := msg.ReceiptHandle
+	span.AddEvent("messageDeferred", oteltrace.WithAttributes(
+		attribute.Int64("messaging.defer_seconds", int64(math.Ceil(deferErr.Delay.Seconds()))),
+		attribute.String("messaging.defer_reason", deferErr.Reason.Error()),
+	))
+	if err := sqs_broker.Defer(c.api, c.requestsQueueURL, msg, deferErr.Delay, deleter); err != nil {
+		// The message still comes back once the current visibility timeout expires
+		span.RecordError(errors.New(fmt.Sprintf("Couldn't defer message %s : %v", *receiptHandle, err)))
+		log.Println(fmt.Sprintf("Couldn't defer message %s : %v", *receiptHandle, err))
+		return
+	}
+	opsDeferred.Inc()
+}
+
+func (c *SQSClient) Recv(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker_iface.BankingDataRequest) error) error {
+	pool, err := worker_pool.NewFromEnv("banking_requests")
+	if err != nil {
+		return err
+	}
+	deleter := sqs_broker.NewBatchDeleter(c.api, c.requestsQueueURL)
+	tp := tracing.NewProvider()
+	for ctx.Err() == nil {
+		// Polling pauses while all the workers are busy and the queue is full
+		free, err := pool.WaitForCapacity(ctx)
+		if err != nil {
+			break
+		}
+		maxMessages := c.maxMessages
+		if int32(free) < maxMessages {
+			maxMessages = int32(free)
+		}
+		receivedAt := time.Now()
+		msgs, err := c.recv(ctx, maxMessages)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			// Record error in a new span
+			atomic.StoreInt32(&c.lastRecvFail, 1)
+			_, span := tp.GetTracer().Start(context.Background(), "receiveBankingMsgs")
+			log.Println(fmt.Sprintf("Couldn't recieve message : %v", err))
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+			span.End()
+			sleepCtx(ctx, RECV_ERROR_BACKOFF)
+			continue
+		}
+		atomic.StoreInt32(&c.lastRecvFail, 0)
+		if len(msgs) == 0 {
+			continue
+		}
+
+		// A batch mixes messages of several traces, the receive span links to every producer span
+		// and the process span of each message, child of its producer, links back to the receive span
+		producerLinks := make([]oteltrace.Link, 0, len(msgs))
+		for _, msg := range msgs {
+			if producer := oteltrace.SpanContextFromContext(msg.producerCtx); producer.IsValid() {
+				producerLinks = append(producerLinks, oteltrace.Link{SpanContext: producer})
+			}
+		}
+		_, recvSpan := tp.GetTracer().Start(context.Background(), "receiveBankingMsgs",
+			oteltrace.WithTimestamp(receivedAt),
+			oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+			oteltrace.WithLinks(producerLinks...),
+			oteltrace.WithAttributes(
+				semconv.MessagingSystemKey.String("AmazonSQS"),
+				semconv.MessagingDestinationKey.String(*c.requestsQueueURL),
+				semconv.MessagingDestinationKindQueue,
+				semconv.MessagingOperationReceive,
+				attribute.Int("messaging.batch.message_count", len(msgs)),
+			),
+		)
+		recvLink := oteltrace.Link{SpanContext: recvSpan.SpanContext()}
+
+		for _, msg := range msgs {
+			msg := msg
+			// The message is not tied to ctx, once received it is processed even if polling stops
+			ctxSpan, span := tp.GetTracer().Start(msg.producerCtx, "processBankingMsg",
+				oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+				oteltrace.WithLinks(recvLink),
+				oteltrace.WithAttributes(
+					semconv.MessagingSystemKey.String("AmazonSQS"),
+					semconv.MessagingDestinationKey.String(*c.requestsQueueURL),
+					semconv.MessagingOperationProcess,
+					semconv.MessagingMessageIDKey.String(msg.MessageId),
+				),
+			)
+			if msg.err != nil {
+				// Retrying won't make the message valid, move it out of the way right away
+				log.Println(fmt.Sprintf("Couldn't recieve message : %v", msg.err))
+				span.RecordError(msg.err)
+				span.SetStatus(codes.Error, "invalid message")
+				c.deadLetters.Quarantine(ctxSpan, msg.ReceivedMessage, sqs_broker.QUARANTINE_MALFORMED, msg.err, deleter)
+				span.End()
+				continue
+			}
+
+			// The message is kept invisible from the moment it's received, time queued in the pool counts too
+			heartbeat := sqs_broker.StartHeartbeat(ctxSpan, c.api, c.requestsQueueURL, msg.ReceiptHandle, c.visibilityTimeout, receivedAt, c.maxProcessingTime)
+
+			// Handle process in the pool, the span ends once the message is processed
+			err = pool.Submit(func() {
+				c.processMsg(ctxSpan, handlerFunc, msg, deleter, heartbeat)
+			})
+			if err != nil {
+				heartbeat.Stop()
+				// The message becomes visible again once the visibility timeout expires
+				log.Println(fmt.Sprintf("Couldn't schedule message %s : %v", *msg.ReceiptHandle, err))
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
 				span.End()
 			}
 		}
+		recvSpan.End()
+	}
+
+	log.Println("Stopping polling because a context kill signal was sent, waiting for in-flight messages")
+	pool.Close()
+	deleter.Close()
+	return nil
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
 	}
 }
 
-func (c *SQSClient) recv() (*msg_broker_iface.BankingDataRequest, *string, error) {
+func (c *SQSClient) recv(ctx context.Context, maxMessages int32) ([]receivedMsg, error) {
 	recvMsgInput := &sqs.ReceiveMessageInput{
 		MessageAttributeNames: []string{
 			string(types.QueueAttributeNameAll),
 		},
-		WaitTimeSeconds:   1,
-		QueueUrl:          c.requestsQueueURL,
-		VisibilityTimeout: VISIBILITY_TIMEOUT,
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeName(types.MessageSystemAttributeNameApproximateReceiveCount),
+			// Set by producers instrumented with X-Ray
+			types.QueueAttributeName(types.MessageSystemAttributeNameAWSTraceHeader),
+		},
+		MaxNumberOfMessages: maxMessages,
+		WaitTimeSeconds:     c.waitTimeSeconds,
+		QueueUrl:            c.requestsQueueURL,
+		VisibilityTimeout:   c.visibilityTimeout,
 	}
 
-	msgOutput, err := c.api.ReceiveMessage(context.TODO(), recvMsgInput)
+	msgOutput, err := c.api.ReceiveMessage(ctx, recvMsgInput)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if len(msgOutput.Messages) > 0 {
-		msg := msgOutput.Messages[0]
+	msgs := make([]receivedMsg, 0, len(msgOutput.Messages))
+	for _, msg := range msgOutput.Messages {
+		received := receivedMsg{
+			ReceivedMessage: sqs_broker.NewReceivedMessage(msg),
+		}
 		var req msg_broker_iface.BankingDataRequest
-		if err := json.Unmarshal([]byte(*msg.Body), &req); err != nil || reflect.DeepEqual(req, msg_broker_iface.BankingDataRequest{}) {
-			return nil, nil, errors.New(fmt.Sprintf("Unknown message format, cannot parse json: %v", *msg.Body))
+		if err := json.Unmarshal([]byte(received.Body), &req); err != nil {
+			// The body may hold personal data, it is kept out of the error and the dead letter attributes
+			received.err = errors.New(fmt.Sprintf("Unknown message format, cannot parse the json body: %v", err))
+		} else if err := req.Validate(); err != nil {
+			received.err = errors.New(fmt.Sprintf("Invalid banking data request %s: %v", received.MessageId, err))
+		} else {
+			received.req = &req
 		}
-		return &req, msg.ReceiptHandle, nil
-	} else {
-		return nil, nil, nil
+		// Requests that fail validation may still carry the trace of their producer
+		received.producerCtx = telemetry.ExtractMessageContext(msg, req.TracingInformation.Traceparent, req.TracingInformation.Tracestate)
+		msgs = append(msgs, received)
 	}
+	return msgs, nil
 }
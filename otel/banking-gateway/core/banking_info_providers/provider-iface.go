@@ -1,5 +1,11 @@
 package banking_info_providers
 
+import (
+	"common/banking_data"
+	"context"
+)
+
 type BankingInfoProvider interface {
-	Query() (map[string]interface{}, error)
+	// Query must stop and return ctx.Err() once ctx is done
+	Query(ctx context.Context) ([]banking_data.PeriodScore, error)
 }
@@ -0,0 +1,78 @@
+package banking_info_providers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownInstitution = errors.New("unknown banking institution")
+	// ErrInstitutionUnavailable is returned without calling the institution while it is known to be failing
+	ErrInstitutionUnavailable = errors.New("banking institution unavailable")
+	// ErrInstitutionFailure wraps the failures of the institution itself, transport errors, 5xx responses and
+	// provider timeouts, only those count for its circuit breaker
+	ErrInstitutionFailure = errors.New("banking institution failure")
+)
+
+// ThrottledError is returned when a call would exceed the quota of a banking institution
+type ThrottledError struct {
+	BankingInstitutionId string
+	RetryAfter           time.Duration
+	Reason               string
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("banking institution %s throttled (%s), retry after %v", e.BankingInstitutionId, e.Reason, e.RetryAfter)
+}
+
+// ProviderRequest holds the per-message data a provider needs to query a banking institution
+type ProviderRequest struct {
+	UserId               string
+	BankingInstitutionId string
+	Credentials          map[string]string
+	// BypassCache skips cached results, the fresh result still replaces them
+	BypassCache bool
+}
+
+// ProviderFactory builds a BankingInfoProvider for a single request
+type ProviderFactory func(req *ProviderRequest) (BankingInfoProvider, error)
+
+// Registry resolves the provider implementation of each banking institution
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[string]ProviderFactory
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		factories: make(map[string]ProviderFactory),
+	}
+}
+
+func (r *Registry) Register(bankingInstitutionId string, factory ProviderFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[bankingInstitutionId] = factory
+}
+
+func (r *Registry) Get(req *ProviderRequest) (BankingInfoProvider, error) {
+	r.mu.RLock()
+	factory, ok := r.factories[req.BankingInstitutionId]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownInstitution, req.BankingInstitutionId)
+	}
+	return factory(req)
+}
+
+func (r *Registry) Institutions() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.factories))
+	for id := range r.factories {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -1,18 +1,51 @@
 package msg_broker
 
-type BankingDataRequest struct {
-	UserId               string                 `json:"userId"`
-	BankingInstitutionId string                 `json:"bankingInstitutionId"`
-	BankingCredentials   map[string]string      `json:"bankingCredentials"`
-	Span                 string                 `json:"span"`
-	TracingInformation   map[string]interface{} `json:"tracingInformation"`
+import (
+	"common/banking_data"
+	"context"
+	"fmt"
+	"time"
+)
+
+type BankingDataRequest = banking_data.BankingDataRequest
+
+type BankingDataResponse = banking_data.BankingDataResponse
+
+// DeferError makes the client return the message to the queue for Delay instead of treating it as failed
+type DeferError struct {
+	Delay  time.Duration
+	Reason error
+}
+
+func (e *DeferError) Error() string {
+	return fmt.Sprintf("message deferred for %v: %v", e.Delay, e.Reason)
+}
+
+func (e *DeferError) Unwrap() error {
+	return e.Reason
+}
+
+type deliveryKey struct{}
+
+// Delivery tells the handler which attempt at the message it runs, a failed attempt is retried until MaxAttempts
+type Delivery struct {
+	Attempt     int
+	MaxAttempts int
+}
+
+func WithDelivery(ctx context.Context, delivery Delivery) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, delivery)
 }
 
-type BankingDataResponse struct {
-	Data map[string]interface{} `json:"data"`
+// LastAttempt is true when a failure won't be retried, as it is for clients that don't set the delivery
+func LastAttempt(ctx context.Context) bool {
+	delivery, ok := ctx.Value(deliveryKey{}).(Delivery)
+	return !ok || delivery.Attempt >= delivery.MaxAttempts
 }
 
 type Client interface {
-	Send(resp *BankingDataResponse) error
-	Recv(handlerFunc func(msg *BankingDataRequest) error) error
+	Send(ctx context.Context, resp *BankingDataResponse) error
+	// Recv calls handlerFunc with a context carrying the message span, its processing deadline and its Delivery.
+	// It stops polling once ctx is done and returns after the messages already received are processed.
+	Recv(ctx context.Context, handlerFunc func(ctx context.Context, msg *BankingDataRequest) error) error
 }
@@ -1,43 +1,166 @@
 package usecases
 
 import (
-	bank_impl "banking-gateway/application/banking_info_providers"
 	"banking-gateway/core/banking_info_providers"
+	"banking-gateway/core/constants"
 	"banking-gateway/core/msg_broker"
 	msg_broker_iface "banking-gateway/core/msg_broker"
+	"common/banking_data"
+	"common/telemetry"
+	"common/vault"
+	"context"
 	"errors"
 	"fmt"
+	"log"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
-func BankingInstitutionReqConsumer(client msg_broker.Client) error {
-	err := client.Recv(func(msg *msg_broker.BankingDataRequest) error {
-		var provider banking_info_providers.BankingInfoProvider
-		// Banking Mock Call
-		userName := msg.BankingCredentials["username"]
-		password := msg.BankingCredentials["password"]
+func BankingInstitutionReqConsumer(ctx context.Context, client msg_broker.Client, registry *banking_info_providers.Registry, credentialsVault vault.Vault) error {
+	err := client.Recv(ctx, func(ctx context.Context, msg *msg_broker.BankingDataRequest) error {
+		creds, err := resolveCredentials(ctx, credentialsVault, msg)
+		if errors.Is(err, vault.ErrUnknownReference) {
+			// Retrying won't make the reference valid
+			return reject(ctx, client, msg, banking_data.ERROR_INVALID_CREDENTIALS_REF, false, err)
+		}
+		if err != nil {
+			return retryOrReject(ctx, client, msg, banking_data.ERROR_CREDENTIALS_UNAVAILABLE,
+				errors.New(fmt.Sprintf("Error resolving credentials for bank %s :%v", msg.BankingInstitutionId, err)))
+		}
+
+		provider, err := registry.Get(&banking_info_providers.ProviderRequest{
+			UserId:               msg.UserId,
+			BankingInstitutionId: msg.BankingInstitutionId,
+			Credentials:          creds,
+			BypassCache:          msg.BypassCache,
+		})
+		if errors.Is(err, banking_info_providers.ErrUnknownInstitution) {
+			// Retrying won't make the institution known
+			return reject(ctx, client, msg, banking_data.ERROR_UNKNOWN_INSTITUTION, false, err)
+		}
+		if err != nil {
+			return reject(ctx, client, msg, banking_data.ERROR_INTERNAL, false,
+				errors.New(fmt.Sprintf("Error building provider for bank %s :%v", msg.BankingInstitutionId, err)))
+		}
 
-		provider = &bank_impl.BankA{
-			Username:      &userName,
-			Password:      &password,
-			StartFromYear: 2015,
+		resp, err := queryProvider(ctx, provider, msg)
+		var throttled *banking_info_providers.ThrottledError
+		if errors.As(err, &throttled) {
+			// Over the institution quota, the message goes back to the queue until there is room
+			return &msg_broker.DeferError{
+				Delay:  throttled.RetryAfter,
+				Reason: err,
+			}
+		}
+		if errors.Is(err, banking_info_providers.ErrInstitutionUnavailable) {
+			// Answer right away instead of holding the message until the institution recovers
+			return reject(ctx, client, msg, banking_data.ERROR_INSTITUTION_UNAVAILABLE, true, err)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return retryOrReject(ctx, client, msg, banking_data.ERROR_PROVIDER_TIMEOUT,
+				errors.New(fmt.Sprintf("Timed out querying bank %s", msg.BankingInstitutionId)))
 		}
-		resp, err := provider.Query()
 		if err != nil {
-			return errors.New(fmt.Sprintf("Error querying bank %s :%v", msg.BankingInstitutionId, err))
+			return retryOrReject(ctx, client, msg, banking_data.ERROR_PROVIDER_FAILURE,
+				errors.New(fmt.Sprintf("Error querying bank %s :%v", msg.BankingInstitutionId, err)))
 		}
 
-		err = client.Send(&msg_broker_iface.BankingDataResponse{
-			Data: map[string]interface{}{
-				"userId":               msg.UserId,
-				"bankingInstitutionId": msg.BankingInstitutionId,
-				"tracingInformation":   msg.TracingInformation,
-				"scores":               resp,
+		return client.Send(ctx, &msg_broker_iface.BankingDataResponse{
+			Data: banking_data.BankingData{
+				Version:              banking_data.SCHEMA_VERSION,
+				UserId:               msg.UserId,
+				BankingInstitutionId: msg.BankingInstitutionId,
+				TracingInformation:   msg.TracingInformation,
+				Scores:               resp,
 			},
 		})
-		return nil
 	})
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func queryProvider(ctx context.Context, provider banking_info_providers.BankingInfoProvider, msg *msg_broker.BankingDataRequest) ([]banking_data.PeriodScore, error) {
+	ctx, span := telemetry.Tracer(ctx, constants.APP_NAME).Start(ctx, "queryBankingProvider", oteltrace.WithAttributes(
+		attribute.String("req.bankingInstitutionId", msg.BankingInstitutionId),
+	))
+	defer span.End()
+
+	resp, err := provider.Query(ctx)
+	var throttled *banking_info_providers.ThrottledError
+	if errors.As(err, &throttled) {
+		// The request is deferred, not failed
+		span.AddEvent("bankingProviderThrottled", oteltrace.WithAttributes(
+			attribute.String("throttle.reason", throttled.Reason),
+			attribute.Int64("throttle.retry_after_ms", throttled.RetryAfter.Milliseconds()),
+		))
+		return nil, err
+	}
+	if err != nil {
+		span.RecordError(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			span.SetStatus(codes.Error, "banking provider timed out")
+		} else {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// resolveCredentials reads the credentials of the request from the vault right before they are needed
+func resolveCredentials(ctx context.Context, credentialsVault vault.Vault, msg *msg_broker.BankingDataRequest) (map[string]string, error) {
+	if msg.BankingCredentialsRef == "" {
+		return nil, nil
+	}
+	ctx, span := telemetry.Tracer(ctx, constants.APP_NAME).Start(ctx, "resolveCredentials")
+	defer span.End()
+	creds, err := credentialsVault.Resolve(ctx, msg.BankingCredentialsRef)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return creds, nil
+}
+
+// retryOrReject lets the broker retry a transient failure, the requester only gets the retryable error once the
+// last attempt fails
+func retryOrReject(ctx context.Context, client msg_broker.Client, msg *msg_broker.BankingDataRequest, code string, err error) error {
+	if !msg_broker.LastAttempt(ctx) {
+		oteltrace.SpanFromContext(ctx).SetAttributes(attribute.String("error.code", code))
+		return err
+	}
+	return reject(ctx, client, msg, code, true, err)
+}
+
+// reject answers the requester with the reason its request can't be processed, the request is
+// acknowledged and it is up to the requester to send it again when the error is retryable
+func reject(ctx context.Context, client msg_broker.Client, msg *msg_broker.BankingDataRequest, code string, retryable bool, err error) error {
+	span := oteltrace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.SetAttributes(
+		attribute.String("error.code", code),
+		attribute.Bool("error.retryable", retryable),
+	)
+	log.Println(fmt.Sprintf("Rejected banking data request userId=%s code=%s: %v", msg.UserId, code, err))
+	return client.Send(ctx, &msg_broker_iface.BankingDataResponse{
+		Data: banking_data.BankingData{
+			Version:              banking_data.SCHEMA_VERSION,
+			UserId:               msg.UserId,
+			BankingInstitutionId: msg.BankingInstitutionId,
+			TracingInformation:   msg.TracingInformation,
+			Error: &banking_data.BankingError{
+				Code:                 code,
+				Retryable:            retryable,
+				BankingInstitutionId: msg.BankingInstitutionId,
+				TraceId:              span.SpanContext().TraceID().String(),
+				Message:              err.Error(),
+			},
+		},
+	})
+}
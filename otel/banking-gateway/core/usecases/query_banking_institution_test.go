@@ -0,0 +1,65 @@
+package usecases
+
+import (
+	"banking-gateway/core/banking_info_providers"
+	"banking-gateway/core/msg_broker"
+	"common/banking_data"
+	"context"
+	"errors"
+	"testing"
+)
+
+type failingProvider struct{}
+
+func (p *failingProvider) Query(ctx context.Context) ([]banking_data.PeriodScore, error) {
+	return nil, errors.New("bank exploded")
+}
+
+// fakeClient runs the handler once for msg with the given delivery and records the responses
+type fakeClient struct {
+	delivery  msg_broker.Delivery
+	msg       *msg_broker.BankingDataRequest
+	responses []*msg_broker.BankingDataResponse
+	handled   error
+}
+
+func (c *fakeClient) Send(ctx context.Context, resp *msg_broker.BankingDataResponse) error {
+	c.responses = append(c.responses, resp)
+	return nil
+}
+
+func (c *fakeClient) Recv(ctx context.Context, handlerFunc func(ctx context.Context, msg *msg_broker.BankingDataRequest) error) error {
+	c.handled = handlerFunc(msg_broker.WithDelivery(ctx, c.delivery), c.msg)
+	return nil
+}
+
+func TestTransientFailuresAreRetriedBeforeTheErrorIsSent(t *testing.T) {
+	registry := banking_info_providers.NewRegistry()
+	registry.Register("bank", func(req *banking_info_providers.ProviderRequest) (banking_info_providers.BankingInfoProvider, error) {
+		return &failingProvider{}, nil
+	})
+	msg := &msg_broker.BankingDataRequest{UserId: "user", BankingInstitutionId: "bank"}
+
+	client := &fakeClient{delivery: msg_broker.Delivery{Attempt: 1, MaxAttempts: 3}, msg: msg}
+	BankingInstitutionReqConsumer(context.Background(), client, registry, nil)
+	if client.handled == nil || len(client.responses) != 0 {
+		t.Fatalf("first attempt: handler returned %v and sent %d responses, want a retry", client.handled, len(client.responses))
+	}
+
+	client = &fakeClient{delivery: msg_broker.Delivery{Attempt: 3, MaxAttempts: 3}, msg: msg}
+	BankingInstitutionReqConsumer(context.Background(), client, registry, nil)
+	if client.handled != nil || len(client.responses) != 1 {
+		t.Fatalf("last attempt: handler returned %v and sent %d responses, want the error response", client.handled, len(client.responses))
+	}
+	bankingErr := client.responses[0].Data.Error
+	if bankingErr == nil || bankingErr.Code != banking_data.ERROR_PROVIDER_FAILURE || !bankingErr.Retryable {
+		t.Fatalf("last attempt sent %+v", bankingErr)
+	}
+
+	// Permanent failures are answered on the first attempt
+	client = &fakeClient{delivery: msg_broker.Delivery{Attempt: 1, MaxAttempts: 3}, msg: &msg_broker.BankingDataRequest{UserId: "user", BankingInstitutionId: "unknown"}}
+	BankingInstitutionReqConsumer(context.Background(), client, registry, nil)
+	if len(client.responses) != 1 || client.responses[0].Data.Error.Code != banking_data.ERROR_UNKNOWN_INSTITUTION {
+		t.Fatalf("unknown institution sent %d responses", len(client.responses))
+	}
+}
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"common/vault"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	bank_impl "banking-gateway/application/banking_info_providers"
 	"banking-gateway/application/controllers"
 	msgbroker "banking-gateway/application/msg-broker"
+	"banking-gateway/application/msg-broker/bolt_queue"
+	"banking-gateway/application/msg-broker/jetstream"
+	"banking-gateway/application/msg-broker/memory"
 	"banking-gateway/application/tracing"
 
 	_ "banking-gateway/application/docs"
 
+	"banking-gateway/core/msg_broker"
 	"banking-gateway/core/usecases"
 
 	swagger "github.com/arsmn/fiber-swagger/v2"
@@ -19,10 +32,65 @@ import (
 	_ "go.uber.org/automaxprocs"
 )
 
+const (
+	// DEFAULT_SHUTDOWN_TIMEOUT stays below the 30s grace period of docker and kubernetes
+	DEFAULT_SHUTDOWN_TIMEOUT = 25 * time.Second
+	TRACER_FLUSH_TIMEOUT     = 5 * time.Second
+	DEFAULT_PORT             = "8080"
+)
+
+// listenAddress reads PORT, so both services can run on the same machine
+func listenAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":" + DEFAULT_PORT
+}
+
+// shutdownTimeout reads SHUTDOWN_TIMEOUT, how long in-flight messages have to finish once a stop signal arrives
+func shutdownTimeout() time.Duration {
+	value := os.Getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid SHUTDOWN_TIMEOUT %q: %v", value, err))
+	}
+	return timeout
+}
+
+// brokerClient is a message broker client the probes can check
+type brokerClient interface {
+	msg_broker.Client
+	controllers.HealthReporter
+}
+
+// newBrokerClient builds the client of the broker set in MSG_BROKER, "sqs" (the default), "nats", "bolt" or "memory".
+// The memory broker only reaches producers and consumers of this process, the dev command runs both services in
+// one process over it. The bolt broker reaches those of this machine.
+func newBrokerClient() (brokerClient, error) {
+	switch backend := os.Getenv("MSG_BROKER"); backend {
+	case "", "sqs":
+		return msgbroker.New(), nil
+	case "nats":
+		return jetstream.New()
+	case "bolt":
+		return bolt_queue.New()
+	case "memory":
+		return memory.New()
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown message broker %s", backend))
+	}
+}
+
 func main() {
 
 	tp := tracing.NewProvider()
-	defer tp.ShuwDownTracer()
+	drainTimeout := shutdownTimeout()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
 	app := fiber.New(fiber.Config{})
 	app.Use(recover.New())
@@ -32,7 +100,58 @@ func main() {
 	app.Get("/readiness", controllers.ReadinessProbe)
 	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
 
+	registry, err := bank_impl.NewRegistryFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	credentialsVault, err := vault.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	brokerClient, err := newBrokerClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	controllers.WatchBrokers(brokerClient)
+
 	// Init the consumer
-	go usecases.BankingInstitutionReqConsumer(msgbroker.New())
-	log.Fatal(app.Listen(":8080"))
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		if err := usecases.BankingInstitutionReqConsumer(ctx, brokerClient, registry, credentialsVault); err != nil {
+			log.Println(fmt.Sprintf("Banking requests consumer stopped: %v", err))
+		}
+	}()
+
+	go func() {
+		if err := app.Listen(listenAddress()); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Println("Shutdown signal received")
+	case <-consumerDone:
+		log.Println("Banking requests consumer exited, shutting down")
+	}
+	// A second signal kills the process right away
+	stop()
+
+	ctxDrain, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := app.Shutdown(); err != nil {
+		log.Println(fmt.Sprintf("Error shutting down the http server: %v", err))
+	}
+	select {
+	case <-consumerDone:
+	case <-ctxDrain.Done():
+		log.Println(fmt.Sprintf("In-flight messages didn't finish within %v, they will be redelivered", drainTimeout))
+	}
+
+	ctxFlush, cancelFlush := context.WithTimeout(context.Background(), TRACER_FLUSH_TIMEOUT)
+	defer cancelFlush()
+	tp.ShuwDownTracer(ctxFlush)
 }
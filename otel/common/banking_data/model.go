@@ -0,0 +1,101 @@
+// Package banking_data holds the contract of the banking-requests and banking-responses queues,
+// banking-gateway and credit-score-service both use it so the wire format can't drift between them.
+package banking_data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SCHEMA_VERSION must be bumped on every breaking change of the structs below
+const SCHEMA_VERSION = "3"
+
+type TracingInformation struct {
+	Traceparent string `json:"traceparent"`
+	Tracestate  string `json:"tracestate,omitempty"`
+}
+
+// PeriodScore is the banking score of a user for a single month
+type PeriodScore struct {
+	Year  int     `json:"year"`
+	Month int     `json:"month"`
+	Score float64 `json:"score"`
+}
+
+// BankingDataRequest only carries the vault reference of the banking credentials, never the credentials themselves
+type BankingDataRequest struct {
+	Version               string `json:"version"`
+	UserId                string `json:"userId"`
+	BankingInstitutionId  string `json:"bankingInstitutionId"`
+	BankingCredentialsRef string `json:"bankingCredentialsRef,omitempty"`
+	// BypassCache forces a fresh query of the banking institution
+	BypassCache        bool               `json:"bypassCache,omitempty"`
+	Span               string             `json:"span"`
+	TracingInformation TracingInformation `json:"tracingInformation"`
+}
+
+// Error codes of BankingError
+const (
+	ERROR_INVALID_CREDENTIALS_REF = "INVALID_CREDENTIALS_REF"
+	ERROR_CREDENTIALS_UNAVAILABLE = "CREDENTIALS_UNAVAILABLE"
+	ERROR_UNKNOWN_INSTITUTION     = "UNKNOWN_INSTITUTION"
+	ERROR_INSTITUTION_UNAVAILABLE = "INSTITUTION_UNAVAILABLE"
+	ERROR_PROVIDER_TIMEOUT        = "PROVIDER_TIMEOUT"
+	ERROR_PROVIDER_FAILURE        = "PROVIDER_FAILURE"
+	ERROR_INTERNAL                = "INTERNAL"
+)
+
+// BankingError tells the requester why its banking data couldn't be fetched, a retryable error
+// may succeed if the request is sent again later
+type BankingError struct {
+	Code                 string `json:"code"`
+	Retryable            bool   `json:"retryable"`
+	BankingInstitutionId string `json:"bankingInstitutionId"`
+	// TraceId is the trace where the banking gateway failed
+	TraceId string `json:"traceId,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *BankingError) Error() string {
+	return fmt.Sprintf("%s for banking institution %s: %s", e.Code, e.BankingInstitutionId, e.Message)
+}
+
+type BankingData struct {
+	Version              string             `json:"version"`
+	UserId               string             `json:"userId"`
+	BankingInstitutionId string             `json:"bankingInstitutionId"`
+	TracingInformation   TracingInformation `json:"tracingInformation"`
+	Scores               []PeriodScore      `json:"scores,omitempty"`
+	Error                *BankingError      `json:"error,omitempty"`
+}
+
+type BankingDataResponse struct {
+	Data BankingData `json:"data"`
+}
+
+func checkVersion(version string) error {
+	if version != SCHEMA_VERSION {
+		return errors.New(fmt.Sprintf("Unsupported banking data schema version %q, expected %q", version, SCHEMA_VERSION))
+	}
+	return nil
+}
+
+func (r *BankingDataRequest) Validate() error {
+	if err := checkVersion(r.Version); err != nil {
+		return err
+	}
+	if r.UserId == "" || r.BankingInstitutionId == "" {
+		return errors.New("Banking data request without userId or bankingInstitutionId")
+	}
+	return nil
+}
+
+func (r *BankingDataResponse) Validate() error {
+	if err := checkVersion(r.Data.Version); err != nil {
+		return err
+	}
+	if r.Data.UserId == "" || r.Data.BankingInstitutionId == "" {
+		return errors.New("Banking data response without userId or bankingInstitutionId")
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Package jetstream_broker holds the parts of the JetStream clients shared by the services: the connection, the
+// streams, the trace context in the headers and the progress heartbeat of the messages being processed. Every queue
+// is a work queue stream with a single subject named after the queue, consumed by a durable pull consumer.
+package jetstream_broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_ACK_WAIT            = time.Second * 15
+	DEFAULT_MAX_PROCESSING_TIME = time.Minute * 2
+	DEFAULT_MAX_RECEIVE_COUNT   = 5
+	DEFAULT_FETCH_WAIT          = time.Second * 5
+	MAX_MESSAGES                = 10
+	MESSAGING_SYSTEM            = "nats"
+	// RECV_ERROR_BACKOFF keeps a failing server from being polled in a tight loop
+	RECV_ERROR_BACKOFF = time.Second
+	PUBLISH_TIMEOUT    = time.Second * 15
+)
+
+// Settings of the consumers, read from the environment
+type Settings struct {
+	AckWait           time.Duration
+	MaxProcessingTime time.Duration
+	MaxReceiveCount   int
+	FetchWait         time.Duration
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid %s %q, expected a positive duration", name, value))
+	}
+	return parsed, nil
+}
+
+// SettingsFromEnv reads JETSTREAM_ACK_WAIT, how long a message stays unacknowledged before it is redelivered,
+// JETSTREAM_MAX_PROCESSING_TIME, JETSTREAM_MAX_RECEIVE_COUNT and JETSTREAM_FETCH_WAIT
+func SettingsFromEnv() (Settings, error) {
+	var s Settings
+	var err error
+	if s.AckWait, err = durationFromEnv("JETSTREAM_ACK_WAIT", DEFAULT_ACK_WAIT); err != nil {
+		return s, err
+	}
+	if s.MaxProcessingTime, err = durationFromEnv("JETSTREAM_MAX_PROCESSING_TIME", DEFAULT_MAX_PROCESSING_TIME); err != nil {
+		return s, err
+	}
+	if s.FetchWait, err = durationFromEnv("JETSTREAM_FETCH_WAIT", DEFAULT_FETCH_WAIT); err != nil {
+		return s, err
+	}
+	s.MaxReceiveCount = DEFAULT_MAX_RECEIVE_COUNT
+	if value := os.Getenv("JETSTREAM_MAX_RECEIVE_COUNT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return s, errors.New(fmt.Sprintf("Invalid JETSTREAM_MAX_RECEIVE_COUNT %q, expected a positive number", value))
+		}
+		s.MaxReceiveCount = parsed
+	}
+	return s, nil
+}
+
+// Connect opens a connection to NATS_URL, reconnecting forever once connected
+func Connect() (*nats.Conn, nats.JetStreamContext, error) {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err := nats.Connect(url, nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Couldn't Connect to nats %s: %v", url, err))
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, nil, errors.New(fmt.Sprintf("Couldn't get the jetstream context: %v", err))
+	}
+	return conn, js, nil
+}
+
+// StreamName turns a queue name into a valid stream name, banking-requests becomes BANKING_REQUESTS
+func StreamName(queueName string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(queueName))
+}
+
+// EnsureStream creates the work queue stream of the queue, an existing stream is left as it is
+func EnsureStream(js nats.JetStreamContext, queueName string) error {
+	name := StreamName(queueName)
+	_, err := js.StreamInfo(name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return errors.New(fmt.Sprintf("Couldn't get stream %s: %v", name, err))
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:      name,
+		Subjects:  []string{queueName},
+		Retention: nats.WorkQueuePolicy,
+		Storage:   nats.FileStorage,
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't create stream %s: %v", name, err))
+	}
+	log.Println(fmt.Sprintf("Created stream %s for subject %s", name, queueName))
+	return nil
+}
+
+// Subscribe binds a durable pull consumer to the stream of the queue, unacknowledged messages are redelivered after ackWait
+func Subscribe(js nats.JetStreamContext, queueName, durable string, ackWait time.Duration) (*nats.Subscription, error) {
+	if err := EnsureStream(js, queueName); err != nil {
+		return nil, err
+	}
+	sub, err := js.PullSubscribe(queueName, durable,
+		nats.BindStream(StreamName(queueName)),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(ackWait),
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't Subscribe to %s: %v", queueName, err))
+	}
+	return sub, nil
+}
+
+// HeaderCarrier adapts nats headers to the otel propagators, unlike http headers they keep the case of the keys
+type HeaderCarrier nats.Header
+
+func (c HeaderCarrier) Get(key string) string {
+	return nats.Header(c).Get(key)
+}
+
+func (c HeaderCarrier) Set(key, value string) {
+	nats.Header(c).Set(key, value)
+}
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Publish sends data with the trace context of ctx in the headers
+func Publish(ctx context.Context, js nats.JetStreamContext, subject string, data []byte, header nats.Header) error {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	for key, values := range header {
+		msg.Header[key] = values
+	}
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier(msg.Header))
+	ctxPublish, cancel := context.WithTimeout(ctx, PUBLISH_TIMEOUT)
+	defer cancel()
+	if _, err := js.PublishMsg(msg, nats.Context(ctxPublish)); err != nil {
+		return errors.New(fmt.Sprintf("Cannot Publish nats message to %s: %v", subject, err))
+	}
+	return nil
+}
+
+// ProducerContext extracts the trace of the producer from the headers, falling back to the tracing
+// information of the body for messages published without headers
+func ProducerContext(msg *nats.Msg, traceparent, tracestate string) context.Context {
+	if msg.Header.Get("traceparent") != "" {
+		return otel.GetTextMapPropagator().Extract(context.Background(), HeaderCarrier(msg.Header))
+	}
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier{
+		"traceparent": traceparent,
+		"tracestate":  tracestate,
+	})
+}
+
+// ReceiveCount is how many times the message has been delivered, this delivery included
+func ReceiveCount(msg *nats.Msg) int {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return 1
+	}
+	return int(meta.NumDelivered)
+}
+
+func MessageId(msg *nats.Msg) string {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return msg.Subject
+	}
+	return fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream)
+}
+
+// ProgressHeartbeat keeps a message from being redelivered while it waits in the pool or is processed,
+// telling the server it is in progress every half ack wait until it stops or the deadline is reached
+type ProgressHeartbeat struct {
+	msg     *nats.Msg
+	ackWait time.Duration
+	// Deadline is when processing must be over, the message is not kept past it
+	Deadline time.Time
+	span     oteltrace.Span
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartHeartbeat records the progress updates as events of the span in ctx
+func StartHeartbeat(ctx context.Context, msg *nats.Msg, ackWait time.Duration, receivedAt time.Time, maxProcessingTime time.Duration) *ProgressHeartbeat {
+	h := &ProgressHeartbeat{
+		msg:      msg,
+		ackWait:  ackWait,
+		Deadline: receivedAt.Add(maxProcessingTime),
+		span:     oteltrace.SpanFromContext(ctx),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// Stop returns once no progress update is being sent, so it is safe to ack the message afterwards
+func (h *ProgressHeartbeat) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+	<-h.done
+}
+
+func (h *ProgressHeartbeat) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.ackWait / 2)
+	defer ticker.Stop()
+	for extensions := 1; ; extensions++ {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		// Past the deadline the message is redelivered once the ack wait expires
+		if time.Until(h.Deadline) <= 0 {
+			return
+		}
+		if err := h.msg.InProgress(); err != nil {
+			newErr := errors.New(fmt.Sprintf("Couldn't extend ack wait of message %s : %v", MessageId(h.msg), err))
+			h.span.RecordError(newErr)
+			log.Println(newErr)
+			return
+		}
+		h.span.AddEvent("ackWaitExtended", oteltrace.WithAttributes(
+			attribute.Int("messaging.ack_wait_extensions", extensions),
+		))
+	}
+}
+
+// SleepCtx waits for d or until ctx is done
+func SleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// IsFetchTimeout tells whether Fetch returned because no message arrived in time
+func IsFetchTimeout(err error) bool {
+	return errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded)
+}
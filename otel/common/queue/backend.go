@@ -0,0 +1,40 @@
+// Package queue defines the queues the services can exchange messages over without a broker, with the delivery
+// semantics of SQS: received messages stay invisible for a visibility timeout and come back unless deleted.
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrInvalidReceipt = errors.New("invalid receipt handle")
+
+// Backend is a queue the clients can run over, either one living in the process or a durable one
+type Backend interface {
+	// Name identifies the queue, System the messaging system holding it
+	Name() string
+	System() string
+	// Send returns the message id
+	Send(body []byte, headers map[string]string) (string, error)
+	// Receive waits until there is at least one visible message or ctx is done, the received
+	// messages stay invisible for visibilityTimeout
+	Receive(ctx context.Context, maxMessages int, visibilityTimeout time.Duration) ([]Message, error)
+	// Delete fails once the visibility timeout of that delivery expired
+	Delete(receiptHandle string) error
+	// ChangeVisibility makes a received message visible again after visibilityTimeout, counting from now
+	ChangeVisibility(receiptHandle string, visibilityTimeout time.Duration) error
+	// Defer is ChangeVisibility for a delivery that doesn't count in the attempts of the message
+	Defer(receiptHandle string, delay time.Duration) error
+}
+
+// Message is a received message, ReceiptHandle identifies this delivery of the message
+type Message struct {
+	Id           string
+	Body         []byte
+	Headers      map[string]string
+	ReceiveCount int
+	// Attempts counts the deliveries that weren't deferred, this one included
+	Attempts      int
+	ReceiptHandle string
+}
@@ -0,0 +1,290 @@
+// Package bolt_queue keeps the queues in a bbolt file, so services on the same machine can exchange messages
+// without a broker. The file is locked only while a transaction runs, every service opens it per operation.
+// Polls of an empty queue only take a shared lock and never write to the file.
+package bolt_queue
+
+import (
+	"common/queue"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	MESSAGING_SYSTEM = "bbolt"
+	DEFAULT_FILENAME = "observability-lab-queues.db"
+	// LOCK_TIMEOUT is how long an operation waits for another process to release the file
+	LOCK_TIMEOUT = time.Second * 5
+	// POLL_INTERVAL is how often Receive looks for visible messages while the queue is empty
+	POLL_INTERVAL = time.Millisecond * 250
+)
+
+// record is a stored message, Receipt identifies its last delivery
+type record struct {
+	Body         []byte            `json:"body"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	ReceiveCount int               `json:"receiveCount"`
+	Deferrals    int               `json:"deferrals,omitempty"`
+	// VisibleAt is the unix time in nanoseconds the message can be received from
+	VisibleAt int64  `json:"visibleAt"`
+	Receipt   string `json:"receipt,omitempty"`
+}
+
+// Store is a bbolt file holding a bucket per queue
+type Store struct {
+	path string
+}
+
+// Open checks the file at path can be opened, creating it if needed
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.update(func(tx *bolt.Tx) error { return nil }); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenFromEnv opens the file in BOLT_QUEUE_PATH, by default in the temporary directory
+func OpenFromEnv() (*Store, error) {
+	path := os.Getenv("BOLT_QUEUE_PATH")
+	if path == "" {
+		path = filepath.Join(os.TempDir(), DEFAULT_FILENAME)
+	}
+	return Open(path)
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: LOCK_TIMEOUT})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't open queue file %s: %v", s.path, err))
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// view runs fn in a read-only transaction, the file is opened read-only so readers share the lock
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: LOCK_TIMEOUT, ReadOnly: true})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't open queue file %s: %v", s.path, err))
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// Queue returns the queue with that name, its bucket is created on the first message
+func (s *Store) Queue(name string) *Queue {
+	return &Queue{store: s, name: name}
+}
+
+// Queue is a bucket of the store, messages are keyed by their sequence number so they are received in order
+type Queue struct {
+	store *Store
+	name  string
+}
+
+func (q *Queue) Name() string {
+	return q.name
+}
+
+func (q *Queue) System() string {
+	return MESSAGING_SYSTEM
+}
+
+func (q *Queue) messageId(key []byte) string {
+	return fmt.Sprintf("%s-%d", q.name, binary.BigEndian.Uint64(key))
+}
+
+func (q *Queue) Send(body []byte, headers map[string]string) (string, error) {
+	var id string
+	err := q.store.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(q.name))
+		if err != nil {
+			return err
+		}
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(record{Body: body, Headers: headers, VisibleAt: time.Now().UnixNano()})
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, sequence)
+		id = q.messageId(key)
+		return bucket.Put(key, value)
+	})
+	return id, err
+}
+
+func (q *Queue) Receive(ctx context.Context, maxMessages int, visibilityTimeout time.Duration) ([]queue.Message, error) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		// Looking before taking keeps the empty polls from writing to the file
+		visible, err := q.hasVisible()
+		if err != nil {
+			return nil, err
+		}
+		if visible {
+			msgs, err := q.take(maxMessages, visibilityTimeout)
+			if err != nil || len(msgs) > 0 {
+				return msgs, err
+			}
+		}
+		timer.Reset(POLL_INTERVAL)
+	}
+}
+
+// hasVisible tells whether a message can be received now
+func (q *Queue) hasVisible() (bool, error) {
+	visible := false
+	err := q.store.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(q.name))
+		if bucket == nil {
+			return nil
+		}
+		now := time.Now().UnixNano()
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var r record
+			if err := json.Unmarshal(value, &r); err != nil {
+				return errors.New(fmt.Sprintf("Corrupted message %s: %v", q.messageId(key), err))
+			}
+			if r.VisibleAt <= now {
+				visible = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return visible, err
+}
+
+// take hides up to maxMessages visible messages for visibilityTimeout
+func (q *Queue) take(maxMessages int, visibilityTimeout time.Duration) ([]queue.Message, error) {
+	var msgs []queue.Message
+	err := q.store.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(q.name))
+		if bucket == nil {
+			return nil
+		}
+		now := time.Now()
+		var keys [][]byte
+		var received []record
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil && len(keys) < maxMessages; key, value = cursor.Next() {
+			var r record
+			if err := json.Unmarshal(value, &r); err != nil {
+				return errors.New(fmt.Sprintf("Corrupted message %s: %v", q.messageId(key), err))
+			}
+			if r.VisibleAt > now.UnixNano() {
+				continue
+			}
+			keys = append(keys, append([]byte(nil), key...))
+			received = append(received, r)
+		}
+		// The cursor is invalidated by changes, messages are updated once the scan is over
+		for i, key := range keys {
+			r := received[i]
+			r.ReceiveCount++
+			r.VisibleAt = now.Add(visibilityTimeout).UnixNano()
+			// The receive count makes the receipt of every delivery different
+			r.Receipt = fmt.Sprintf("%d:%d", binary.BigEndian.Uint64(key), r.ReceiveCount)
+			updated, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(key, updated); err != nil {
+				return err
+			}
+			msgs = append(msgs, queue.Message{
+				Id:            q.messageId(key),
+				Body:          r.Body,
+				Headers:       r.Headers,
+				ReceiveCount:  r.ReceiveCount,
+				Attempts:      r.ReceiveCount - r.Deferrals,
+				ReceiptHandle: r.Receipt,
+			})
+		}
+		return nil
+	})
+	return msgs, err
+}
+
+// withReceipt runs fn on the message of the receipt, as long as that delivery is still the current one
+func (q *Queue) withReceipt(receiptHandle string, fn func(bucket *bolt.Bucket, key []byte, r *record) error) error {
+	parts := strings.SplitN(receiptHandle, ":", 2)
+	sequence, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return queue.ErrInvalidReceipt
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return q.store.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(q.name))
+		if bucket == nil {
+			return queue.ErrInvalidReceipt
+		}
+		value := bucket.Get(key)
+		if value == nil {
+			return queue.ErrInvalidReceipt
+		}
+		var r record
+		if err := json.Unmarshal(value, &r); err != nil {
+			return errors.New(fmt.Sprintf("Corrupted message %s: %v", q.messageId(key), err))
+		}
+		// Once the visibility timeout expires the message may have been received again
+		if r.Receipt != receiptHandle || r.VisibleAt <= time.Now().UnixNano() {
+			return queue.ErrInvalidReceipt
+		}
+		return fn(bucket, key, &r)
+	})
+}
+
+func (q *Queue) Delete(receiptHandle string) error {
+	return q.withReceipt(receiptHandle, func(bucket *bolt.Bucket, key []byte, r *record) error {
+		return bucket.Delete(key)
+	})
+}
+
+func (q *Queue) ChangeVisibility(receiptHandle string, visibilityTimeout time.Duration) error {
+	return q.changeVisibility(receiptHandle, visibilityTimeout, false)
+}
+
+func (q *Queue) Defer(receiptHandle string, delay time.Duration) error {
+	return q.changeVisibility(receiptHandle, delay, true)
+}
+
+func (q *Queue) changeVisibility(receiptHandle string, visibilityTimeout time.Duration, deferred bool) error {
+	return q.withReceipt(receiptHandle, func(bucket *bolt.Bucket, key []byte, r *record) error {
+		if deferred {
+			r.Deferrals++
+		}
+		r.VisibleAt = time.Now().Add(visibilityTimeout).UnixNano()
+		if visibilityTimeout <= 0 {
+			// The receipt is no longer valid once the message is visible
+			r.Receipt = ""
+		}
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, value)
+	})
+}
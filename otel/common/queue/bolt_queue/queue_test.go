@@ -0,0 +1,133 @@
+package bolt_queue
+
+import (
+	"common/queue"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), DEFAULT_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func receiveOne(t *testing.T, q *Queue, visibilityTimeout time.Duration) queue.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgs, err := q.Receive(ctx, 1, visibilityTimeout)
+	if err != nil {
+		t.Fatalf("expected a message: %v", err)
+	}
+	return msgs[0]
+}
+
+func TestRedeliveredOnceTheVisibilityTimeoutExpires(t *testing.T) {
+	q := newTestStore(t).Queue("requests")
+	id, err := q.Send([]byte("body"), map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := receiveOne(t, q, 50*time.Millisecond)
+	second := receiveOne(t, q, time.Minute)
+
+	if second.Id != id || second.ReceiveCount != 2 || second.Attempts != 2 {
+		t.Fatalf("expected %s received twice, got %s received %d times", id, second.Id, second.ReceiveCount)
+	}
+	if string(second.Body) != "body" || second.Headers["traceparent"] != first.Headers["traceparent"] {
+		t.Fatalf("expected the body and headers to survive the redelivery, got %q %v", second.Body, second.Headers)
+	}
+	if second.ReceiptHandle == first.ReceiptHandle {
+		t.Fatal("expected every delivery to have its own receipt")
+	}
+	if err := q.Delete(first.ReceiptHandle); !errors.Is(err, queue.ErrInvalidReceipt) {
+		t.Fatalf("expected the receipt of the expired delivery to be rejected, got %v", err)
+	}
+	if err := q.ChangeVisibility(first.ReceiptHandle, time.Minute); !errors.Is(err, queue.ErrInvalidReceipt) {
+		t.Fatalf("expected the receipt of the expired delivery to be rejected, got %v", err)
+	}
+	if err := q.Delete(second.ReceiptHandle); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Delete(second.ReceiptHandle); !errors.Is(err, queue.ErrInvalidReceipt) {
+		t.Fatalf("expected the receipt of a deleted message to be rejected, got %v", err)
+	}
+}
+
+func TestExpiredReceiptIsRejectedBeforeTheNextReceive(t *testing.T) {
+	q := newTestStore(t).Queue("requests")
+	q.Send([]byte("body"), nil)
+
+	msg := receiveOne(t, q, 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	// Nobody received the message again, its visibility timeout expiring is enough
+	if err := q.Delete(msg.ReceiptHandle); !errors.Is(err, queue.ErrInvalidReceipt) {
+		t.Fatalf("expected the expired receipt to be rejected, got %v", err)
+	}
+	if err := q.Delete("not-a-receipt"); !errors.Is(err, queue.ErrInvalidReceipt) {
+		t.Fatalf("expected a malformed receipt to be rejected, got %v", err)
+	}
+}
+
+func TestChangeVisibilityAndDefer(t *testing.T) {
+	q := newTestStore(t).Queue("requests")
+	q.Send([]byte("body"), nil)
+
+	msg := receiveOne(t, q, time.Minute)
+	if err := q.ChangeVisibility(msg.ReceiptHandle, 0); err != nil {
+		t.Fatal(err)
+	}
+	msg = receiveOne(t, q, time.Minute)
+	if err := q.Defer(msg.ReceiptHandle, 0); err != nil {
+		t.Fatal(err)
+	}
+	msg = receiveOne(t, q, time.Minute)
+	if msg.ReceiveCount != 3 || msg.Attempts != 2 {
+		t.Fatalf("expected 3 receives and 2 attempts, got %d and %d", msg.ReceiveCount, msg.Attempts)
+	}
+}
+
+func TestEmptyPollsDontWriteTheFile(t *testing.T) {
+	store := newTestStore(t)
+	q := store.Queue("requests")
+	q.Send([]byte("body"), nil)
+	receiveOne(t, q, time.Minute)
+	before, err := os.Stat(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*POLL_INTERVAL+POLL_INTERVAL/2)
+	defer cancel()
+	if _, err := q.Receive(ctx, 1, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected no visible message, got %v", err)
+	}
+
+	after, err := os.Stat(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Fatal("expected the empty polls to leave the file untouched")
+	}
+}
+
+func TestMessagesOutliveTheStore(t *testing.T) {
+	store := newTestStore(t)
+	store.Queue("requests").Send([]byte("body"), nil)
+
+	reopened, err := Open(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveOne(t, reopened.Queue("requests"), time.Minute); string(msg.Body) != "body" {
+		t.Fatalf("expected the stored message, got %q", msg.Body)
+	}
+}
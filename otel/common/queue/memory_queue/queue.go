@@ -0,0 +1,207 @@
+// Package memory_queue implements queues living in the process with the delivery semantics of SQS, producers
+// and consumers must share the process. The services running in the same process share its queues.
+package memory_queue
+
+import (
+	"common/queue"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const MESSAGING_SYSTEM = "memory"
+
+var (
+	queuesMu sync.Mutex
+	queues   = map[string]*Queue{}
+)
+
+type entry struct {
+	id           string
+	body         []byte
+	headers      map[string]string
+	receiveCount int
+	deferrals    int
+	receipt      string
+	timer        *time.Timer
+	// visibility counts the visibility changes, a timer that fired before a later change doesn't requeue the message
+	visibility int
+}
+
+// Queue holds the messages waiting to be received and the ones received and not yet deleted
+type Queue struct {
+	name string
+
+	mu        sync.Mutex
+	sequence  int
+	ready     []*entry
+	invisible map[string]*entry
+	// available is closed and replaced every time a message becomes visible
+	available chan struct{}
+}
+
+// GetQueue returns the queue of the process with that name, creating it the first time
+func GetQueue(name string) *Queue {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	q, ok := queues[name]
+	if !ok {
+		q = &Queue{
+			name:      name,
+			invisible: make(map[string]*entry),
+			available: make(chan struct{}),
+		}
+		queues[name] = q
+	}
+	return q
+}
+
+func (q *Queue) Name() string {
+	return q.name
+}
+
+func (q *Queue) System() string {
+	return MESSAGING_SYSTEM
+}
+
+// Send queues a copy of body and headers, it never fails
+func (q *Queue) Send(body []byte, headers map[string]string) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sequence++
+	e := &entry{
+		id:      fmt.Sprintf("%s-%d", q.name, q.sequence),
+		body:    append([]byte(nil), body...),
+		headers: make(map[string]string, len(headers)),
+	}
+	for key, value := range headers {
+		e.headers[key] = value
+	}
+	q.push(e)
+	return e.id, nil
+}
+
+// push must be called holding the lock
+func (q *Queue) push(e *entry) {
+	q.ready = append(q.ready, e)
+	close(q.available)
+	q.available = make(chan struct{})
+}
+
+func (q *Queue) Receive(ctx context.Context, maxMessages int, visibilityTimeout time.Duration) ([]queue.Message, error) {
+	for {
+		q.mu.Lock()
+		if len(q.ready) > 0 {
+			msgs := q.take(maxMessages, visibilityTimeout)
+			q.mu.Unlock()
+			return msgs, nil
+		}
+		available := q.available
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-available:
+		}
+	}
+}
+
+// take must be called holding the lock
+func (q *Queue) take(maxMessages int, visibilityTimeout time.Duration) []queue.Message {
+	if maxMessages > len(q.ready) {
+		maxMessages = len(q.ready)
+	}
+	msgs := make([]queue.Message, 0, maxMessages)
+	for _, e := range q.ready[:maxMessages] {
+		q.sequence++
+		e.receiveCount++
+		e.receipt = fmt.Sprintf("%s-receipt-%d", q.name, q.sequence)
+		q.invisible[e.receipt] = e
+		q.hide(e, visibilityTimeout)
+
+		headers := make(map[string]string, len(e.headers))
+		for key, value := range e.headers {
+			headers[key] = value
+		}
+		msgs = append(msgs, queue.Message{
+			Id:            e.id,
+			Body:          append([]byte(nil), e.body...),
+			Headers:       headers,
+			ReceiveCount:  e.receiveCount,
+			Attempts:      e.receiveCount - e.deferrals,
+			ReceiptHandle: e.receipt,
+		})
+	}
+	q.ready = q.ready[maxMessages:]
+	return msgs
+}
+
+// hide keeps the received message invisible for visibilityTimeout, it must be called holding the lock
+func (q *Queue) hide(e *entry, visibilityTimeout time.Duration) {
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.visibility++
+	receipt, visibility := e.receipt, e.visibility
+	e.timer = time.AfterFunc(visibilityTimeout, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		// The timer may have fired while the visibility was being changed, the change wins
+		if q.invisible[receipt] == e && e.visibility == visibility {
+			delete(q.invisible, receipt)
+			e.receipt = ""
+			q.push(e)
+		}
+	})
+}
+
+func (q *Queue) Delete(receiptHandle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.invisible[receiptHandle]
+	if !ok {
+		return queue.ErrInvalidReceipt
+	}
+	e.timer.Stop()
+	delete(q.invisible, receiptHandle)
+	return nil
+}
+
+func (q *Queue) ChangeVisibility(receiptHandle string, visibilityTimeout time.Duration) error {
+	return q.changeVisibility(receiptHandle, visibilityTimeout, false)
+}
+
+func (q *Queue) Defer(receiptHandle string, delay time.Duration) error {
+	return q.changeVisibility(receiptHandle, delay, true)
+}
+
+func (q *Queue) changeVisibility(receiptHandle string, visibilityTimeout time.Duration, deferred bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.invisible[receiptHandle]
+	if !ok {
+		return queue.ErrInvalidReceipt
+	}
+	if deferred {
+		e.deferrals++
+	}
+	if visibilityTimeout <= 0 {
+		e.timer.Stop()
+		e.visibility++
+		delete(q.invisible, receiptHandle)
+		e.receipt = ""
+		q.push(e)
+		return nil
+	}
+	q.hide(e, visibilityTimeout)
+	return nil
+}
+
+// Len returns the number of visible and invisible messages
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.ready) + len(q.invisible)
+}
@@ -0,0 +1,121 @@
+package memory_queue
+
+import (
+	"common/queue"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestQueue is a queue of its own, so tests don't share messages
+func newTestQueue(t *testing.T) *Queue {
+	return GetQueue(fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano()))
+}
+
+func receiveOne(t *testing.T, q *Queue, visibilityTimeout, wait time.Duration) queue.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	msgs, err := q.Receive(ctx, 1, visibilityTimeout)
+	if err != nil {
+		t.Fatalf("expected a message within %v: %v", wait, err)
+	}
+	return msgs[0]
+}
+
+func expectNothing(t *testing.T, q *Queue, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	if msgs, err := q.Receive(ctx, 1, time.Minute); err == nil {
+		t.Fatalf("expected no visible message, got %s", msgs[0].Id)
+	}
+}
+
+func TestRedeliveredOnceTheVisibilityTimeoutExpires(t *testing.T) {
+	q := newTestQueue(t)
+	id, _ := q.Send([]byte("body"), map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+
+	first := receiveOne(t, q, 20*time.Millisecond, time.Second)
+	expectNothing(t, q, 5*time.Millisecond)
+	second := receiveOne(t, q, time.Minute, time.Second)
+
+	if second.Id != id || second.ReceiveCount != 2 || second.Attempts != 2 {
+		t.Fatalf("expected %s received twice, got %s received %d times", id, second.Id, second.ReceiveCount)
+	}
+	if string(second.Body) != "body" || second.Headers["traceparent"] != first.Headers["traceparent"] {
+		t.Fatalf("expected the body and headers to survive the redelivery, got %q %v", second.Body, second.Headers)
+	}
+	if err := q.Delete(first.ReceiptHandle); !errors.Is(err, queue.ErrInvalidReceipt) {
+		t.Fatalf("expected the receipt of the expired delivery to be rejected, got %v", err)
+	}
+	if err := q.Delete(second.ReceiptHandle); err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("expected the queue to be empty, got %d messages", q.Len())
+	}
+}
+
+func TestChangeVisibility(t *testing.T) {
+	q := newTestQueue(t)
+	q.Send([]byte("body"), nil)
+
+	msg := receiveOne(t, q, 20*time.Millisecond, time.Second)
+	// Extending keeps the message invisible past its first timeout
+	if err := q.ChangeVisibility(msg.ReceiptHandle, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, q, 50*time.Millisecond)
+	// No timeout makes it visible right away
+	if err := q.ChangeVisibility(msg.ReceiptHandle, 0); err != nil {
+		t.Fatal(err)
+	}
+	again := receiveOne(t, q, time.Minute, 10*time.Millisecond)
+	if again.ReceiveCount != 2 {
+		t.Fatalf("expected the second receive, got %d", again.ReceiveCount)
+	}
+	if err := q.ChangeVisibility(msg.ReceiptHandle, time.Minute); !errors.Is(err, queue.ErrInvalidReceipt) {
+		t.Fatalf("expected the stale receipt to be rejected, got %v", err)
+	}
+}
+
+func TestDeferDoesNotCountAsAttempt(t *testing.T) {
+	q := newTestQueue(t)
+	q.Send([]byte("body"), nil)
+
+	msg := receiveOne(t, q, time.Minute, time.Second)
+	if err := q.Defer(msg.ReceiptHandle, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	again := receiveOne(t, q, time.Minute, time.Second)
+	if again.ReceiveCount != 2 || again.Attempts != 1 {
+		t.Fatalf("expected 2 receives and 1 attempt, got %d and %d", again.ReceiveCount, again.Attempts)
+	}
+}
+
+func TestReceiveWaitsForContext(t *testing.T) {
+	q := newTestQueue(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Receive(ctx, 1, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the receive to end with its context, got %v", err)
+	}
+}
+
+func TestExtendWhileExpiring(t *testing.T) {
+	q := newTestQueue(t)
+	q.Send([]byte("body"), nil)
+
+	msg := receiveOne(t, q, time.Millisecond, time.Second)
+	// The timer fires while the lock is held, it only gets the lock once the visibility was extended
+	q.mu.Lock()
+	time.Sleep(20 * time.Millisecond)
+	q.hide(q.invisible[msg.ReceiptHandle], time.Minute)
+	q.mu.Unlock()
+
+	expectNothing(t, q, 50*time.Millisecond)
+	if err := q.Delete(msg.ReceiptHandle); err != nil {
+		t.Fatalf("expected the extended receipt to stay valid, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package sqs_broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// MAX_BATCH_SIZE is the SQS limit of messages per receive and per delete batch
+	MAX_BATCH_SIZE        = 10
+	DELETE_FLUSH_INTERVAL = time.Millisecond * 100
+)
+
+type deleteRequest struct {
+	receiptHandle *string
+	result        chan error
+}
+
+// BatchDeleter groups the deletes of the processed messages into DeleteMessageBatch calls,
+// a batch is sent once it is full or DELETE_FLUSH_INTERVAL after its first entry
+type BatchDeleter struct {
+	api      API
+	queueURL *string
+	requests chan deleteRequest
+	done     chan struct{}
+}
+
+func NewBatchDeleter(api API, queueURL *string) *BatchDeleter {
+	d := &BatchDeleter{
+		api:      api,
+		queueURL: queueURL,
+		requests: make(chan deleteRequest),
+		done:     make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Delete waits until the batch holding the message is sent, it returns the error of its own entry
+func (d *BatchDeleter) Delete(receiptHandle *string) error {
+	result := make(chan error, 1)
+	d.requests <- deleteRequest{
+		receiptHandle: receiptHandle,
+		result:        result,
+	}
+	return <-result
+}
+
+// Close sends the pending deletes, no Delete may be called afterwards
+func (d *BatchDeleter) Close() {
+	close(d.requests)
+	<-d.done
+}
+
+func (d *BatchDeleter) run() {
+	defer close(d.done)
+	var batch []deleteRequest
+	var flush <-chan time.Time
+	for {
+		select {
+		case req, ok := <-d.requests:
+			if !ok {
+				d.flush(batch)
+				return
+			}
+			if len(batch) == 0 {
+				flush = time.After(DELETE_FLUSH_INTERVAL)
+			}
+			batch = append(batch, req)
+			if len(batch) == MAX_BATCH_SIZE {
+				d.flush(batch)
+				batch, flush = nil, nil
+			}
+		case <-flush:
+			d.flush(batch)
+			batch, flush = nil, nil
+		}
+	}
+}
+
+func (d *BatchDeleter) flush(batch []deleteRequest) {
+	if len(batch) == 0 {
+		return
+	}
+	// Entry ids only need to be unique within the batch
+	entries := make([]types.DeleteMessageBatchRequestEntry, len(batch))
+	for i, req := range batch {
+		entries[i] = types.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: req.receiptHandle,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	output, err := d.api.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: d.queueURL,
+		Entries:  entries,
+	})
+	results := make([]error, len(batch))
+	if err != nil {
+		for i := range results {
+			results[i] = err
+		}
+	} else {
+		for _, failed := range output.Failed {
+			i, convErr := strconv.Atoi(aws.ToString(failed.Id))
+			if convErr != nil || i < 0 || i >= len(batch) {
+				continue
+			}
+			results[i] = errors.New(fmt.Sprintf("%s: %s", aws.ToString(failed.Code), aws.ToString(failed.Message)))
+		}
+	}
+	for i, req := range batch {
+		req.result <- results[i]
+	}
+}
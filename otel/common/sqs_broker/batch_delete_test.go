@@ -0,0 +1,139 @@
+package sqs_broker
+
+import (
+	"common/sqs_broker/fake_sqs"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const TEST_QUEUE_URL = fake_sqs.URL_PREFIX + "requests"
+
+// receiveMessages sends n messages to the queue and receives them the way the clients do
+func receiveMessages(t *testing.T, api *fake_sqs.SQS, n int) []ReceivedMessage {
+	for i := 0; i < n; i++ {
+		if _, err := api.SendMessage(context.Background(), &sqs.SendMessageInput{
+			QueueUrl:    aws.String(TEST_QUEUE_URL),
+			MessageBody: aws.String(fmt.Sprintf(`{"userId":"user-%d"}`, i)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output, err := api.ReceiveMessage(context.Background(), &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(TEST_QUEUE_URL),
+		MaxNumberOfMessages:   int32(n),
+		VisibilityTimeout:     60,
+		MessageAttributeNames: []string{string(types.QueueAttributeNameAll)},
+		AttributeNames:        []types.QueueAttributeName{types.QueueAttributeNameAll},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]ReceivedMessage, len(output.Messages))
+	for i, msg := range output.Messages {
+		msgs[i] = NewReceivedMessage(msg)
+	}
+	return msgs
+}
+
+func deleteAll(deleter *BatchDeleter, receipts []*string) []error {
+	results := make([]error, len(receipts))
+	var wg sync.WaitGroup
+	for i, receipt := range receipts {
+		wg.Add(1)
+		go func(i int, receipt *string) {
+			defer wg.Done()
+			results[i] = deleter.Delete(receipt)
+		}(i, receipt)
+	}
+	wg.Wait()
+	return results
+}
+
+func receipts(msgs []ReceivedMessage) []*string {
+	handles := make([]*string, len(msgs))
+	for i, msg := range msgs {
+		handles[i] = msg.ReceiptHandle
+	}
+	return handles
+}
+
+func TestBatchDeleterFlushesFullBatches(t *testing.T) {
+	api := fake_sqs.New()
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	msgs := receiveMessages(t, api, MAX_BATCH_SIZE)
+
+	start := time.Now()
+	for _, err := range deleteAll(deleter, receipts(msgs)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= DELETE_FLUSH_INTERVAL {
+		t.Fatalf("expected a full batch to be sent right away, it took %v", elapsed)
+	}
+	if batches := api.Batches(); len(batches) != 1 || len(batches[0]) != MAX_BATCH_SIZE {
+		t.Fatalf("expected one batch of %d entries, got %d batches", MAX_BATCH_SIZE, len(batches))
+	}
+	if left := api.Messages(TEST_QUEUE_URL); len(left) != 0 {
+		t.Fatalf("expected the queue to be empty, %d messages left", len(left))
+	}
+}
+
+func TestBatchDeleterFlushesAfterTheInterval(t *testing.T) {
+	api := fake_sqs.New()
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	msgs := receiveMessages(t, api, 1)
+
+	start := time.Now()
+	if err := deleter.Delete(msgs[0].ReceiptHandle); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < DELETE_FLUSH_INTERVAL {
+		t.Fatalf("expected the batch to wait for more entries, it was sent after %v", elapsed)
+	}
+	if left := api.Messages(TEST_QUEUE_URL); len(left) != 0 {
+		t.Fatalf("expected the message to be deleted, %d messages left", len(left))
+	}
+}
+
+func TestBatchDeleterReturnsTheErrorOfEachEntry(t *testing.T) {
+	api := fake_sqs.New()
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	msgs := receiveMessages(t, api, 1)
+
+	results := deleteAll(deleter, []*string{msgs[0].ReceiptHandle, aws.String("expired")})
+	if results[0] != nil {
+		t.Fatalf("expected the valid receipt to be deleted, got %v", results[0])
+	}
+	if results[1] == nil {
+		t.Fatal("expected the expired receipt to fail")
+	}
+}
+
+func TestBatchDeleterFailsEveryEntryWhenTheBatchFails(t *testing.T) {
+	api := fake_sqs.New()
+	api.FailBatch = errors.New("throttled")
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	msgs := receiveMessages(t, api, 2)
+
+	for i, err := range deleteAll(deleter, receipts(msgs)) {
+		if err == nil {
+			t.Fatalf("expected entry %d to fail with its batch", i)
+		}
+	}
+	if left := api.Messages(TEST_QUEUE_URL); len(left) != 2 {
+		t.Fatalf("expected the messages to stay in the queue, %d left", len(left))
+	}
+}
@@ -0,0 +1,69 @@
+package sqs_broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	MAX_SQS_DELAY_SECONDS = 900
+	DEFER_TIMEOUT         = time.Second * 5
+)
+
+// Defer returns the message to the queue for delay without counting this delivery as an attempt. SQS counts every
+// receive, so a copy delayed by up to MAX_SQS_DELAY_SECONDS carries the attempts so far and the message is deleted.
+// When the copy can't be sent the visibility of the message is changed instead, this delivery then counts.
+func Defer(api API, queueURL *string, msg ReceivedMessage, delay time.Duration, deleter *BatchDeleter) error {
+	delaySeconds := int32(math.Ceil(delay.Seconds()))
+	if delaySeconds > MAX_SQS_DELAY_SECONDS {
+		delaySeconds = MAX_SQS_DELAY_SECONDS
+	}
+	attributes := make(map[string]types.MessageAttributeValue, len(msg.Attributes)+1)
+	for key, value := range msg.Attributes {
+		attributes[key] = value
+	}
+	attributes[FAILED_ATTEMPTS_ATTRIBUTE] = types.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(msg.Attempts - 1)),
+	}
+	var systemAttributes map[string]types.MessageSystemAttributeValue
+	if msg.TraceHeader != "" {
+		systemAttributes = map[string]types.MessageSystemAttributeValue{
+			AWS_TRACE_HEADER: {DataType: aws.String("String"), StringValue: aws.String(msg.TraceHeader)},
+		}
+	}
+
+	ctxSend, cancel := context.WithTimeout(context.Background(), DEFER_TIMEOUT)
+	defer cancel()
+	_, err := api.SendMessage(ctxSend, &sqs.SendMessageInput{
+		QueueUrl:                queueURL,
+		MessageBody:             aws.String(msg.Body),
+		DelaySeconds:            delaySeconds,
+		MessageAttributes:       attributes,
+		MessageSystemAttributes: systemAttributes,
+	})
+	if err == nil {
+		// Should the delete fail the message comes back as well as its copy
+		return deleter.Delete(msg.ReceiptHandle)
+	}
+
+	ctxChange, cancelChange := context.WithTimeout(context.Background(), DEFER_TIMEOUT)
+	defer cancelChange()
+	_, changeErr := api.ChangeMessageVisibility(ctxChange, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          queueURL,
+		ReceiptHandle:     msg.ReceiptHandle,
+		VisibilityTimeout: int32(math.Min(math.Ceil(delay.Seconds()), float64(MAX_SQS_VISIBILITY_TIMEOUT))),
+	})
+	if changeErr != nil {
+		return errors.New(fmt.Sprintf("Couldn't send the deferred copy: %v, nor change the visibility: %v", err, changeErr))
+	}
+	return nil
+}
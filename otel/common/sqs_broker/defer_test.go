@@ -0,0 +1,61 @@
+package sqs_broker
+
+import (
+	"common/sqs_broker/fake_sqs"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+func TestDeferSendsADelayedCopyCarryingTheAttempts(t *testing.T) {
+	api := fake_sqs.New()
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	msg := receiveMessages(t, api, 1)[0]
+	msg.Attempts = 5
+	msg.TraceHeader = "Root=1-5759e988-bd862e3fe1be46a994272793"
+
+	if err := Defer(api, aws.String(TEST_QUEUE_URL), msg, time.Hour, deleter); err != nil {
+		t.Fatal(err)
+	}
+	sent := api.Sent()
+	deferred := sent[len(sent)-1]
+	if deferred.DelaySeconds != MAX_SQS_DELAY_SECONDS {
+		t.Fatalf("expected the delay to be capped to %ds, got %ds", MAX_SQS_DELAY_SECONDS, deferred.DelaySeconds)
+	}
+	if header := aws.ToString(deferred.MessageSystemAttributes[AWS_TRACE_HEADER].StringValue); header != msg.TraceHeader {
+		t.Fatalf("expected the copy to keep the trace header, got %q", header)
+	}
+
+	// Only the copy is left, it counts the attempts of the message it replaces
+	left := api.Messages(TEST_QUEUE_URL)
+	if len(left) != 1 || aws.ToString(left[0].MessageId) == msg.MessageId {
+		t.Fatalf("expected the deferred message to be replaced by its copy, got %d messages", len(left))
+	}
+	left[0].Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)] = "1"
+	if attempts := NewReceivedMessage(left[0]).Attempts; attempts != 5 {
+		t.Fatalf("expected the copy to be on its 5th attempt, got %d", attempts)
+	}
+}
+
+func TestDeferChangesTheVisibilityWhenTheCopyIsNotSent(t *testing.T) {
+	api := fake_sqs.New()
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	msg := receiveMessages(t, api, 1)[0]
+	api.FailSend = errors.New("throttled")
+
+	if err := Defer(api, aws.String(TEST_QUEUE_URL), msg, 30*time.Second, deleter); err != nil {
+		t.Fatal(err)
+	}
+	changes := api.VisibilityChanges()
+	if len(changes) != 1 || changes[0].VisibilityTimeout != 30 {
+		t.Fatalf("expected the visibility to be changed to 30s, got %d changes", len(changes))
+	}
+	if left := api.Messages(TEST_QUEUE_URL); len(left) != 1 {
+		t.Fatalf("expected the message to stay in its queue, %d left", len(left))
+	}
+}
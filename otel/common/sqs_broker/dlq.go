@@ -0,0 +1,121 @@
+package sqs_broker
+
+import (
+	"common/telemetry"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_MAX_RECEIVE_COUNT = int32(5)
+
+	// Quarantine reasons, sent as the FailureReason attribute of the dead letter
+	QUARANTINE_MALFORMED           = "malformed"
+	QUARANTINE_MAX_RECEIVES        = "max_receives_exceeded"
+	MAX_FAILURE_MESSAGE_LENGTH     = 1024
+	QUARANTINE_OPERATION_TIMEOUT   = time.Second * 5
+	DEAD_LETTER_ATTRIBUTE_DATATYPE = "String"
+	// INSTRUMENTATION_NAME names the tracer of the spans of this package
+	INSTRUMENTATION_NAME = "common/sqs_broker"
+)
+
+// DeadLetterQueue holds the messages that can't be processed, with the reason as message attributes
+type DeadLetterQueue struct {
+	api            API
+	sourceQueueURL *string
+	queueURL       *string
+	quarantined    *prometheus.CounterVec
+	redactor       *telemetry.Redactor
+}
+
+// NewDeadLetterQueue moves the messages of sourceQueueURL to queueURL, which is nil when there is no dead letter
+// queue. The quarantined messages are counted by reason.
+func NewDeadLetterQueue(api API, sourceQueueURL, queueURL *string, quarantined *prometheus.CounterVec) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		api:            api,
+		sourceQueueURL: sourceQueueURL,
+		queueURL:       queueURL,
+		quarantined:    quarantined,
+		redactor:       telemetry.NewRedactorFromEnv(),
+	}
+}
+
+func stringAttribute(value string) types.MessageAttributeValue {
+	return types.MessageAttributeValue{
+		DataType:    aws.String(DEAD_LETTER_ATTRIBUTE_DATATYPE),
+		StringValue: aws.String(value),
+	}
+}
+
+// Quarantine moves the message to the dead letter queue, it is only deleted from its queue once the copy is sent.
+// Without a dead letter queue the message stays in its queue and comes back once its visibility timeout expires.
+func (q *DeadLetterQueue) Quarantine(ctx context.Context, msg ReceivedMessage, reason string, cause error, deleter *BatchDeleter) error {
+	ctx, span := telemetry.Tracer(ctx, INSTRUMENTATION_NAME).Start(ctx, "quarantineMessage", oteltrace.WithAttributes(
+		semconv.MessagingMessageIDKey.String(msg.MessageId),
+		attribute.String("quarantine.reason", reason),
+		attribute.Int("messaging.receive_count", msg.ReceiveCount),
+		attribute.Int("messaging.attempts", msg.Attempts),
+	))
+	defer span.End()
+	span.RecordError(cause)
+
+	if q == nil || q.queueURL == nil {
+		err := errors.New(fmt.Sprintf("No dead letter queue configured, message %s stays in its queue", msg.MessageId))
+		span.SetStatus(codes.Error, err.Error())
+		log.Println(err)
+		return err
+	}
+
+	// Errors may quote what they failed on, the attributes outlive the logs and the traces
+	failure := q.redactor.String(cause.Error())
+	if len(failure) > MAX_FAILURE_MESSAGE_LENGTH {
+		failure = failure[:MAX_FAILURE_MESSAGE_LENGTH]
+	}
+	ctxSend, cancel := context.WithTimeout(ctx, QUARANTINE_OPERATION_TIMEOUT)
+	defer cancel()
+	_, err := q.api.SendMessage(ctxSend, &sqs.SendMessageInput{
+		QueueUrl:    q.queueURL,
+		MessageBody: aws.String(msg.Body),
+		// The trace context ties the dead letter to the trace where it was quarantined
+		MessageAttributes: telemetry.InjectMessageAttributes(ctx, map[string]types.MessageAttributeValue{
+			"FailureReason":   stringAttribute(reason),
+			"FailureMessage":  stringAttribute(failure),
+			"SourceQueue":     stringAttribute(aws.ToString(q.sourceQueueURL)),
+			"SourceMessageId": stringAttribute(msg.MessageId),
+			"ReceiveCount":    stringAttribute(strconv.Itoa(msg.ReceiveCount)),
+			"Attempts":        stringAttribute(strconv.Itoa(msg.Attempts)),
+		}),
+		MessageSystemAttributes: telemetry.InjectMessageSystemAttributes(ctx),
+	})
+	if err != nil {
+		newErr := errors.New(fmt.Sprintf("Couldn't quarantine message %s : %v", msg.MessageId, err))
+		span.RecordError(newErr)
+		span.SetStatus(codes.Error, newErr.Error())
+		log.Println(newErr)
+		return newErr
+	}
+	q.quarantined.WithLabelValues(reason).Inc()
+	log.Println(fmt.Sprintf("Quarantined message %s reason=%s attempts=%d", msg.MessageId, reason, msg.Attempts))
+
+	if err := deleter.Delete(msg.ReceiptHandle); err != nil {
+		// The message comes back and will be quarantined again, the dead letter queue gets a duplicate
+		newErr := errors.New(fmt.Sprintf("Couldn't delete quarantined message %s : %v", msg.MessageId, err))
+		span.RecordError(newErr)
+		log.Println(newErr)
+		return newErr
+	}
+	return nil
+}
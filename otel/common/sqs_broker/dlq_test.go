@@ -0,0 +1,88 @@
+package sqs_broker
+
+import (
+	"common/sqs_broker/fake_sqs"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const TEST_DLQ_URL = fake_sqs.URL_PREFIX + "requests-dlq"
+
+func newQuarantinedCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "test_quarantined_total",
+		Help: "The quarantined messages of the test",
+	}, []string{"reason"})
+}
+
+func TestQuarantineSendsTheDeadLetterAndDeletesTheMessage(t *testing.T) {
+	api := fake_sqs.New()
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	quarantined := newQuarantinedCounter()
+	dlq := NewDeadLetterQueue(api, aws.String(TEST_QUEUE_URL), aws.String(TEST_DLQ_URL), quarantined)
+	msg := receiveMessages(t, api, 1)[0]
+
+	err := dlq.Quarantine(context.Background(), msg, QUARANTINE_MAX_RECEIVES, errors.New("banking gateway unavailable"), deleter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters := api.Messages(TEST_DLQ_URL)
+	if len(deadLetters) != 1 || aws.ToString(deadLetters[0].Body) != msg.Body {
+		t.Fatalf("expected the body in the dead letter queue, got %d messages", len(deadLetters))
+	}
+	for name, expected := range map[string]string{
+		"FailureReason":   QUARANTINE_MAX_RECEIVES,
+		"FailureMessage":  "banking gateway unavailable",
+		"SourceQueue":     TEST_QUEUE_URL,
+		"SourceMessageId": msg.MessageId,
+		"ReceiveCount":    "1",
+		"Attempts":        "1",
+	} {
+		if value := aws.ToString(deadLetters[0].MessageAttributes[name].StringValue); value != expected {
+			t.Errorf("expected %s %q, got %q", name, expected, value)
+		}
+	}
+	if left := api.Messages(TEST_QUEUE_URL); len(left) != 0 {
+		t.Fatalf("expected the quarantined message to be deleted, %d messages left", len(left))
+	}
+	if count := testutil.ToFloat64(quarantined.WithLabelValues(QUARANTINE_MAX_RECEIVES)); count != 1 {
+		t.Fatalf("expected one quarantined message, got %v", count)
+	}
+}
+
+func TestQuarantineKeepsTheMessageWhenTheDeadLetterIsNotSent(t *testing.T) {
+	api := fake_sqs.New()
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	dlq := NewDeadLetterQueue(api, aws.String(TEST_QUEUE_URL), aws.String(TEST_DLQ_URL), newQuarantinedCounter())
+	msg := receiveMessages(t, api, 1)[0]
+	api.FailSend = errors.New("throttled")
+
+	if err := dlq.Quarantine(context.Background(), msg, QUARANTINE_MALFORMED, errors.New("invalid json"), deleter); err == nil {
+		t.Fatal("expected the quarantine to fail")
+	}
+	if left := api.Messages(TEST_QUEUE_URL); len(left) != 1 {
+		t.Fatal("expected the message to stay in its queue")
+	}
+}
+
+func TestQuarantineWithoutDeadLetterQueue(t *testing.T) {
+	api := fake_sqs.New()
+	deleter := NewBatchDeleter(api, aws.String(TEST_QUEUE_URL))
+	defer deleter.Close()
+	dlq := NewDeadLetterQueue(api, aws.String(TEST_QUEUE_URL), nil, newQuarantinedCounter())
+	msg := receiveMessages(t, api, 1)[0]
+
+	if err := dlq.Quarantine(context.Background(), msg, QUARANTINE_MALFORMED, errors.New("invalid json"), deleter); err == nil {
+		t.Fatal("expected the quarantine to fail without a dead letter queue")
+	}
+	if left := api.Messages(TEST_QUEUE_URL); len(left) != 1 {
+		t.Fatal("expected the message to stay in its queue")
+	}
+}
@@ -0,0 +1,254 @@
+// Package fake_sqs implements sqs_broker.API in memory for the tests of the SQS clients, with the visibility
+// timeouts, delays and receive counts of SQS.
+package fake_sqs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	URL_PREFIX = "https://sqs.local/"
+	// EMPTY_RECEIVE_WAIT is how long a receive waits for messages before returning none, long polling would slow
+	// the tests down
+	EMPTY_RECEIVE_WAIT = time.Millisecond * 10
+)
+
+var ErrInvalidReceipt = errors.New("ReceiptHandleIsInvalid: The receipt handle is not valid")
+
+type message struct {
+	id               string
+	body             string
+	attributes       map[string]types.MessageAttributeValue
+	systemAttributes map[string]string
+	receiveCount     int
+	visibleAt        time.Time
+	receipt          string
+}
+
+// SQS holds the queues by url, the Fail fields must be set before the clients run
+type SQS struct {
+	// FailSend, FailReceive and FailBatch are returned by every call of the operation
+	FailSend    error
+	FailReceive error
+	FailBatch   error
+	// FailReceipts are the receipt handles that fail to be deleted or changed
+	FailReceipts map[string]bool
+
+	mu         sync.Mutex
+	sequence   int
+	queues     map[string][]*message
+	sent       []*sqs.SendMessageInput
+	batches    [][]types.DeleteMessageBatchRequestEntry
+	visibility []*sqs.ChangeMessageVisibilityInput
+}
+
+func New() *SQS {
+	return &SQS{queues: map[string][]*message{}}
+}
+
+// URL is the url GetQueueUrl returns for the queue name
+func URL(name string) string {
+	return URL_PREFIX + name
+}
+
+func (f *SQS) GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(URL(aws.ToString(params.QueueName)))}, nil
+}
+
+func (f *SQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.FailSend != nil {
+		return nil, f.FailSend
+	}
+	f.sent = append(f.sent, params)
+	f.sequence++
+	msg := &message{
+		id:               fmt.Sprintf("message-%d", f.sequence),
+		body:             aws.ToString(params.MessageBody),
+		attributes:       params.MessageAttributes,
+		systemAttributes: map[string]string{},
+		visibleAt:        time.Now().Add(time.Second * time.Duration(params.DelaySeconds)),
+	}
+	for name, value := range params.MessageSystemAttributes {
+		msg.systemAttributes[name] = aws.ToString(value.StringValue)
+	}
+	url := aws.ToString(params.QueueUrl)
+	f.queues[url] = append(f.queues[url], msg)
+	return &sqs.SendMessageOutput{MessageId: aws.String(msg.id)}, nil
+}
+
+// ReceiveMessage hands out the visible messages with the system attributes requested, it waits
+// EMPTY_RECEIVE_WAIT when there is none
+func (f *SQS) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	if msgs, err := f.receive(params); err != nil || len(msgs) > 0 {
+		return &sqs.ReceiveMessageOutput{Messages: msgs}, err
+	}
+	timer := time.NewTimer(EMPTY_RECEIVE_WAIT)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+func (f *SQS) receive(params *sqs.ReceiveMessageInput) ([]types.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.FailReceive != nil {
+		return nil, f.FailReceive
+	}
+	maxMessages := int(params.MaxNumberOfMessages)
+	if maxMessages < 1 {
+		maxMessages = 1
+	}
+	requested := map[string]bool{}
+	for _, name := range params.AttributeNames {
+		requested[string(name)] = true
+	}
+	now := time.Now()
+	var received []types.Message
+	for _, msg := range f.queues[aws.ToString(params.QueueUrl)] {
+		if len(received) == maxMessages {
+			break
+		}
+		if now.Before(msg.visibleAt) {
+			continue
+		}
+		f.sequence++
+		msg.receiveCount++
+		msg.receipt = fmt.Sprintf("receipt-%d", f.sequence)
+		msg.visibleAt = now.Add(time.Second * time.Duration(params.VisibilityTimeout))
+		received = append(received, msg.output(requested))
+	}
+	return received, nil
+}
+
+// output must be called holding the lock
+func (msg *message) output(requested map[string]bool) types.Message {
+	all := requested[string(types.QueueAttributeNameAll)]
+	attributes := map[string]string{}
+	for name, value := range msg.systemAttributes {
+		if all || requested[name] {
+			attributes[name] = value
+		}
+	}
+	if name := string(types.MessageSystemAttributeNameApproximateReceiveCount); all || requested[name] {
+		attributes[name] = strconv.Itoa(msg.receiveCount)
+	}
+	return types.Message{
+		MessageId:         aws.String(msg.id),
+		ReceiptHandle:     aws.String(msg.receipt),
+		Body:              aws.String(msg.body),
+		MessageAttributes: msg.attributes,
+		Attributes:        attributes,
+	}
+}
+
+// find must be called holding the lock, only the last receipt of a message is valid
+func (f *SQS) find(url, receipt string) int {
+	if f.FailReceipts[receipt] {
+		return -1
+	}
+	for i, msg := range f.queues[url] {
+		if msg.receipt == receipt && receipt != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *SQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	url := aws.ToString(params.QueueUrl)
+	i := f.find(url, aws.ToString(params.ReceiptHandle))
+	if i < 0 {
+		return nil, ErrInvalidReceipt
+	}
+	f.queues[url] = append(f.queues[url][:i], f.queues[url][i+1:]...)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *SQS) DeleteMessageBatch(ctx context.Context, params *sqs.DeleteMessageBatchInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageBatchOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, params.Entries)
+	if f.FailBatch != nil {
+		return nil, f.FailBatch
+	}
+	url := aws.ToString(params.QueueUrl)
+	output := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range params.Entries {
+		i := f.find(url, aws.ToString(entry.ReceiptHandle))
+		if i < 0 {
+			output.Failed = append(output.Failed, types.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String("ReceiptHandleIsInvalid"),
+				Message:     aws.String("The receipt handle is not valid"),
+				SenderFault: true,
+			})
+			continue
+		}
+		f.queues[url] = append(f.queues[url][:i], f.queues[url][i+1:]...)
+		output.Successful = append(output.Successful, types.DeleteMessageBatchResultEntry{Id: entry.Id})
+	}
+	return output, nil
+}
+
+func (f *SQS) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	url := aws.ToString(params.QueueUrl)
+	i := f.find(url, aws.ToString(params.ReceiptHandle))
+	if i < 0 {
+		return nil, ErrInvalidReceipt
+	}
+	f.visibility = append(f.visibility, params)
+	f.queues[url][i].visibleAt = time.Now().Add(time.Second * time.Duration(params.VisibilityTimeout))
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+// Messages returns the messages of the queue not deleted yet, visible or not, with all their attributes
+func (f *SQS) Messages(url string) []types.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	all := map[string]bool{string(types.QueueAttributeNameAll): true}
+	msgs := make([]types.Message, 0, len(f.queues[url]))
+	for _, msg := range f.queues[url] {
+		msgs = append(msgs, msg.output(all))
+	}
+	return msgs
+}
+
+// Sent returns the messages sent so far, to any queue
+func (f *SQS) Sent() []*sqs.SendMessageInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*sqs.SendMessageInput(nil), f.sent...)
+}
+
+// Batches returns the entries of every DeleteMessageBatch call, failed or not
+func (f *SQS) Batches() [][]types.DeleteMessageBatchRequestEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]types.DeleteMessageBatchRequestEntry(nil), f.batches...)
+}
+
+// VisibilityChanges returns the successful ChangeMessageVisibility calls
+func (f *SQS) VisibilityChanges() []*sqs.ChangeMessageVisibilityInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*sqs.ChangeMessageVisibilityInput(nil), f.visibility...)
+}
@@ -0,0 +1,113 @@
+package sqs_broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_VISIBILITY_TIMEOUT   = int32(15)
+	DEFAULT_MAX_PROCESSING_TIME  = time.Minute * 2
+	MAX_SQS_VISIBILITY_TIMEOUT   = int32(43200)
+	VISIBILITY_EXTENSION_TIMEOUT = time.Second * 5
+)
+
+// VisibilityHeartbeat keeps a message invisible while it waits in the pool or is processed,
+// extending its visibility timeout every half timeout until it stops or the deadline is reached
+type VisibilityHeartbeat struct {
+	api               API
+	queueURL          *string
+	receiptHandle     *string
+	visibilityTimeout time.Duration
+	receivedAt        time.Time
+	// Deadline is when processing must be over, the message is not extended past it
+	Deadline time.Time
+	span     oteltrace.Span
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartHeartbeat records the extensions as events of the span in ctx
+func StartHeartbeat(ctx context.Context, api API, queueURL, receiptHandle *string, visibilityTimeout int32, receivedAt time.Time, maxProcessingTime time.Duration) *VisibilityHeartbeat {
+	h := &VisibilityHeartbeat{
+		api:               api,
+		queueURL:          queueURL,
+		receiptHandle:     receiptHandle,
+		visibilityTimeout: time.Second * time.Duration(visibilityTimeout),
+		receivedAt:        receivedAt,
+		Deadline:          receivedAt.Add(maxProcessingTime),
+		span:              oteltrace.SpanFromContext(ctx),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// Stop returns once no extension is in progress, so it is safe to change the visibility afterwards
+func (h *VisibilityHeartbeat) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+	<-h.done
+}
+
+func (h *VisibilityHeartbeat) run() {
+	defer close(h.done)
+	interval := h.visibilityTimeout / 2
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for extensions := 1; ; extensions++ {
+		select {
+		case <-h.stop:
+			return
+		case <-timer.C:
+		}
+
+		remaining := time.Until(h.Deadline)
+		if remaining <= 0 {
+			return
+		}
+		extension := h.visibilityTimeout
+		if remaining < extension {
+			extension = remaining
+		}
+		seconds := int32(math.Ceil(extension.Seconds()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), VISIBILITY_EXTENSION_TIMEOUT)
+		_, err := h.api.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          h.queueURL,
+			ReceiptHandle:     h.receiptHandle,
+			VisibilityTimeout: seconds,
+		})
+		cancel()
+		if err != nil {
+			// The receipt handle is no longer valid, another consumer may get the message
+			newErr := errors.New(fmt.Sprintf("Couldn't extend visibility of message %s : %v", *h.receiptHandle, err))
+			h.span.RecordError(newErr)
+			log.Println(newErr)
+			return
+		}
+		h.span.AddEvent("visibilityExtended", oteltrace.WithAttributes(
+			attribute.Int64("messaging.visibility_timeout_seconds", int64(seconds)),
+			attribute.Int("messaging.visibility_extensions", extensions),
+			attribute.Int64("messaging.processing_ms", time.Since(h.receivedAt).Milliseconds()),
+		))
+		if remaining <= h.visibilityTimeout {
+			// The last extension already reaches the deadline
+			return
+		}
+		timer.Reset(interval)
+	}
+}
@@ -0,0 +1,44 @@
+package sqs_broker
+
+import (
+	"common/sqs_broker/fake_sqs"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestHeartbeatStopsBeforeExtending(t *testing.T) {
+	api := fake_sqs.New()
+	msg := receiveMessages(t, api, 1)[0]
+	heartbeat := StartHeartbeat(context.Background(), api, aws.String(TEST_QUEUE_URL), msg.ReceiptHandle, 1, time.Now(), time.Minute)
+	heartbeat.Stop()
+	// Stopping twice is safe
+	heartbeat.Stop()
+	time.Sleep(600 * time.Millisecond)
+	if changes := api.VisibilityChanges(); len(changes) != 0 {
+		t.Fatalf("expected no extension after Stop, got %d", len(changes))
+	}
+}
+
+func TestHeartbeatDoesNotExtendPastTheDeadline(t *testing.T) {
+	api := fake_sqs.New()
+	msg := receiveMessages(t, api, 1)[0]
+	receivedAt := time.Now()
+	heartbeat := StartHeartbeat(context.Background(), api, aws.String(TEST_QUEUE_URL), msg.ReceiptHandle, 1, receivedAt, 700*time.Millisecond)
+	defer heartbeat.Stop()
+	if !heartbeat.Deadline.Equal(receivedAt.Add(700 * time.Millisecond)) {
+		t.Fatalf("expected the deadline to be the max processing time after the receive, got %v", heartbeat.Deadline)
+	}
+
+	// The extension at half the visibility timeout reaches the deadline, there is no other one
+	time.Sleep(1200 * time.Millisecond)
+	changes := api.VisibilityChanges()
+	if len(changes) != 1 {
+		t.Fatalf("expected a single extension, got %d", len(changes))
+	}
+	if changes[0].VisibilityTimeout != 1 || aws.ToString(changes[0].ReceiptHandle) != aws.ToString(msg.ReceiptHandle) {
+		t.Fatalf("expected the message to be extended by 1s, got %ds", changes[0].VisibilityTimeout)
+	}
+}
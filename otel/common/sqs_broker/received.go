@@ -0,0 +1,51 @@
+package sqs_broker
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// FAILED_ATTEMPTS_ATTRIBUTE carries the attempts of a message over its deferred copies
+	FAILED_ATTEMPTS_ATTRIBUTE = "FailedAttempts"
+	AWS_TRACE_HEADER          = string(types.MessageSystemAttributeNameAWSTraceHeader)
+)
+
+// ReceivedMessage is what the clients keep of a received message to delete, defer or quarantine it
+type ReceivedMessage struct {
+	MessageId     string
+	ReceiptHandle *string
+	Body          string
+	// ReceiveCount is the ApproximateReceiveCount of this copy of the message
+	ReceiveCount int
+	// Attempts counts the deliveries that weren't deferred, this one included, the message is quarantined on it
+	Attempts   int
+	Attributes map[string]types.MessageAttributeValue
+	// TraceHeader is the AWSTraceHeader system attribute, if any
+	TraceHeader string
+}
+
+// NewReceivedMessage reads a message received with the ApproximateReceiveCount and AWSTraceHeader system attributes
+// and all the message attributes
+func NewReceivedMessage(msg types.Message) ReceivedMessage {
+	received := ReceivedMessage{
+		MessageId:     aws.ToString(msg.MessageId),
+		ReceiptHandle: msg.ReceiptHandle,
+		Body:          aws.ToString(msg.Body),
+		Attributes:    msg.MessageAttributes,
+		TraceHeader:   msg.Attributes[AWS_TRACE_HEADER],
+	}
+	if count, err := strconv.Atoi(msg.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)]); err == nil {
+		received.ReceiveCount = count
+	}
+	received.Attempts = received.ReceiveCount
+	// Deferred copies start over their ApproximateReceiveCount, the attempts of the previous copies come along
+	if failed, ok := msg.MessageAttributes[FAILED_ATTEMPTS_ATTRIBUTE]; ok {
+		if count, err := strconv.Atoi(aws.ToString(failed.StringValue)); err == nil && count > 0 {
+			received.Attempts += count
+		}
+	}
+	return received
+}
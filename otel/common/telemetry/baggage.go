@@ -0,0 +1,75 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	BAGGAGE_ATTRIBUTE_PREFIX = "baggage."
+	// Baggage members set by the credit score service, every service downstream gets them
+	BAGGAGE_TENANT_ID = "tenantId"
+	BAGGAGE_USER_ID   = "userId"
+)
+
+// PROPAGATED_BAGGAGE_MEMBERS are the only members accepted from the baggage of incoming requests
+var PROPAGATED_BAGGAGE_MEMBERS = []string{BAGGAGE_TENANT_ID, BAGGAGE_USER_ID}
+
+// BaggageSpanProcessor copies the baggage of the parent context to the attributes of every started span,
+// so the tenant and user of a request can be found on the spans of every service it goes through
+type BaggageSpanProcessor struct{}
+
+func NewBaggageSpanProcessor() *BaggageSpanProcessor {
+	return &BaggageSpanProcessor{}
+}
+
+// WithBaggageMember adds key=value to the baggage of ctx, which is returned unchanged when the member is invalid
+func WithBaggageMember(ctx context.Context, key, value string) context.Context {
+	member, err := baggage.NewMember(key, value)
+	if err == nil {
+		var bag baggage.Baggage
+		bag, err = baggage.FromContext(ctx).SetMember(member)
+		if err == nil {
+			return baggage.ContextWithBaggage(ctx, bag)
+		}
+	}
+	log.Println(fmt.Sprintf("Couldn't add baggage member %s : %v", key, err))
+	return ctx
+}
+
+// KeepBaggageMembers drops every member of the baggage of ctx but keys, callers can't make the services carry and
+// record arbitrary baggage
+func KeepBaggageMembers(ctx context.Context, keys ...string) context.Context {
+	bag := baggage.FromContext(ctx)
+	for _, member := range bag.Members() {
+		keep := false
+		for _, key := range keys {
+			keep = keep || member.Key() == key
+		}
+		if !keep {
+			bag = bag.DeleteMember(member.Key())
+		}
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+func (p *BaggageSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	for _, member := range baggage.FromContext(parent).Members() {
+		s.SetAttributes(attribute.String(BAGGAGE_ATTRIBUTE_PREFIX+member.Key(), member.Value()))
+	}
+}
+
+func (p *BaggageSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {}
+
+func (p *BaggageSpanProcessor) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (p *BaggageSpanProcessor) ForceFlush(ctx context.Context) error {
+	return nil
+}
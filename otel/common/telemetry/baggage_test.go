@@ -0,0 +1,20 @@
+package telemetry
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+func TestKeepBaggageMembers(t *testing.T) {
+	bag, err := baggage.Parse("tenantId=acme,userId=jdoe,session=secret,debug=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := KeepBaggageMembers(baggage.ContextWithBaggage(context.Background(), bag), PROPAGATED_BAGGAGE_MEMBERS...)
+	kept := baggage.FromContext(ctx)
+	if kept.Len() != 2 || kept.Member(BAGGAGE_TENANT_ID).Value() != "acme" || kept.Member(BAGGAGE_USER_ID).Value() != "jdoe" {
+		t.Fatalf("kept baggage %s", kept)
+	}
+}
@@ -0,0 +1,96 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	stdout "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	EXPORTER_OTLP    = "otlp"
+	EXPORTER_JAEGER  = "jaeger"
+	EXPORTER_CONSOLE = "console"
+	EXPORTER_NONE    = "none"
+
+	OTLP_PROTOCOL_GRPC    = "grpc"
+	OTLP_PROTOCOL_HTTP    = "http/protobuf"
+	DEFAULT_OTLP_PROTOCOL = OTLP_PROTOCOL_HTTP
+)
+
+var jaegerEnpoint = os.Getenv("JAEGER_ENDPOINT")
+
+// exporterNamesFromEnv reads the comma separated exporters of OTEL_TRACES_EXPORTER. Without it spans go
+// to Jaeger when JAEGER_ENDPOINT is set and are pretty printed to stdout otherwise.
+func exporterNamesFromEnv() []string {
+	names := os.Getenv("OTEL_TRACES_EXPORTER")
+	if names == "" {
+		if jaegerEnpoint != "" {
+			return []string{EXPORTER_JAEGER}
+		}
+		return []string{EXPORTER_CONSOLE}
+	}
+	var parsed []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != EXPORTER_NONE {
+			parsed = append(parsed, name)
+		}
+	}
+	return parsed
+}
+
+// otlpProtocolFromEnv reads OTEL_EXPORTER_OTLP_TRACES_PROTOCOL, falling back to OTEL_EXPORTER_OTLP_PROTOCOL
+func otlpProtocolFromEnv() string {
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+		if protocol := os.Getenv(name); protocol != "" {
+			return protocol
+		}
+	}
+	return DEFAULT_OTLP_PROTOCOL
+}
+
+// newExporter creates the exporter with that name. The OTLP exporters read their endpoint, headers, timeout,
+// compression and certificate from the OTEL_EXPORTER_OTLP_* variables themselves.
+func newExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case EXPORTER_OTLP:
+		switch protocol := otlpProtocolFromEnv(); protocol {
+		case OTLP_PROTOCOL_GRPC:
+			return otlptracegrpc.New(ctx)
+		case OTLP_PROTOCOL_HTTP:
+			return otlptracehttp.New(ctx)
+		default:
+			return nil, errors.New(fmt.Sprintf("Unsupported OTLP protocol %q, expected %s or %s", protocol, OTLP_PROTOCOL_GRPC, OTLP_PROTOCOL_HTTP))
+		}
+	case EXPORTER_JAEGER:
+		if jaegerEnpoint == "" {
+			// The collector endpoint comes from OTEL_EXPORTER_JAEGER_ENDPOINT
+			return jaeger.New(jaeger.WithCollectorEndpoint())
+		}
+		return jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(jaegerEnpoint)))
+	case EXPORTER_CONSOLE:
+		return stdout.New(stdout.WithPrettyPrint())
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown exporter %q in OTEL_TRACES_EXPORTER, expected %s, %s, %s or %s", name, EXPORTER_OTLP, EXPORTER_JAEGER, EXPORTER_CONSOLE, EXPORTER_NONE))
+	}
+}
+
+// exportersFromEnv creates every exporter of OTEL_TRACES_EXPORTER, spans are sent to all of them
+func exportersFromEnv(ctx context.Context) ([]sdktrace.SpanExporter, error) {
+	var exporters []sdktrace.SpanExporter
+	for _, name := range exporterNamesFromEnv() {
+		exporter, err := newExporter(ctx, name)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't create %s exporter: %v", name, err))
+		}
+		exporters = append(exporters, exporter)
+	}
+	return exporters, nil
+}
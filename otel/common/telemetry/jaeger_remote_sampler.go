@@ -0,0 +1,263 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	// DEFAULT_JAEGER_SAMPLING_ENDPOINT is the sampling endpoint of the Jaeger agent, the collector serves it at :14268/api/sampling
+	DEFAULT_JAEGER_SAMPLING_ENDPOINT = "http://localhost:5778/sampling"
+	DEFAULT_JAEGER_POLLING_INTERVAL  = time.Minute
+	DEFAULT_JAEGER_INITIAL_RATE      = 0.001
+	JAEGER_STRATEGY_RATE_LIMITING    = "RATE_LIMITING"
+)
+
+// samplerHolder lets the current sampler, of any type, be swapped atomically
+type samplerHolder struct {
+	sdktrace.Sampler
+}
+
+// JaegerRemoteSampler polls the sampling strategy of the service from a Jaeger sampling endpoint, so sampling
+// can be changed while the service runs. Until the first strategy arrives the initial ratio is used, and the
+// last strategy is kept while the endpoint fails.
+type JaegerRemoteSampler struct {
+	endpoint string
+	interval time.Duration
+	client   *http.Client
+	current  atomic.Value
+	strategy []byte
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewJaegerRemoteSamplerFromArg reads the comma separated endpoint=<url>, pollingIntervalMs=<ms> and
+// initialSamplingRate=<ratio> of OTEL_TRACES_SAMPLER_ARG and starts polling
+func NewJaegerRemoteSamplerFromArg(serviceName, arg string) (*JaegerRemoteSampler, error) {
+	endpoint := DEFAULT_JAEGER_SAMPLING_ENDPOINT
+	interval := DEFAULT_JAEGER_POLLING_INTERVAL
+	initialRate := DEFAULT_JAEGER_INITIAL_RATE
+	for _, option := range strings.Split(arg, ",") {
+		if strings.TrimSpace(option) == "" {
+			continue
+		}
+		keyAndValue := strings.SplitN(option, "=", 2)
+		if len(keyAndValue) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid option %q, expected <key>=<value>", option))
+		}
+		key, value := strings.TrimSpace(keyAndValue[0]), strings.TrimSpace(keyAndValue[1])
+		switch key {
+		case "endpoint":
+			endpoint = value
+		case "pollingIntervalMs":
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms <= 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid pollingIntervalMs %q", value))
+			}
+			interval = time.Duration(ms) * time.Millisecond
+		case "initialSamplingRate":
+			rate, err := parseSamplerNumber(value, DEFAULT_JAEGER_INITIAL_RATE)
+			if err != nil || rate > 1 {
+				return nil, errors.New(fmt.Sprintf("Invalid initialSamplingRate %q, expected a number from 0 to 1", value))
+			}
+			initialRate = rate
+		default:
+			return nil, errors.New(fmt.Sprintf("Unknown option %q, expected endpoint, pollingIntervalMs or initialSamplingRate", key))
+		}
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid endpoint %q: %v", endpoint, err))
+	}
+	query := endpointURL.Query()
+	query.Set("service", serviceName)
+	endpointURL.RawQuery = query.Encode()
+	return NewJaegerRemoteSampler(endpointURL.String(), interval, sdktrace.TraceIDRatioBased(initialRate)), nil
+}
+
+// NewJaegerRemoteSampler fetches the strategy from endpoint right away and then every interval until stopped
+func NewJaegerRemoteSampler(endpoint string, interval time.Duration, initial sdktrace.Sampler) *JaegerRemoteSampler {
+	s := &JaegerRemoteSampler{
+		endpoint: endpoint,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		stop:     make(chan struct{}),
+	}
+	s.current.Store(samplerHolder{initial})
+	go s.poll()
+	return s
+}
+
+func (s *JaegerRemoteSampler) poll() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.update(); err != nil {
+			log.Println(fmt.Sprintf("Couldn't update the sampling strategy from %s: %v", s.endpoint, err))
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *JaegerRemoteSampler) update() error {
+	resp, err := s.client.Get(s.endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Unexpected status %d: %s", resp.StatusCode, body))
+	}
+	// Rebuilding an unchanged strategy would reset its rate limiters
+	if bytes.Equal(body, s.strategy) {
+		return nil
+	}
+	var strategy samplingStrategy
+	if err := json.Unmarshal(body, &strategy); err != nil {
+		return errors.New(fmt.Sprintf("Invalid sampling strategy: %v", err))
+	}
+	sampler, err := strategy.sampler()
+	if err != nil {
+		return err
+	}
+	s.current.Store(samplerHolder{sampler})
+	s.strategy = body
+	log.Println(fmt.Sprintf("Using sampler %s", sampler.Description()))
+	return nil
+}
+
+func (s *JaegerRemoteSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	return s.current.Load().(samplerHolder).ShouldSample(p)
+}
+
+func (s *JaegerRemoteSampler) Description() string {
+	return fmt.Sprintf("JaegerRemoteSampler{%s}", s.current.Load().(samplerHolder).Description())
+}
+
+// Stop ends the polling, the last strategy keeps being used
+func (s *JaegerRemoteSampler) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+type probabilisticSampling struct {
+	SamplingRate float64 `json:"samplingRate"`
+}
+
+type rateLimitingSampling struct {
+	MaxTracesPerSecond float64 `json:"maxTracesPerSecond"`
+}
+
+type operationStrategy struct {
+	Operation             string                `json:"operation"`
+	ProbabilisticSampling probabilisticSampling `json:"probabilisticSampling"`
+}
+
+type operationSampling struct {
+	DefaultSamplingProbability       float64             `json:"defaultSamplingProbability"`
+	DefaultLowerBoundTracesPerSecond float64             `json:"defaultLowerBoundTracesPerSecond"`
+	PerOperationStrategies           []operationStrategy `json:"perOperationStrategies"`
+}
+
+// samplingStrategy is the response of the Jaeger sampling endpoint, older versions send the strategy type as a number
+type samplingStrategy struct {
+	StrategyType          json.RawMessage        `json:"strategyType"`
+	ProbabilisticSampling *probabilisticSampling `json:"probabilisticSampling"`
+	RateLimitingSampling  *rateLimitingSampling  `json:"rateLimitingSampling"`
+	OperationSampling     *operationSampling     `json:"operationSampling"`
+}
+
+func (s samplingStrategy) isRateLimiting() bool {
+	strategyType := strings.Trim(string(s.StrategyType), `"`)
+	return strategyType == JAEGER_STRATEGY_RATE_LIMITING || strategyType == "1"
+}
+
+func (s samplingStrategy) sampler() (sdktrace.Sampler, error) {
+	switch {
+	case s.OperationSampling != nil:
+		return newOperationSampler(*s.OperationSampling), nil
+	case s.isRateLimiting() && s.RateLimitingSampling != nil:
+		return NewRateLimitingSampler(s.RateLimitingSampling.MaxTracesPerSecond), nil
+	case s.ProbabilisticSampling != nil:
+		return sdktrace.TraceIDRatioBased(s.ProbabilisticSampling.SamplingRate), nil
+	default:
+		return nil, errors.New("The sampling strategy has no probabilistic, rate limiting or per operation sampling")
+	}
+}
+
+// guaranteedThroughputSampler samples by ratio but lets through at least lowerBound traces per second
+type guaranteedThroughputSampler struct {
+	ratio      sdktrace.Sampler
+	lowerBound *RateLimitingSampler
+}
+
+func newGuaranteedThroughputSampler(rate, lowerBound float64) guaranteedThroughputSampler {
+	sampler := guaranteedThroughputSampler{ratio: sdktrace.TraceIDRatioBased(rate)}
+	if lowerBound > 0 {
+		sampler.lowerBound = NewRateLimitingSampler(lowerBound)
+	}
+	return sampler
+}
+
+func (s guaranteedThroughputSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	result := s.ratio.ShouldSample(p)
+	if result.Decision == sdktrace.RecordAndSample || s.lowerBound == nil {
+		return result
+	}
+	return s.lowerBound.ShouldSample(p)
+}
+
+func (s guaranteedThroughputSampler) Description() string {
+	if s.lowerBound == nil {
+		return s.ratio.Description()
+	}
+	return fmt.Sprintf("%s+%s", s.ratio.Description(), s.lowerBound.Description())
+}
+
+// operationSampler picks the sampler by span name, spans of operations without strategy use the default one
+type operationSampler struct {
+	operations     map[string]sdktrace.Sampler
+	defaultSampler sdktrace.Sampler
+}
+
+func newOperationSampler(strategy operationSampling) operationSampler {
+	sampler := operationSampler{
+		operations:     map[string]sdktrace.Sampler{},
+		defaultSampler: newGuaranteedThroughputSampler(strategy.DefaultSamplingProbability, strategy.DefaultLowerBoundTracesPerSecond),
+	}
+	for _, operation := range strategy.PerOperationStrategies {
+		sampler.operations[operation.Operation] = newGuaranteedThroughputSampler(operation.ProbabilisticSampling.SamplingRate, strategy.DefaultLowerBoundTracesPerSecond)
+	}
+	return sampler
+}
+
+func (s operationSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if sampler, ok := s.operations[p.Name]; ok {
+		return sampler.ShouldSample(p)
+	}
+	return s.defaultSampler.ShouldSample(p)
+}
+
+func (s operationSampler) Description() string {
+	return fmt.Sprintf("OperationSampler{default=%s,operations=%d}", s.defaultSampler.Description(), len(s.operations))
+}
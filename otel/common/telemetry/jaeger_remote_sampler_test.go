@@ -0,0 +1,203 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// strategyServer serves the strategy and status set by the test
+type strategyServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	strategy string
+}
+
+func newStrategyServer(t *testing.T, strategy string) *strategyServer {
+	s := &strategyServer{status: http.StatusOK, strategy: strategy}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.WriteHeader(s.status)
+		w.Write([]byte(s.strategy))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *strategyServer) set(status int, strategy string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.strategy = status, strategy
+}
+
+// newTestRemoteSampler doesn't poll, the tests call update
+func newTestRemoteSampler(endpoint string) *JaegerRemoteSampler {
+	s := &JaegerRemoteSampler{
+		endpoint: endpoint,
+		interval: time.Hour,
+		client:   &http.Client{Timeout: time.Second},
+		stop:     make(chan struct{}),
+	}
+	s.current.Store(samplerHolder{sdktrace.NeverSample()})
+	return s
+}
+
+func sample(s sdktrace.Sampler, name string) sdktrace.SamplingDecision {
+	return s.ShouldSample(sdktrace.SamplingParameters{
+		ParentContext: context.Background(),
+		TraceID:       trace.TraceID{0x01},
+		Name:          name,
+	}).Decision
+}
+
+func TestJaegerRemoteSamplerStrategies(t *testing.T) {
+	tests := map[string]struct {
+		strategy string
+		check    func(t *testing.T, s sdktrace.Sampler)
+	}{
+		"probabilistic": {
+			strategy: `{"strategyType": "PROBABILISTIC", "probabilisticSampling": {"samplingRate": 1}}`,
+			check: func(t *testing.T, s sdktrace.Sampler) {
+				if sample(s, "op") != sdktrace.RecordAndSample {
+					t.Error("a rate of 1 dropped the span")
+				}
+			},
+		},
+		"rate limiting": {
+			strategy: `{"strategyType": "RATE_LIMITING", "rateLimitingSampling": {"maxTracesPerSecond": 2}}`,
+			check: func(t *testing.T, s sdktrace.Sampler) {
+				if sample(s, "op") != sdktrace.RecordAndSample || sample(s, "op") != sdktrace.RecordAndSample || sample(s, "op") != sdktrace.Drop {
+					t.Error("expected the first two spans of the second")
+				}
+			},
+		},
+		"numeric strategy type": {
+			strategy: `{"strategyType": 1, "rateLimitingSampling": {"maxTracesPerSecond": 1}}`,
+			check: func(t *testing.T, s sdktrace.Sampler) {
+				if !strings.Contains(s.Description(), "RateLimitingSampler") {
+					t.Errorf("sampler %s, want a rate limiting one", s.Description())
+				}
+			},
+		},
+		"per operation": {
+			strategy: `{"strategyType": "PROBABILISTIC", "operationSampling": {
+				"defaultSamplingProbability": 0,
+				"perOperationStrategies": [{"operation": "important", "probabilisticSampling": {"samplingRate": 1}}]
+			}}`,
+			check: func(t *testing.T, s sdktrace.Sampler) {
+				if sample(s, "important") != sdktrace.RecordAndSample {
+					t.Error("the operation with a rate of 1 dropped the span")
+				}
+				if sample(s, "other") != sdktrace.Drop {
+					t.Error("the default rate of 0 sampled the span")
+				}
+			},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := newStrategyServer(t, test.strategy)
+			s := newTestRemoteSampler(server.URL)
+			if err := s.update(); err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, s)
+		})
+	}
+}
+
+func TestJaegerRemoteSamplerKeepsTheLastStrategy(t *testing.T) {
+	server := newStrategyServer(t, `{"probabilisticSampling": {"samplingRate": 1}}`)
+	s := newTestRemoteSampler(server.URL)
+	if err := s.update(); err != nil {
+		t.Fatal(err)
+	}
+	for name, response := range map[string]struct {
+		status int
+		body   string
+	}{
+		"error status": {http.StatusInternalServerError, `{"probabilisticSampling": {"samplingRate": 0}}`},
+		"invalid json": {http.StatusOK, `{"probabilisticSampling": `},
+		"no strategy":  {http.StatusOK, `{}`},
+	} {
+		server.set(response.status, response.body)
+		if err := s.update(); err == nil {
+			t.Errorf("%s: update() succeeded", name)
+		}
+		if sample(s, "op") != sdktrace.RecordAndSample {
+			t.Errorf("%s: the last strategy was dropped", name)
+		}
+	}
+}
+
+func TestJaegerRemoteSamplerKeepsAnUnchangedStrategy(t *testing.T) {
+	server := newStrategyServer(t, `{"strategyType": "RATE_LIMITING", "rateLimitingSampling": {"maxTracesPerSecond": 1}}`)
+	s := newTestRemoteSampler(server.URL)
+	if err := s.update(); err != nil {
+		t.Fatal(err)
+	}
+	first := s.current.Load().(samplerHolder).Sampler
+	if err := s.update(); err != nil {
+		t.Fatal(err)
+	}
+	if s.current.Load().(samplerHolder).Sampler != first {
+		t.Fatal("the same strategy rebuilt the sampler, resetting its rate limiter")
+	}
+}
+
+func TestParentBasedJaegerRemoteSamplerFollowsAnUnsampledParent(t *testing.T) {
+	server := newStrategyServer(t, `{"probabilisticSampling": {"samplingRate": 1}}`)
+	t.Setenv("OTEL_TRACES_SAMPLER", PARENT_BASED_PREFIX+SAMPLER_JAEGER_REMOTE)
+	t.Setenv("OTEL_TRACES_SAMPLER_ARG", "endpoint="+server.URL+",pollingIntervalMs=10")
+	sampler, stop, err := samplerFromEnv("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// The first strategy arrives in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(sampler.Description(), "JaegerRemoteSampler{AlwaysOnSampler}") {
+		if time.Now().After(deadline) {
+			t.Fatalf("the strategy was never applied: %s", sampler.Description())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	unsampled := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{0x02},
+		SpanID:  trace.SpanID{0x02},
+		Remote:  true,
+	}))
+	result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: unsampled, TraceID: trace.TraceID{0x02}, Name: "op"})
+	if result.Decision != sdktrace.Drop {
+		t.Fatalf("decision %v for an unsampled traceparent, want Drop", result.Decision)
+	}
+	if sample(sampler, "op") != sdktrace.RecordAndSample {
+		t.Fatal("root span dropped with a rate of 1")
+	}
+}
+
+func TestRateLimitingSamplerUnderOneSpanPerSecond(t *testing.T) {
+	s := NewRateLimitingSampler(0.5)
+	if sample(s, "op") != sdktrace.RecordAndSample {
+		t.Fatal("the first span was dropped")
+	}
+	if sample(s, "op") != sdktrace.Drop {
+		t.Fatal("the second span of the second was sampled")
+	}
+	s.mu.Lock()
+	s.last = s.last.Add(-2 * time.Second)
+	s.mu.Unlock()
+	if sample(s, "op") != sdktrace.RecordAndSample {
+		t.Fatal("no span sampled two seconds later")
+	}
+}
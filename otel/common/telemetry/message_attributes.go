@@ -0,0 +1,96 @@
+package telemetry
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	MESSAGE_ATTRIBUTE_DATATYPE = "String"
+	// XRAY_TRACE_HEADER is the field of the xray propagator, SQS carries it in the AWSTraceHeader system attribute
+	XRAY_TRACE_HEADER = "X-Amzn-Trace-Id"
+)
+
+// MessageAttributesCarrier adapts SQS message attributes to the otel propagators, SQS allows up to 10 attributes
+// per message and the propagators use at most traceparent, tracestate and baggage
+type MessageAttributesCarrier map[string]types.MessageAttributeValue
+
+func (c MessageAttributesCarrier) Get(key string) string {
+	value, ok := c[key]
+	if !ok {
+		return ""
+	}
+	return aws.ToString(value.StringValue)
+}
+
+// Set ignores the X-Ray trace header, it goes in the AWSTraceHeader system attribute instead
+func (c MessageAttributesCarrier) Set(key, value string) {
+	if key == XRAY_TRACE_HEADER {
+		return
+	}
+	c[key] = types.MessageAttributeValue{
+		DataType:    aws.String(MESSAGE_ATTRIBUTE_DATATYPE),
+		StringValue: aws.String(value),
+	}
+}
+
+func (c MessageAttributesCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// InjectMessageAttributes adds the trace context and baggage of ctx to attributes, creating the map if needed
+func InjectMessageAttributes(ctx context.Context, attributes map[string]types.MessageAttributeValue) map[string]types.MessageAttributeValue {
+	if attributes == nil {
+		attributes = map[string]types.MessageAttributeValue{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, MessageAttributesCarrier(attributes))
+	return attributes
+}
+
+// InjectMessageSystemAttributes returns the AWSTraceHeader system attribute of the trace of ctx, so AWS services
+// and X-Ray instrumented consumers can follow it. It is nil unless the xray propagator is enabled.
+func InjectMessageSystemAttributes(ctx context.Context) map[string]types.MessageSystemAttributeValue {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	header := carrier.Get(XRAY_TRACE_HEADER)
+	if header == "" {
+		return nil
+	}
+	return map[string]types.MessageSystemAttributeValue{
+		string(types.MessageSystemAttributeNameForSendsAWSTraceHeader): {
+			DataType:    aws.String(MESSAGE_ATTRIBUTE_DATATYPE),
+			StringValue: aws.String(header),
+		},
+	}
+}
+
+// ExtractMessageContext reads the trace context and baggage of the producer from the message attributes.
+// Producers instrumented by AWS, such as Lambda, only set the AWSTraceHeader system attribute, which must be
+// requested when receiving. Messages sent before the trace context moved to the attributes only carry the
+// tracing information of the body.
+func ExtractMessageContext(msg types.Message, traceparent, tracestate string) context.Context {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), MessageAttributesCarrier(msg.MessageAttributes))
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	if header := msg.Attributes[string(types.MessageSystemAttributeNameAWSTraceHeader)]; header != "" {
+		ctx = xray.Propagator{}.Extract(ctx, propagation.MapCarrier{XRAY_TRACE_HEADER: header})
+		if trace.SpanContextFromContext(ctx).IsValid() {
+			return ctx
+		}
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{
+		"traceparent": traceparent,
+		"tracestate":  tracestate,
+	})
+}
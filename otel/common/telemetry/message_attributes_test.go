@@ -0,0 +1,157 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fakeSQS keeps the sent messages the way SQS hands them out, the AWSTraceHeader system attribute is returned
+// with the attributes of the message when it is requested
+type fakeSQS struct {
+	messages []types.Message
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	msg := types.Message{
+		MessageId:         aws.String(fmt.Sprintf("message-%d", len(f.messages))),
+		Body:              params.MessageBody,
+		MessageAttributes: params.MessageAttributes,
+		Attributes:        map[string]string{},
+	}
+	for name, value := range params.MessageSystemAttributes {
+		msg.Attributes[name] = aws.ToString(value.StringValue)
+	}
+	f.messages = append(f.messages, msg)
+	return &sqs.SendMessageOutput{MessageId: msg.MessageId}, nil
+}
+
+func (f *fakeSQS) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	requested := map[string]bool{}
+	for _, name := range params.AttributeNames {
+		requested[string(name)] = true
+	}
+	var received []types.Message
+	for _, msg := range f.messages {
+		attributes := map[string]string{}
+		for name, value := range msg.Attributes {
+			if requested[name] || requested[string(types.QueueAttributeNameAll)] {
+				attributes[name] = value
+			}
+		}
+		msg.Attributes = attributes
+		received = append(received, msg)
+	}
+	f.messages = nil
+	return &sqs.ReceiveMessageOutput{Messages: received}, nil
+}
+
+// receive requests the attributes the services request
+func (f *fakeSQS) receive(t *testing.T) []types.Message {
+	output, err := f.ReceiveMessage(context.Background(), &sqs.ReceiveMessageInput{
+		MessageAttributeNames: []string{string(types.QueueAttributeNameAll)},
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeName(types.MessageSystemAttributeNameApproximateReceiveCount),
+			types.QueueAttributeName(types.MessageSystemAttributeNameAWSTraceHeader),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output.Messages
+}
+
+func usePropagators(t *testing.T, names string) {
+	previous := otel.GetTextMapPropagator()
+	t.Setenv("OTEL_PROPAGATORS", names)
+	otel.SetTextMapPropagator(propagatorFromEnv())
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+}
+
+func testSpanContext(t *testing.T, traceID string) trace.SpanContext {
+	id, err := trace.TraceIDFromHex(traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	return trace.NewSpanContext(trace.SpanContextConfig{TraceID: id, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+}
+
+func sendTraced(t *testing.T, api *fakeSQS, sc trace.SpanContext) {
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	_, err := api.SendMessage(ctx, &sqs.SendMessageInput{
+		MessageBody:             aws.String("{}"),
+		MessageAttributes:       InjectMessageAttributes(ctx, nil),
+		MessageSystemAttributes: InjectMessageSystemAttributes(ctx),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInjectMessageSystemAttributes(t *testing.T) {
+	for propagators, wantHeader := range map[string]bool{
+		"tracecontext,baggage":      false,
+		"tracecontext,baggage,xray": true,
+		"xray":                      true,
+	} {
+		t.Run(propagators, func(t *testing.T) {
+			usePropagators(t, propagators)
+			api := &fakeSQS{}
+			sc := testSpanContext(t, "4bf92f3577b34da6a3ce929d0e0e4736")
+			sendTraced(t, api, sc)
+
+			msg := api.receive(t)[0]
+			header, ok := msg.Attributes[string(types.MessageSystemAttributeNameAWSTraceHeader)]
+			if ok != wantHeader {
+				t.Fatalf("expected AWSTraceHeader to be set %v, got %q", wantHeader, header)
+			}
+			if _, ok := msg.MessageAttributes[XRAY_TRACE_HEADER]; ok {
+				t.Fatalf("expected %s to stay out of the message attributes", XRAY_TRACE_HEADER)
+			}
+			if got := trace.SpanContextFromContext(ExtractMessageContext(msg, "", "")).TraceID(); got != sc.TraceID() {
+				t.Fatalf("expected trace %s, got %s", sc.TraceID(), got)
+			}
+		})
+	}
+}
+
+func TestExtractMessageContextFallbacks(t *testing.T) {
+	usePropagators(t, "tracecontext,baggage")
+	attributesTrace := testSpanContext(t, "4bf92f3577b34da6a3ce929d0e0e4736")
+	xrayTrace := testSpanContext(t, "5759e988bd862e3fe1be46a994272793")
+	bodyTrace := testSpanContext(t, "0af7651916cd43dd8448eb211c80319c")
+
+	xrayCarrier := propagation.MapCarrier{}
+	xray.Propagator{}.Inject(trace.ContextWithSpanContext(context.Background(), xrayTrace), xrayCarrier)
+	bodyCarrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), bodyTrace), bodyCarrier)
+	attributes := InjectMessageAttributes(trace.ContextWithSpanContext(context.Background(), attributesTrace), nil)
+	awsTraceHeader := map[string]string{string(types.MessageSystemAttributeNameAWSTraceHeader): xrayCarrier.Get(XRAY_TRACE_HEADER)}
+
+	for name, test := range map[string]struct {
+		msg  types.Message
+		want trace.SpanContext
+	}{
+		"attributes first":          {types.Message{MessageAttributes: attributes, Attributes: awsTraceHeader}, attributesTrace},
+		"then AWSTraceHeader":       {types.Message{Attributes: awsTraceHeader}, xrayTrace},
+		"then the body":             {types.Message{}, bodyTrace},
+		"invalid AWSTraceHeader":    {types.Message{Attributes: map[string]string{string(types.MessageSystemAttributeNameAWSTraceHeader): "Root=invalid"}}, bodyTrace},
+		"attributes without a span": {types.Message{MessageAttributes: map[string]types.MessageAttributeValue{}}, bodyTrace},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := ExtractMessageContext(test.msg, bodyCarrier.Get("traceparent"), "")
+			if got := trace.SpanContextFromContext(ctx).TraceID(); got != test.want.TraceID() {
+				t.Fatalf("expected trace %s, got %s", test.want.TraceID(), got)
+			}
+		})
+	}
+}
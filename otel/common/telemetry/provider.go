@@ -0,0 +1,176 @@
+// Package telemetry sets up the tracing shared by the services: the provider, its exporters, samplers and span
+// processors, and the propagation of the trace context through message attributes.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_PROPAGATORS = "tracecontext,baggage"
+	ID_GENERATOR_RANDOM = "random"
+	ID_GENERATOR_XRAY   = "xray"
+)
+
+type Provider struct {
+	provider     *sdktrace.TracerProvider
+	tracer       trace.Tracer
+	stopSampling func()
+}
+
+var (
+	providerMu sync.Mutex
+	providers  = map[string]*Provider{}
+)
+
+// NewProvider sets up the tracer provider of serviceName the first time it is called for it, so services running
+// in the same process each export under their own name. The first provider of the process is the global one.
+func NewProvider(serviceName string) *Provider {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	provider, ok := providers[serviceName]
+	if !ok {
+		exporters, err := exportersFromEnv(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Scrub PII and secrets from both the exported spans and the logs
+		redactor := NewRedactorFromEnv()
+		if len(providers) == 0 {
+			log.SetOutput(redactor.Writer(os.Stderr))
+		}
+		res := resourceFromEnv(context.Background(), serviceName)
+		resourceName, _ := res.Set().Value(semconv.ServiceNameKey)
+		sampler, stopSampling, err := samplerFromEnv(resourceName.AsString())
+		if err != nil {
+			log.Fatal(err)
+		}
+		options := []sdktrace.TracerProviderOption{
+			sdktrace.WithSampler(sampler),
+			sdktrace.WithSpanProcessor(NewBaggageSpanProcessor()),
+			sdktrace.WithResource(res),
+		}
+		var processors []sdktrace.SpanProcessor
+		for _, exporter := range exporters {
+			processors = append(processors, NewRedactingSpanProcessor(redactor, sdktrace.NewBatchSpanProcessor(exporter)))
+		}
+		tailSampling, err := TailSamplingSettingsFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tailSampling != nil {
+			// A single tail sampler keeps the exporters in agreement on which traces are kept
+			tailSampler, err := NewTailSamplingSpanProcessor(*tailSampling, processors...)
+			if err != nil {
+				log.Fatal(err)
+			}
+			processors = []sdktrace.SpanProcessor{tailSampler}
+		}
+		for _, processor := range processors {
+			options = append(options, sdktrace.WithSpanProcessor(processor))
+		}
+		if idGenerator := idGeneratorFromEnv(); idGenerator != nil {
+			options = append(options, sdktrace.WithIDGenerator(idGenerator))
+		}
+		tp := sdktrace.NewTracerProvider(options...)
+		if len(providers) == 0 {
+			otel.SetTracerProvider(tp)
+			otel.SetTextMapPropagator(propagatorFromEnv())
+		}
+		provider = &Provider{
+			provider:     tp,
+			tracer:       tp.Tracer(serviceName),
+			stopSampling: stopSampling,
+		}
+		providers[serviceName] = provider
+	}
+
+	return provider
+}
+
+// Tracer returns the tracer name of the provider of the span in ctx, so the spans of a service sharing the process
+// stay with its provider. Without a recording span it is the tracer of the global provider.
+func Tracer(ctx context.Context, name string) trace.Tracer {
+	if span := trace.SpanFromContext(ctx); span.IsRecording() {
+		return span.TracerProvider().Tracer(name)
+	}
+	return otel.Tracer(name)
+}
+
+// resourceFromEnv names the service serviceName, OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+func resourceFromEnv(ctx context.Context, serviceName string) *resource.Resource {
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceNameKey.String(serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		// The resource still holds the attributes that could be parsed
+		log.Println(fmt.Sprintf("Invalid resource attributes: %v", err))
+	}
+	return res
+}
+
+// propagatorFromEnv composes the propagators listed in OTEL_PROPAGATORS, xray reads and writes the
+// X-Amzn-Trace-Id header of AWS services and the AWSTraceHeader of SQS messages
+func propagatorFromEnv() propagation.TextMapPropagator {
+	names := os.Getenv("OTEL_PROPAGATORS")
+	if names == "" {
+		names = DEFAULT_PROPAGATORS
+	}
+	var propagators []propagation.TextMapPropagator
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "tracecontext":
+			propagators = append(propagators, propagation.TraceContext{})
+		case "baggage":
+			propagators = append(propagators, propagation.Baggage{})
+		case "xray":
+			propagators = append(propagators, xray.Propagator{})
+		case "none":
+		default:
+			log.Fatal(errors.New(fmt.Sprintf("Unknown propagator %q in OTEL_PROPAGATORS, expected tracecontext, baggage, xray or none", name)))
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...)
+}
+
+// idGeneratorFromEnv reads TRACING_ID_GENERATOR, X-Ray drops traces whose ids don't start with their
+// creation time so traces sent to AWS need the xray generator. Nil keeps the random generator of the sdk.
+func idGeneratorFromEnv() sdktrace.IDGenerator {
+	switch generator := os.Getenv("TRACING_ID_GENERATOR"); generator {
+	case "", ID_GENERATOR_RANDOM:
+		return nil
+	case ID_GENERATOR_XRAY:
+		return xray.NewIDGenerator()
+	default:
+		log.Fatal(errors.New(fmt.Sprintf("Unknown TRACING_ID_GENERATOR %q, expected %s or %s", generator, ID_GENERATOR_RANDOM, ID_GENERATOR_XRAY)))
+		return nil
+	}
+}
+
+func (tp *Provider) GetTracer() trace.Tracer {
+	return tp.tracer
+}
+
+// ShuwDownTracer flushes the buffered spans to the exporter, giving up once ctx is done
+func (tp *Provider) ShuwDownTracer(ctx context.Context) {
+	tp.stopSampling()
+	if err := tp.provider.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down tracer provider: %v", err)
+	}
+}
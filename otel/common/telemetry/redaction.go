@@ -0,0 +1,253 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	REDACTION_MASK = "mask"
+	REDACTION_HASH = "hash"
+
+	REDACTED_VALUE = "[REDACTED]"
+)
+
+var (
+	// Secrets are masked, identifiers are hashed so they can still be correlated
+	defaultKeyRules   = "mask:(?i)(password|passwd|secret|token|authorization|credential|^user(name)?$);hash:(?i)user_?id"
+	defaultValueRules = `mask:(?i)bearer\s+[a-z0-9._~+/-]+=*;mask:\b\d{13,19}\b;hash:[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`
+
+	// keyValuePattern finds key/value pairs in log lines such as "key":"value", key=value or map[key:value]
+	keyValuePattern = regexp.MustCompile(`("?)([A-Za-z0-9_.-]+)("?\s*[:=]\s*)("(?:[^"\\]|\\.)*"|[^\s,;"{}\[\]]+)`)
+)
+
+type redactionRule struct {
+	mode    string
+	pattern *regexp.Regexp
+}
+
+// Redactor masks or hashes the attributes whose keys match a key rule and any text matching a value rule
+type Redactor struct {
+	keyRules   []redactionRule
+	valueRules []redactionRule
+	salt       []byte
+}
+
+// parseRedactionRules reads rules written as <mode>:<regexp> separated by semicolons
+func parseRedactionRules(rules string) ([]redactionRule, error) {
+	var parsed []redactionRule
+	for _, rule := range strings.Split(rules, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 || (parts[0] != REDACTION_MASK && parts[0] != REDACTION_HASH) {
+			return nil, errors.New(fmt.Sprintf("Invalid redaction rule %q, expected mask:<regexp> or hash:<regexp>", rule))
+		}
+		pattern, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid redaction rule %q: %v", rule, err))
+		}
+		parsed = append(parsed, redactionRule{mode: parts[0], pattern: pattern})
+	}
+	return parsed, nil
+}
+
+func NewRedactor(keyRules, valueRules, salt string) (*Redactor, error) {
+	keys, err := parseRedactionRules(keyRules)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseRedactionRules(valueRules)
+	if err != nil {
+		return nil, err
+	}
+	return &Redactor{
+		keyRules:   keys,
+		valueRules: values,
+		salt:       []byte(salt),
+	}, nil
+}
+
+// NewRedactorFromEnv reads REDACTION_KEY_RULES, REDACTION_VALUE_RULES and REDACTION_HASH_SALT,
+// setting a rules variable to "none" disables that kind of rules
+func NewRedactorFromEnv() *Redactor {
+	rulesFromEnv := func(name, defaultRules string) string {
+		rules, ok := os.LookupEnv(name)
+		if !ok {
+			return defaultRules
+		}
+		if rules == "none" {
+			return ""
+		}
+		return rules
+	}
+	redactor, err := NewRedactor(
+		rulesFromEnv("REDACTION_KEY_RULES", defaultKeyRules),
+		rulesFromEnv("REDACTION_VALUE_RULES", defaultValueRules),
+		os.Getenv("REDACTION_HASH_SALT"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return redactor
+}
+
+func (r *Redactor) apply(mode, value string) string {
+	if mode == REDACTION_MASK {
+		return REDACTED_VALUE
+	}
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(value))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (r *Redactor) keyMode(key string) (string, bool) {
+	for _, rule := range r.keyRules {
+		if rule.pattern.MatchString(key) {
+			return rule.mode, true
+		}
+	}
+	return "", false
+}
+
+// String redacts every match of the value rules and the values of matching keys found in text
+func (r *Redactor) String(text string) string {
+	for _, rule := range r.valueRules {
+		mode := rule.mode
+		text = rule.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			return r.apply(mode, match)
+		})
+	}
+	if len(r.keyRules) > 0 {
+		text = keyValuePattern.ReplaceAllStringFunc(text, func(pair string) string {
+			groups := keyValuePattern.FindStringSubmatch(pair)
+			mode, ok := r.keyMode(groups[2])
+			if !ok {
+				return pair
+			}
+			value := groups[4]
+			if strings.HasPrefix(value, `"`) {
+				return groups[1] + groups[2] + groups[3] + `"` + r.apply(mode, strings.Trim(value, `"`)) + `"`
+			}
+			return groups[1] + groups[2] + groups[3] + r.apply(mode, value)
+		})
+	}
+	return text
+}
+
+func (r *Redactor) Attribute(kv attribute.KeyValue) attribute.KeyValue {
+	if mode, ok := r.keyMode(string(kv.Key)); ok {
+		return kv.Key.String(r.apply(mode, kv.Value.Emit()))
+	}
+	switch kv.Value.Type() {
+	case attribute.STRING:
+		return kv.Key.String(r.String(kv.Value.AsString()))
+	case attribute.STRINGSLICE:
+		values := kv.Value.AsStringSlice()
+		redacted := make([]string, len(values))
+		for i, value := range values {
+			redacted[i] = r.String(value)
+		}
+		return kv.Key.StringSlice(redacted)
+	}
+	return kv
+}
+
+func (r *Redactor) Attributes(attrs []attribute.KeyValue) []attribute.KeyValue {
+	redacted := make([]attribute.KeyValue, len(attrs))
+	for i, kv := range attrs {
+		redacted[i] = r.Attribute(kv)
+	}
+	return redacted
+}
+
+type redactingWriter struct {
+	redactor *Redactor
+	out      io.Writer
+}
+
+// Writer scrubs every write before passing it to out, the log package writes one entry per call
+func (r *Redactor) Writer(out io.Writer) io.Writer {
+	return &redactingWriter{
+		redactor: r,
+		out:      out,
+	}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, w.redactor.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactedSpan exposes a finished span with its attributes, events and status redacted
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	redactor *Redactor
+}
+
+func (s redactedSpan) Attributes() []attribute.KeyValue {
+	return s.redactor.Attributes(s.ReadOnlySpan.Attributes())
+}
+
+func (s redactedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	redacted := make([]sdktrace.Event, len(events))
+	for i, event := range events {
+		redacted[i] = event
+		redacted[i].Attributes = s.redactor.Attributes(event.Attributes)
+	}
+	return redacted
+}
+
+func (s redactedSpan) Status() sdktrace.Status {
+	status := s.ReadOnlySpan.Status()
+	status.Description = s.redactor.String(status.Description)
+	return status
+}
+
+// RedactingSpanProcessor hands redacted copies of the ended spans to the next processor, so exporters never see raw values
+type RedactingSpanProcessor struct {
+	next     sdktrace.SpanProcessor
+	redactor *Redactor
+}
+
+func NewRedactingSpanProcessor(redactor *Redactor, next sdktrace.SpanProcessor) *RedactingSpanProcessor {
+	return &RedactingSpanProcessor{
+		next:     next,
+		redactor: redactor,
+	}
+}
+
+func (p *RedactingSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	p.next.OnStart(parent, s)
+}
+
+func (p *RedactingSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.next.OnEnd(redactedSpan{
+		ReadOnlySpan: s,
+		redactor:     p.redactor,
+	})
+}
+
+func (p *RedactingSpanProcessor) Shutdown(ctx context.Context) error {
+	return p.next.Shutdown(ctx)
+}
+
+func (p *RedactingSpanProcessor) ForceFlush(ctx context.Context) error {
+	return p.next.ForceFlush(ctx)
+}
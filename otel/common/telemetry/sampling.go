@@ -0,0 +1,206 @@
+package telemetry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SAMPLER_ALWAYS_ON     = "always_on"
+	SAMPLER_ALWAYS_OFF    = "always_off"
+	SAMPLER_RATIO         = "traceidratio"
+	SAMPLER_RATE_LIMITING = "ratelimiting"
+	SAMPLER_RULES         = "rules"
+	SAMPLER_JAEGER_REMOTE = "jaeger_remote"
+
+	// PARENT_BASED_PREFIX makes a sampler decide only for root spans, the rest follow the sampled flag of their parent
+	PARENT_BASED_PREFIX = "parentbased_"
+	DEFAULT_SAMPLER     = PARENT_BASED_PREFIX + SAMPLER_ALWAYS_ON
+)
+
+// samplerFromEnv reads OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG, by default root spans are always sampled
+// and the others follow their parent, including the parent of an incoming traceparent. The returned function
+// stops the background work of the sampler.
+func samplerFromEnv(serviceName string) (sdktrace.Sampler, func(), error) {
+	name := strings.TrimSpace(os.Getenv("OTEL_TRACES_SAMPLER"))
+	if name == "" {
+		name = DEFAULT_SAMPLER
+	}
+	arg := os.Getenv("OTEL_TRACES_SAMPLER_ARG")
+	stop := func() {}
+	var sampler sdktrace.Sampler
+	var err error
+	switch root := strings.TrimPrefix(name, PARENT_BASED_PREFIX); root {
+	case SAMPLER_JAEGER_REMOTE:
+		var remote *JaegerRemoteSampler
+		remote, err = NewJaegerRemoteSamplerFromArg(serviceName, arg)
+		if err == nil {
+			sampler, stop = remote, remote.Stop
+		}
+	case SAMPLER_RULES:
+		sampler, err = NewRuleSamplerFromArg(arg)
+	default:
+		sampler, err = newSampler(root, arg)
+	}
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Invalid OTEL_TRACES_SAMPLER %q: %v", name, err))
+	}
+	if strings.HasPrefix(name, PARENT_BASED_PREFIX) {
+		sampler = sdktrace.ParentBased(sampler)
+	}
+	return sampler, stop, nil
+}
+
+// newSampler creates one of the samplers that need at most a number as argument
+func newSampler(name, arg string) (sdktrace.Sampler, error) {
+	switch name {
+	case SAMPLER_ALWAYS_ON:
+		return sdktrace.AlwaysSample(), nil
+	case SAMPLER_ALWAYS_OFF:
+		return sdktrace.NeverSample(), nil
+	case SAMPLER_RATIO:
+		ratio, err := parseSamplerNumber(arg, 1)
+		if err != nil || ratio > 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid ratio %q, expected a number from 0 to 1", arg))
+		}
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case SAMPLER_RATE_LIMITING:
+		maxPerSecond, err := parseSamplerNumber(arg, 1)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid rate %q, expected the traces per second", arg))
+		}
+		return NewRateLimitingSampler(maxPerSecond), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown sampler %q, expected %s, %s, %s, %s, %s or %s, optionally prefixed by %s",
+			name, SAMPLER_ALWAYS_ON, SAMPLER_ALWAYS_OFF, SAMPLER_RATIO, SAMPLER_RATE_LIMITING, SAMPLER_RULES, SAMPLER_JAEGER_REMOTE, PARENT_BASED_PREFIX))
+	}
+}
+
+func parseSamplerNumber(arg string, defaultValue float64) (float64, error) {
+	if strings.TrimSpace(arg) == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+	if err != nil || value < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid number %q", arg))
+	}
+	return value, nil
+}
+
+// RateLimitingSampler samples up to maxPerSecond spans per second, allowing bursts of a second worth of spans.
+// Rates under one span per second still let a span through once the balance reaches one.
+type RateLimitingSampler struct {
+	mu           sync.Mutex
+	maxPerSecond float64
+	maxBalance   float64
+	balance      float64
+	last         time.Time
+}
+
+func NewRateLimitingSampler(maxPerSecond float64) *RateLimitingSampler {
+	maxBalance := math.Max(maxPerSecond, 1)
+	return &RateLimitingSampler{
+		maxPerSecond: maxPerSecond,
+		maxBalance:   maxBalance,
+		balance:      maxBalance,
+		last:         time.Now(),
+	}
+}
+
+func (s *RateLimitingSampler) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.balance += now.Sub(s.last).Seconds() * s.maxPerSecond
+	s.last = now
+	if s.balance > s.maxBalance {
+		s.balance = s.maxBalance
+	}
+	if s.balance < 1 {
+		return false
+	}
+	s.balance--
+	return true
+}
+
+func (s *RateLimitingSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	decision := sdktrace.Drop
+	if s.allow() {
+		decision = sdktrace.RecordAndSample
+	}
+	return sdktrace.SamplingResult{
+		Decision:   decision,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+}
+
+func (s *RateLimitingSampler) Description() string {
+	return fmt.Sprintf("RateLimitingSampler{%g}", s.maxPerSecond)
+}
+
+type samplingRule struct {
+	pattern *regexp.Regexp
+	sampler sdktrace.Sampler
+}
+
+// RuleSampler hands each span to the sampler of the first rule matching its name, spans matching no rule are sampled
+type RuleSampler struct {
+	rules []samplingRule
+}
+
+// NewRuleSamplerFromArg reads rules written as <sampler>:<regexp> separated by semicolons, the sampler being
+// always_on, always_off, traceidratio=<ratio> or ratelimiting=<traces per second>
+func NewRuleSamplerFromArg(arg string) (*RuleSampler, error) {
+	sampler := &RuleSampler{}
+	for _, rule := range strings.Split(arg, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid sampling rule %q, expected <sampler>:<regexp>", rule))
+		}
+		nameAndArg := strings.SplitN(strings.TrimSpace(parts[0]), "=", 2)
+		samplerArg := ""
+		if len(nameAndArg) == 2 {
+			samplerArg = nameAndArg[1]
+		}
+		ruleSampler, err := newSampler(nameAndArg[0], samplerArg)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid sampling rule %q: %v", rule, err))
+		}
+		pattern, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid sampling rule %q: %v", rule, err))
+		}
+		sampler.rules = append(sampler.rules, samplingRule{pattern: pattern, sampler: ruleSampler})
+	}
+	return sampler, nil
+}
+
+func (s *RuleSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, rule := range s.rules {
+		if rule.pattern.MatchString(p.Name) {
+			return rule.sampler.ShouldSample(p)
+		}
+	}
+	return sdktrace.AlwaysSample().ShouldSample(p)
+}
+
+func (s *RuleSampler) Description() string {
+	descriptions := make([]string, len(s.rules))
+	for i, rule := range s.rules {
+		descriptions[i] = rule.sampler.Description() + ":" + rule.pattern.String()
+	}
+	return fmt.Sprintf("RuleSampler{%s}", strings.Join(descriptions, ";"))
+}
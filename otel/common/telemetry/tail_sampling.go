@@ -0,0 +1,391 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_TAIL_SAMPLING_WINDOW              = 10 * time.Second
+	DEFAULT_TAIL_SAMPLING_LATENCY_THRESHOLD   = 2 * time.Second
+	DEFAULT_TAIL_SAMPLING_RATIO               = 0.1
+	DEFAULT_TAIL_SAMPLING_MAX_TRACES          = 10000
+	DEFAULT_TAIL_SAMPLING_MAX_SPANS_PER_TRACE = 1000
+	DEFAULT_TAIL_SAMPLING_MAX_SPANS           = 100000
+	// MIN_TAIL_SAMPLING_TICK bounds how often the expired traces are looked for with very short windows
+	MIN_TAIL_SAMPLING_TICK = time.Millisecond
+
+	// Decisions and their reasons, used as labels of the tail sampling metrics
+	TAIL_SAMPLING_KEPT    = "kept"
+	TAIL_SAMPLING_DROPPED = "dropped"
+	TAIL_SAMPLING_ERROR   = "error"
+	TAIL_SAMPLING_LATENCY = "latency"
+	TAIL_SAMPLING_RATIO   = "ratio"
+
+	// Reasons to decide on a trace before its window ends
+	TAIL_SAMPLING_MAX_TRACES = "max_traces"
+	TAIL_SAMPLING_MAX_SPANS  = "max_spans"
+	// TAIL_SAMPLING_MAX_BUFFERED_SPANS is reached by the spans of all the buffered traces together
+	TAIL_SAMPLING_MAX_BUFFERED_SPANS = "max_buffered_spans"
+	TAIL_SAMPLING_FLUSH              = "flush"
+)
+
+var (
+	tailSampledTraces = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tail_sampling_traces_total",
+		Help: "The total number of traces kept or dropped by the tail sampler, by the reason of the decision",
+	}, []string{"decision", "reason"})
+	tailSamplingEarlyDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tail_sampling_early_decisions_total",
+		Help: "The total number of traces decided before their window ended, to bound memory or on flush",
+	}, []string{"reason"})
+	tailSamplingBufferedTraces = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tail_sampling_buffered_traces",
+		Help: "The number of traces waiting for the tail sampling decision",
+	})
+)
+
+type TailSamplingSettings struct {
+	// Window is how long the spans of a trace are buffered after its first span ends
+	Window time.Duration
+	// LatencyThreshold keeps the traces with a span lasting longer than it
+	LatencyThreshold time.Duration
+	// Ratio is the share of the traces without errors or slow spans that are kept
+	Ratio float64
+	// MaxTraces, MaxSpansPerTrace and MaxSpans, of all the traces, bound the buffer, the oldest traces are decided
+	// early once they are reached
+	MaxTraces        int
+	MaxSpansPerTrace int
+	MaxSpans         int
+}
+
+// TailSamplingSettingsFromEnv reads TAIL_SAMPLING_WINDOW, TAIL_SAMPLING_LATENCY_THRESHOLD, TAIL_SAMPLING_RATIO,
+// TAIL_SAMPLING_MAX_TRACES, TAIL_SAMPLING_MAX_SPANS_PER_TRACE and TAIL_SAMPLING_MAX_SPANS. It is nil unless
+// TAIL_SAMPLING_ENABLED is true.
+func TailSamplingSettingsFromEnv() (*TailSamplingSettings, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("TAIL_SAMPLING_ENABLED")); !enabled {
+		return nil, nil
+	}
+	settings := &TailSamplingSettings{
+		Window:           DEFAULT_TAIL_SAMPLING_WINDOW,
+		LatencyThreshold: DEFAULT_TAIL_SAMPLING_LATENCY_THRESHOLD,
+		Ratio:            DEFAULT_TAIL_SAMPLING_RATIO,
+		MaxTraces:        DEFAULT_TAIL_SAMPLING_MAX_TRACES,
+		MaxSpansPerTrace: DEFAULT_TAIL_SAMPLING_MAX_SPANS_PER_TRACE,
+		MaxSpans:         DEFAULT_TAIL_SAMPLING_MAX_SPANS,
+	}
+	for name, duration := range map[string]*time.Duration{
+		"TAIL_SAMPLING_WINDOW":            &settings.Window,
+		"TAIL_SAMPLING_LATENCY_THRESHOLD": &settings.LatencyThreshold,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid %s %q, expected a positive duration", name, value))
+			}
+			*duration = parsed
+		}
+	}
+	if value := os.Getenv("TAIL_SAMPLING_RATIO"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid TAIL_SAMPLING_RATIO %q, expected a number from 0 to 1", value))
+		}
+		settings.Ratio = parsed
+	}
+	for name, limit := range map[string]*int{
+		"TAIL_SAMPLING_MAX_TRACES":          &settings.MaxTraces,
+		"TAIL_SAMPLING_MAX_SPANS_PER_TRACE": &settings.MaxSpansPerTrace,
+		"TAIL_SAMPLING_MAX_SPANS":           &settings.MaxSpans,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				return nil, errors.New(fmt.Sprintf("Invalid %s %q, expected a positive number", name, value))
+			}
+			*limit = parsed
+		}
+	}
+	return settings, nil
+}
+
+// Validate checks the settings built without TailSamplingSettingsFromEnv
+func (s TailSamplingSettings) Validate() error {
+	if s.Window <= 0 || s.LatencyThreshold <= 0 {
+		return errors.New(fmt.Sprintf("Invalid tail sampling window %v or latency threshold %v, expected positive durations", s.Window, s.LatencyThreshold))
+	}
+	if s.Ratio < 0 || s.Ratio > 1 {
+		return errors.New(fmt.Sprintf("Invalid tail sampling ratio %v, expected a number from 0 to 1", s.Ratio))
+	}
+	if s.MaxTraces < 1 || s.MaxSpansPerTrace < 1 || s.MaxSpans < 1 {
+		return errors.New(fmt.Sprintf("Invalid tail sampling limits MaxTraces=%d MaxSpansPerTrace=%d MaxSpans=%d, expected positive numbers", s.MaxTraces, s.MaxSpansPerTrace, s.MaxSpans))
+	}
+	return nil
+}
+
+type bufferedTrace struct {
+	id        trace.TraceID
+	firstSeen time.Time
+	spans     []sdktrace.ReadOnlySpan
+	decided   bool
+}
+
+// TailSamplingSpanProcessor buffers the ended spans of each trace for a window and then hands all of them to the
+// next processors or none. Traces with an error status or a slow span are always kept, the rest by trace id ratio,
+// so every service keeps the same healthy traces. Spans ending after the decision follow it while it is remembered.
+// Each service decides on its own spans, so the head sampler must sample every span for this one to see them.
+// The decision is taken once the spans ended, too late to reach the other services of the trace: a trace kept for
+// an error or a slow span in one service only keeps the spans of that service. Keeping those traces whole takes a
+// tail sampler in a collector receiving the spans of every service, such as the tail_sampling processor of the
+// OpenTelemetry Collector.
+type TailSamplingSpanProcessor struct {
+	settings TailSamplingSettings
+	next     []sdktrace.SpanProcessor
+	// ratio decides like the head sampler, so services keep the same traces for the same ratio
+	ratio sdktrace.Sampler
+
+	mu     sync.Mutex
+	traces map[trace.TraceID]*bufferedTrace
+	// order holds the buffered traces oldest first, decided ones are skipped
+	order         []*bufferedTrace
+	bufferedSpans int
+	// decisions remembers whether the last MaxTraces decided traces were kept, for the spans ending late
+	decisions     map[trace.TraceID]bool
+	decisionOrder []trace.TraceID
+	nextDecision  int
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTailSamplingSpanProcessor fails on invalid settings, see TailSamplingSettings.Validate
+func NewTailSamplingSpanProcessor(settings TailSamplingSettings, next ...sdktrace.SpanProcessor) (*TailSamplingSpanProcessor, error) {
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+	p := &TailSamplingSpanProcessor{
+		settings:      settings,
+		next:          next,
+		ratio:         sdktrace.TraceIDRatioBased(settings.Ratio),
+		traces:        map[trace.TraceID]*bufferedTrace{},
+		decisions:     map[trace.TraceID]bool{},
+		decisionOrder: make([]trace.TraceID, settings.MaxTraces),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+// run decides on the traces whose window ended, checking a few times per window
+func (p *TailSamplingSpanProcessor) run() {
+	defer close(p.done)
+	interval := p.settings.Window / 10
+	if interval < MIN_TAIL_SAMPLING_TICK {
+		interval = MIN_TAIL_SAMPLING_TICK
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.decideExpired(now)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *TailSamplingSpanProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	for _, next := range p.next {
+		next.OnStart(parent, s)
+	}
+}
+
+func (p *TailSamplingSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	traceID := s.SpanContext().TraceID()
+	p.mu.Lock()
+	if keep, ok := p.decisions[traceID]; ok {
+		p.mu.Unlock()
+		if keep {
+			p.export([]sdktrace.ReadOnlySpan{s})
+		}
+		return
+	}
+	var decided []*bufferedTrace
+	buffered, ok := p.traces[traceID]
+	if !ok {
+		if len(p.traces) >= p.settings.MaxTraces {
+			oldest := p.popOldest()
+			tailSamplingEarlyDecisions.WithLabelValues(TAIL_SAMPLING_MAX_TRACES).Inc()
+			decided = append(decided, oldest)
+		}
+		buffered = &bufferedTrace{id: traceID, firstSeen: time.Now()}
+		p.traces[traceID] = buffered
+		p.order = append(p.order, buffered)
+	}
+	buffered.spans = append(buffered.spans, s)
+	p.bufferedSpans++
+	if len(buffered.spans) >= p.settings.MaxSpansPerTrace {
+		p.remove(buffered)
+		tailSamplingEarlyDecisions.WithLabelValues(TAIL_SAMPLING_MAX_SPANS).Inc()
+		decided = append(decided, buffered)
+	}
+	for p.settings.MaxSpans > 0 && p.bufferedSpans >= p.settings.MaxSpans {
+		oldest := p.popOldest()
+		if oldest == nil {
+			break
+		}
+		tailSamplingEarlyDecisions.WithLabelValues(TAIL_SAMPLING_MAX_BUFFERED_SPANS).Inc()
+		decided = append(decided, oldest)
+	}
+	spans := p.decide(decided)
+	tailSamplingBufferedTraces.Set(float64(len(p.traces)))
+	p.mu.Unlock()
+	p.export(spans)
+}
+
+// decideExpired decides on the traces that were first seen a window before now
+func (p *TailSamplingSpanProcessor) decideExpired(now time.Time) {
+	p.mu.Lock()
+	var decided []*bufferedTrace
+	for len(p.order) > 0 {
+		oldest := p.order[0]
+		if oldest.decided {
+			// Decided early because it reached MaxSpansPerTrace
+			p.order[0] = nil
+			p.order = p.order[1:]
+			continue
+		}
+		if now.Sub(oldest.firstSeen) < p.settings.Window {
+			break
+		}
+		decided = append(decided, p.popOldest())
+	}
+	spans := p.decide(decided)
+	tailSamplingBufferedTraces.Set(float64(len(p.traces)))
+	p.mu.Unlock()
+	p.export(spans)
+}
+
+// decideAll decides on every buffered trace without waiting for its window
+func (p *TailSamplingSpanProcessor) decideAll() {
+	p.mu.Lock()
+	var decided []*bufferedTrace
+	for oldest := p.popOldest(); oldest != nil; oldest = p.popOldest() {
+		decided = append(decided, oldest)
+	}
+	tailSamplingEarlyDecisions.WithLabelValues(TAIL_SAMPLING_FLUSH).Add(float64(len(decided)))
+	spans := p.decide(decided)
+	tailSamplingBufferedTraces.Set(0)
+	p.mu.Unlock()
+	p.export(spans)
+}
+
+// popOldest removes the oldest undecided trace from the buffer, it must be called with the lock held
+func (p *TailSamplingSpanProcessor) popOldest() *bufferedTrace {
+	for len(p.order) > 0 {
+		oldest := p.order[0]
+		p.order[0] = nil
+		p.order = p.order[1:]
+		if !oldest.decided {
+			p.remove(oldest)
+			return oldest
+		}
+	}
+	return nil
+}
+
+// remove takes the trace out of the buffer, it must be called with the lock held
+func (p *TailSamplingSpanProcessor) remove(buffered *bufferedTrace) {
+	buffered.decided = true
+	p.bufferedSpans -= len(buffered.spans)
+	delete(p.traces, buffered.id)
+}
+
+// decide records the decision on each trace and returns the spans to keep, it must be called with the lock held
+func (p *TailSamplingSpanProcessor) decide(traces []*bufferedTrace) []sdktrace.ReadOnlySpan {
+	var kept []sdktrace.ReadOnlySpan
+	for _, buffered := range traces {
+		keep, reason := p.shouldKeep(buffered)
+		decision := TAIL_SAMPLING_DROPPED
+		if keep {
+			decision = TAIL_SAMPLING_KEPT
+			kept = append(kept, buffered.spans...)
+		}
+		tailSampledTraces.WithLabelValues(decision, reason).Inc()
+		p.remember(buffered.id, keep)
+	}
+	return kept
+}
+
+func (p *TailSamplingSpanProcessor) shouldKeep(buffered *bufferedTrace) (bool, string) {
+	for _, s := range buffered.spans {
+		if s.Status().Code == codes.Error {
+			return true, TAIL_SAMPLING_ERROR
+		}
+	}
+	for _, s := range buffered.spans {
+		if s.EndTime().Sub(s.StartTime()) > p.settings.LatencyThreshold {
+			return true, TAIL_SAMPLING_LATENCY
+		}
+	}
+	result := p.ratio.ShouldSample(sdktrace.SamplingParameters{TraceID: buffered.id})
+	return result.Decision == sdktrace.RecordAndSample, TAIL_SAMPLING_RATIO
+}
+
+// remember keeps the decision on the trace, forgetting the oldest one, it must be called with the lock held
+func (p *TailSamplingSpanProcessor) remember(traceID trace.TraceID, keep bool) {
+	if forgotten := p.decisionOrder[p.nextDecision]; forgotten.IsValid() {
+		delete(p.decisions, forgotten)
+	}
+	p.decisionOrder[p.nextDecision] = traceID
+	p.nextDecision = (p.nextDecision + 1) % len(p.decisionOrder)
+	p.decisions[traceID] = keep
+}
+
+func (p *TailSamplingSpanProcessor) export(spans []sdktrace.ReadOnlySpan) {
+	for _, s := range spans {
+		for _, next := range p.next {
+			next.OnEnd(s)
+		}
+	}
+}
+
+// Shutdown decides on the buffered traces right away and shuts the next processors down
+func (p *TailSamplingSpanProcessor) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+	p.decideAll()
+	var err error
+	for _, next := range p.next {
+		if nextErr := next.Shutdown(ctx); nextErr != nil && err == nil {
+			err = nextErr
+		}
+	}
+	return err
+}
+
+// ForceFlush decides on the buffered traces right away and flushes the next processors
+func (p *TailSamplingSpanProcessor) ForceFlush(ctx context.Context) error {
+	p.decideAll()
+	var err error
+	for _, next := range p.next {
+		if nextErr := next.ForceFlush(ctx); nextErr != nil && err == nil {
+			err = nextErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTailSampler(t *testing.T, settings TailSamplingSettings) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	sampler, err := NewTailSamplingSpanProcessor(settings, recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sampler))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return provider, recorder
+}
+
+func TestTailSamplingRejectsZeroSettings(t *testing.T) {
+	if _, err := NewTailSamplingSpanProcessor(TailSamplingSettings{}); err == nil {
+		t.Fatal("expected the zero settings to be rejected")
+	}
+}
+
+func TestTailSamplingMaxSpansDecidesOldestTraces(t *testing.T) {
+	provider, recorder := newTestTailSampler(t, TailSamplingSettings{
+		Window:           time.Hour,
+		LatencyThreshold: time.Hour,
+		Ratio:            1,
+		MaxTraces:        100,
+		MaxSpansPerTrace: 100,
+		MaxSpans:         3,
+	})
+	tracer := provider.Tracer("test")
+	for i := 0; i < 3; i++ {
+		_, span := tracer.Start(context.Background(), fmt.Sprintf("trace-%d", i))
+		span.End()
+	}
+
+	ended := recorder.Ended()
+	if len(ended) != 1 || ended[0].Name() != "trace-0" {
+		t.Fatalf("expected only the oldest trace to be decided, got %d spans", len(ended))
+	}
+}
+
+func TestTailSamplingShortWindow(t *testing.T) {
+	provider, recorder := newTestTailSampler(t, TailSamplingSettings{
+		Window:           time.Nanosecond,
+		LatencyThreshold: time.Hour,
+		Ratio:            1,
+		MaxTraces:        100,
+		MaxSpansPerTrace: 100,
+		MaxSpans:         100,
+	})
+	_, span := provider.Tracer("test").Start(context.Background(), "short")
+	span.End()
+
+	deadline := time.Now().Add(time.Second)
+	for len(recorder.Ended()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the trace to be decided once its window expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,158 @@
+package vault
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	FILE_REF_PREFIX = "file:"
+)
+
+// FileVault stores every set of credentials AES-256-GCM encrypted in its own file of a local directory, files older
+// than the ttl are swept
+type FileVault struct {
+	dir  string
+	aead cipher.AEAD
+	ttl  time.Duration
+}
+
+// NewFileVault takes the base64 encoded 32 bytes key shared by every service using the directory
+func NewFileVault(dir string, encodedKey string, ttl time.Duration) (*FileVault, error) {
+	if ttl <= 0 {
+		return nil, errors.New("The credentials vault ttl must be positive")
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("The credentials vault key must be 32 base64 encoded bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't create credentials vault %s: %v", dir, err))
+	}
+	v := &FileVault{
+		dir:  dir,
+		aead: aead,
+		ttl:  ttl,
+	}
+	// Credentials are not deleted once resolved, redeliveries and deferred requests resolve them again
+	go v.sweep(ttl / 2)
+	return v, nil
+}
+
+// sweep deletes the expired credentials every interval for the lifetime of the process
+func (v *FileVault) sweep(interval time.Duration) {
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		v.deleteExpired()
+		<-ticker.C
+	}
+}
+
+func (v *FileVault) deleteExpired() {
+	files, err := filepath.Glob(filepath.Join(v.dir, "*.enc"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err == nil && v.expired(info) {
+			os.Remove(file)
+		}
+	}
+}
+
+func (v *FileVault) expired(info os.FileInfo) bool {
+	return time.Since(info.ModTime()) > v.ttl
+}
+
+func (v *FileVault) Store(ctx context.Context, creds map[string]string) (string, error) {
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(id)
+	// The id is authenticated along the credentials, so files can't be swapped
+	sealed := v.aead.Seal(nonce, nonce, plaintext, []byte(name))
+
+	tmp, err := ioutil.TempFile(v.dir, name)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Couldn't store credentials: %v", err))
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return "", errors.New(fmt.Sprintf("Couldn't store credentials: %v", err))
+	}
+	if err := tmp.Close(); err != nil {
+		return "", errors.New(fmt.Sprintf("Couldn't store credentials: %v", err))
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(v.dir, name+".enc")); err != nil {
+		return "", errors.New(fmt.Sprintf("Couldn't store credentials: %v", err))
+	}
+	return FILE_REF_PREFIX + name, nil
+}
+
+func (v *FileVault) Resolve(ctx context.Context, ref string) (map[string]string, error) {
+	name := strings.TrimPrefix(ref, FILE_REF_PREFIX)
+	if _, err := hex.DecodeString(name); err != nil || name == ref || name == "" {
+		return nil, fmt.Errorf("%w: malformed reference", ErrUnknownReference)
+	}
+	file := filepath.Join(v.dir, name+".enc")
+	if info, err := os.Stat(file); err == nil && v.expired(info) {
+		os.Remove(file)
+		return nil, fmt.Errorf("%w: %s expired", ErrUnknownReference, ref)
+	}
+	sealed, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownReference, ref)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't read credentials: %v", err))
+	}
+	nonceSize := v.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("Corrupted credentials file")
+	}
+	plaintext, err := v.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil {
+		return nil, errors.New("Couldn't decrypt credentials, check the vault key")
+	}
+	var creds map[string]string
+	if err := json.Unmarshal(plaintext, &creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
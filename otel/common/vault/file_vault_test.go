@@ -0,0 +1,93 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_KEY = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+
+func TestFileVaultResolvesStoredCredentials(t *testing.T) {
+	v, err := NewFileVault(t.TempDir(), TEST_KEY, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := v.Store(context.Background(), map[string]string{"user": "jdoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := v.Resolve(context.Background(), ref)
+	if err != nil || creds["user"] != "jdoe" {
+		t.Fatalf("Resolve() = %v, %v", creds, err)
+	}
+	// Redeliveries resolve the same reference again
+	if _, err := v.Resolve(context.Background(), ref); err != nil {
+		t.Fatalf("second Resolve() = %v", err)
+	}
+}
+
+func TestFileVaultExpiresCredentials(t *testing.T) {
+	dir := t.TempDir()
+	v, err := NewFileVault(dir, TEST_KEY, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := v.Store(context.Background(), map[string]string{"user": "jdoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, strings.TrimPrefix(ref, FILE_REF_PREFIX)+".enc")
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Resolve(context.Background(), ref); !errors.Is(err, ErrUnknownReference) {
+		t.Fatalf("Resolve() = %v, want ErrUnknownReference", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("expired credentials file was not deleted: %v", err)
+	}
+}
+
+func TestFileVaultSweepsExpiredCredentials(t *testing.T) {
+	dir := t.TempDir()
+	v, err := NewFileVault(dir, TEST_KEY, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := v.Store(context.Background(), map[string]string{"user": "old"})
+	fresh, _ := v.Store(context.Background(), map[string]string{"user": "new"})
+	expiredFile := filepath.Join(dir, strings.TrimPrefix(expired, FILE_REF_PREFIX)+".enc")
+	old := time.Now().Add(-2 * time.Minute)
+	if err := os.Chtimes(expiredFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	v.deleteExpired()
+	if _, err := os.Stat(expiredFile); !os.IsNotExist(err) {
+		t.Fatalf("expired credentials file was not swept: %v", err)
+	}
+	if _, err := v.Resolve(context.Background(), fresh); err != nil {
+		t.Fatalf("fresh credentials were swept: %v", err)
+	}
+}
+
+func TestKeyFromEnvReadsTheKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CREDENTIALS_VAULT_KEY", "")
+	t.Setenv("CREDENTIALS_VAULT_KEY_FILE", "")
+	if _, err := keyFromEnv(dir); err == nil {
+		t.Fatal("keyFromEnv() without a key succeeded")
+	}
+	if err := os.WriteFile(filepath.Join(dir, DEFAULT_VAULT_KEY_FILENAME), []byte(TEST_KEY+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := keyFromEnv(dir)
+	if err != nil || key != TEST_KEY {
+		t.Fatalf("keyFromEnv() = %q, %v", key, err)
+	}
+}
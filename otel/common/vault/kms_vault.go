@@ -0,0 +1,104 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const (
+	KMS_REF_PREFIX = "kms:"
+)
+
+// kmsEncryptionContext binds the ciphertexts to this use, KMS refuses to decrypt them with another context
+var kmsEncryptionContext = map[string]string{
+	"purpose": "banking-credentials",
+}
+
+// KMSVault encrypts the credentials with a KMS key, the reference is the ciphertext itself so
+// nothing has to be stored and only services allowed to decrypt with the key can read it
+type KMSVault struct {
+	keyId string
+	api   *kms.Client
+}
+
+func NewKMSVault(keyId string) (*KMSVault, error) {
+	if keyId == "" {
+		return nil, errors.New("A KMS key id or alias is required for the KMS credentials vault")
+	}
+	endpointUrl := os.Getenv("ENDPOINT_URL")
+	var cfg aws.Config
+	var err error
+	if endpointUrl != "" {
+		customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{
+				URL:           endpointUrl,
+				SigningRegion: region,
+			}, nil
+		})
+		cfg, err = config.LoadDefaultConfig(context.Background(), config.WithEndpointResolverWithOptions(customResolver))
+	} else {
+		cfg, err = config.LoadDefaultConfig(context.Background())
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Couldn't create kms client: %v", err))
+	}
+	return &KMSVault{
+		keyId: keyId,
+		api:   kms.NewFromConfig(cfg),
+	}, nil
+}
+
+func (v *KMSVault) Store(ctx context.Context, creds map[string]string) (string, error) {
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return "", err
+	}
+	out, err := v.api.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:               &v.keyId,
+		Plaintext:           plaintext,
+		EncryptionContext:   kmsEncryptionContext,
+		EncryptionAlgorithm: types.EncryptionAlgorithmSpecSymmetricDefault,
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Couldn't encrypt credentials: %v", err))
+	}
+	return KMS_REF_PREFIX + base64.RawURLEncoding.EncodeToString(out.CiphertextBlob), nil
+}
+
+func (v *KMSVault) Resolve(ctx context.Context, ref string) (map[string]string, error) {
+	if !strings.HasPrefix(ref, KMS_REF_PREFIX) {
+		return nil, fmt.Errorf("%w: malformed reference", ErrUnknownReference)
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(ref, KMS_REF_PREFIX))
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed reference", ErrUnknownReference)
+	}
+	out, err := v.api.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:               &v.keyId,
+		CiphertextBlob:      ciphertext,
+		EncryptionContext:   kmsEncryptionContext,
+		EncryptionAlgorithm: types.EncryptionAlgorithmSpecSymmetricDefault,
+	})
+	if err != nil {
+		var invalid *types.InvalidCiphertextException
+		if errors.As(err, &invalid) {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownReference, err)
+		}
+		return nil, errors.New(fmt.Sprintf("Couldn't decrypt credentials: %v", err))
+	}
+	var creds map[string]string
+	if err := json.Unmarshal(out.Plaintext, &creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
@@ -0,0 +1,72 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_VAULT_DIR = "/tmp/banking-credentials"
+	// DEFAULT_VAULT_KEY_FILENAME is the file of the vault directory scripts/generate_vault_key.sh writes the key to
+	DEFAULT_VAULT_KEY_FILENAME = "vault.key"
+	DEFAULT_VAULT_TTL          = time.Hour
+)
+
+var ErrUnknownReference = errors.New("unknown banking credentials reference")
+
+// Vault keeps banking credentials out of the queues, messages only carry the opaque reference returned by Store
+type Vault interface {
+	Store(ctx context.Context, credentials map[string]string) (string, error)
+	Resolve(ctx context.Context, ref string) (map[string]string, error)
+}
+
+// New builds the vault set in CREDENTIALS_VAULT, "file" (the default) or "kms". The file vault keeps the credentials
+// in CREDENTIALS_VAULT_DIR for CREDENTIALS_VAULT_TTL, encrypted with the base64 encoded key of CREDENTIALS_VAULT_KEY
+// or, when it is not set, of the file CREDENTIALS_VAULT_KEY_FILE, by default vault.key in the directory.
+func New() (Vault, error) {
+	switch backend := os.Getenv("CREDENTIALS_VAULT"); backend {
+	case "", "file":
+		dir := os.Getenv("CREDENTIALS_VAULT_DIR")
+		if dir == "" {
+			dir = DEFAULT_VAULT_DIR
+		}
+		key, err := keyFromEnv(dir)
+		if err != nil {
+			return nil, err
+		}
+		ttl := DEFAULT_VAULT_TTL
+		if value := os.Getenv("CREDENTIALS_VAULT_TTL"); value != "" {
+			ttl, err = time.ParseDuration(value)
+			if err != nil || ttl <= 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid CREDENTIALS_VAULT_TTL %q, expected a positive duration", value))
+			}
+		}
+		return NewFileVault(dir, key, ttl)
+	case "kms":
+		return NewKMSVault(os.Getenv("CREDENTIALS_KMS_KEY_ID"))
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown credentials vault %s", backend))
+	}
+}
+
+// keyFromEnv reads the key of the file vault, the services sharing the directory must use the same key
+func keyFromEnv(dir string) (string, error) {
+	if key := os.Getenv("CREDENTIALS_VAULT_KEY"); key != "" {
+		return key, nil
+	}
+	keyFile := os.Getenv("CREDENTIALS_VAULT_KEY_FILE")
+	if keyFile == "" {
+		keyFile = filepath.Join(dir, DEFAULT_VAULT_KEY_FILENAME)
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Couldn't read the credentials vault key, set CREDENTIALS_VAULT_KEY or run scripts/generate_vault_key.sh: %v", err))
+	}
+	return strings.TrimSpace(string(key)), nil
+}
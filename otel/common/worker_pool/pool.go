@@ -0,0 +1,215 @@
+package worker_pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	DEFAULT_WORKERS = 10
+)
+
+var (
+	ErrPoolFull   = errors.New("worker pool queue is full")
+	ErrPoolClosed = errors.New("worker pool is closed")
+
+	poolWorkers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "worker_pool_workers",
+		Help: "The number of workers of the pool",
+	}, []string{"pool"})
+	poolBusy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "worker_pool_busy_workers",
+		Help: "The number of workers running a job",
+	}, []string{"pool"})
+	poolUtilization = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "worker_pool_utilization",
+		Help: "The ratio of busy workers, from 0 to 1",
+	}, []string{"pool"})
+	poolQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "worker_pool_queued_jobs",
+		Help: "The number of jobs waiting for a worker",
+	}, []string{"pool"})
+	poolQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "worker_pool_queue_wait_seconds",
+		Help:    "The time jobs wait in the queue before a worker picks them",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"pool"})
+	poolRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "worker_pool_rejected_total",
+		Help: "The total number of jobs rejected because the queue was full or the pool closed",
+	}, []string{"pool"})
+)
+
+type job struct {
+	fn         func()
+	enqueuedAt time.Time
+}
+
+// Pool runs jobs on a fixed number of workers, jobs wait in a bounded queue while all workers are busy.
+// Producers call WaitForCapacity before fetching work, so nothing is fetched that can't be queued.
+type Pool struct {
+	name     string
+	workers  int
+	capacity int
+	jobs     chan job
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	pending int
+	busy    int
+	closed  bool
+	// freed is signaled every time a job finishes
+	freed chan struct{}
+}
+
+func New(name string, workers, queueSize int) (*Pool, error) {
+	if workers < 1 {
+		return nil, errors.New(fmt.Sprintf("Worker pool %s needs at least one worker", name))
+	}
+	if queueSize < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid queue size %d for worker pool %s", queueSize, name))
+	}
+	p := &Pool{
+		name:     name,
+		workers:  workers,
+		capacity: workers + queueSize,
+		jobs:     make(chan job, workers+queueSize),
+		freed:    make(chan struct{}, 1),
+	}
+	poolWorkers.WithLabelValues(name).Set(float64(workers))
+	poolBusy.WithLabelValues(name).Set(0)
+	poolUtilization.WithLabelValues(name).Set(0)
+	poolQueued.WithLabelValues(name).Set(0)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p, nil
+}
+
+// NewFromEnv reads WORKER_POOL_SIZE and WORKER_POOL_QUEUE_SIZE, the queue defaults to the number of workers
+func NewFromEnv(name string) (*Pool, error) {
+	workers, err := intFromEnv("WORKER_POOL_SIZE", DEFAULT_WORKERS)
+	if err != nil {
+		return nil, err
+	}
+	queueSize, err := intFromEnv("WORKER_POOL_QUEUE_SIZE", workers)
+	if err != nil {
+		return nil, err
+	}
+	return New(name, workers, queueSize)
+}
+
+func intFromEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid %s %q: %v", name, value, err))
+	}
+	return parsed, nil
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for j := range p.jobs {
+		poolQueueWait.WithLabelValues(p.name).Observe(time.Since(j.enqueuedAt).Seconds())
+		p.mu.Lock()
+		p.busy++
+		p.report()
+		p.mu.Unlock()
+
+		p.run(j.fn)
+
+		p.mu.Lock()
+		p.busy--
+		p.pending--
+		p.report()
+		p.mu.Unlock()
+		select {
+		case p.freed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run keeps a panicking job from taking its worker down
+func (p *Pool) run(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println(fmt.Sprintf("Worker pool %s job panicked: %v", p.name, r))
+		}
+	}()
+	fn()
+}
+
+// report must be called holding the lock
+func (p *Pool) report() {
+	poolBusy.WithLabelValues(p.name).Set(float64(p.busy))
+	poolUtilization.WithLabelValues(p.name).Set(float64(p.busy) / float64(p.workers))
+	poolQueued.WithLabelValues(p.name).Set(float64(p.pending - p.busy))
+}
+
+// Free returns how many jobs can be submitted without being rejected
+func (p *Pool) Free() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.capacity - p.pending
+}
+
+// WaitForCapacity blocks while the workers and the queue are full, it returns the free room
+func (p *Pool) WaitForCapacity(ctx context.Context) (int, error) {
+	for {
+		if free := p.Free(); free > 0 {
+			return free, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-p.freed:
+		}
+	}
+}
+
+// Submit queues fn without blocking, it fails when the queue is full or the pool closed
+func (p *Pool) Submit(fn func()) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		poolRejected.WithLabelValues(p.name).Inc()
+		return ErrPoolClosed
+	}
+	if p.pending >= p.capacity {
+		p.mu.Unlock()
+		poolRejected.WithLabelValues(p.name).Inc()
+		return ErrPoolFull
+	}
+	p.pending++
+	p.report()
+	// The channel holds capacity jobs, the send never blocks
+	p.jobs <- job{fn: fn, enqueuedAt: time.Now()}
+	p.mu.Unlock()
+	return nil
+}
+
+// Close stops accepting jobs and waits for the queued and running ones to finish
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,93 @@
+package worker_pool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSubmitRejectsJobsOverCapacity(t *testing.T) {
+	pool, err := New("test_submit", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		if err := pool.Submit(func() { <-release }); err != nil {
+			t.Fatalf("expected job %d to be accepted, got %v", i, err)
+		}
+	}
+	if err := pool.Submit(func() {}); err != ErrPoolFull {
+		t.Fatalf("expected %v, got %v", ErrPoolFull, err)
+	}
+	close(release)
+	pool.Close()
+}
+
+func TestWaitForCapacityBlocksUntilAJobFinishes(t *testing.T) {
+	pool, err := New("test_wait", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if free, err := pool.WaitForCapacity(context.Background()); err != nil || free != 1 {
+		t.Fatalf("expected 1 free slot, got %d %v", free, err)
+	}
+	release := make(chan struct{})
+	if err := pool.Submit(func() { <-release }); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.WaitForCapacity(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected to wait until the deadline, got %v", err)
+	}
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if free, err := pool.WaitForCapacity(ctx); err != nil || free != 1 {
+		t.Fatalf("expected the finished job to free its slot, got %d %v", free, err)
+	}
+}
+
+func TestCloseRunsQueuedJobsAndRejectsNewOnes(t *testing.T) {
+	pool, err := New("test_close", 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ran int32
+	for i := 0; i < 5; i++ {
+		if err := pool.Submit(func() {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&ran, 1)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.Close()
+	if ran := atomic.LoadInt32(&ran); ran != 5 {
+		t.Fatalf("expected Close to wait for the 5 jobs, %d ran", ran)
+	}
+	if err := pool.Submit(func() {}); err != ErrPoolClosed {
+		t.Fatalf("expected %v, got %v", ErrPoolClosed, err)
+	}
+}
+
+func TestPanickingJobKeepsItsWorker(t *testing.T) {
+	pool, err := New("test_panic", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	pool.Submit(func() { panic("poison") })
+	pool.Submit(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the worker to survive the panic")
+	}
+	pool.Close()
+}
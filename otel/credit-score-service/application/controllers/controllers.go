@@ -1,30 +1,42 @@
 package controllers
 
 import (
-	"credit-score-service/application/msg-broker/banking_gateway_sqs"
-	"credit-score-service/application/msg-broker/client_score_sqs"
+	"common/banking_data"
+	"common/telemetry"
 	"credit-score-service/application/tracing"
 	banking_gateway "credit-score-service/core/baking_gateway"
+	"errors"
 	"fmt"
+	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/propagation"
 	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
+// HealthReporter is implemented by the message broker clients
+type HealthReporter interface {
+	IsReady() bool
+	IsHealthy() bool
+}
+
 var (
 	bankingClient banking_gateway.Client
+	brokers       []HealthReporter
 	tp            *tracing.TracingProvider
 )
 
 func init() {
 	tp = tracing.NewProvider()
-	var err error
-	bankingClient, err = banking_gateway_sqs.New()
-	if err != nil {
-		panic(err)
-	}
+}
+
+// Setup sets the client GetUserBankingScore sends the banking requests with and the clients checked by the probes
+func Setup(client banking_gateway.Client, clients ...HealthReporter) {
+	bankingClient = client
+	brokers = clients
 }
 
 // Ready godoc
@@ -34,10 +46,15 @@ func init() {
 // @Success 200
 // @Router /readiness [get]
 func ReadinessProbe(c *fiber.Ctx) error {
-	if client_score_sqs.IsInitialized && banking_gateway_sqs.IsInitialized {
-		return c.SendStatus(200)
+	if len(brokers) == 0 {
+		return c.SendStatus(500)
+	}
+	for _, broker := range brokers {
+		if !broker.IsReady() {
+			return c.SendStatus(500)
+		}
 	}
-	return c.SendStatus(500)
+	return c.SendStatus(200)
 }
 
 // Healthy godoc
@@ -47,45 +64,87 @@ func ReadinessProbe(c *fiber.Ctx) error {
 // @Success 200
 // @Router /healthz [get]
 func Healthz(c *fiber.Ctx) error {
-	if client_score_sqs.IsHealthy && banking_gateway_sqs.IsHealthy {
-		return c.SendStatus(200)
+	if len(brokers) == 0 {
+		return c.SendStatus(500)
+	}
+	for _, broker := range brokers {
+		if !broker.IsHealthy() {
+			return c.SendStatus(500)
+		}
 	}
-	return c.SendStatus(500)
+	return c.SendStatus(200)
 }
 
 // GetUserBankingScore godoc
 // @Summary User Banking Score
 // @Description Returns the score of a user
 // @ID GetUserBankingScore
+// @Param refresh query bool false "Skip the cached banking data"
+// @Param X-Tenant-Id header string false "Tenant of the request, propagated as baggage"
 // @Success 200
+// @Failure 422 {object} banking_data.BankingError "The banking gateway can't fetch the banking data"
+// @Failure 503 {object} banking_data.BankingError "The banking gateway failed, the request may be retried"
 // @Router /score [get]
 func GetUserBankingScore(c *fiber.Ctx) error {
 	userId := "reus"
 	bankingInstitutionId := "userId"
-	ctx, span := tp.GetTracer().Start(c.Context(), "calculateScore", oteltrace.WithAttributes(
+	// Callers can continue their trace and pass the tenant and user baggage members, any other member is dropped.
+	// The tenant comes from the baggage or the X-Tenant-Id header
+	incoming := propagation.MapCarrier{}
+	for _, field := range otel.GetTextMapPropagator().Fields() {
+		incoming[field] = c.Get(field)
+	}
+	ctxRequest := otel.GetTextMapPropagator().Extract(c.Context(), incoming)
+	ctxRequest = telemetry.KeepBaggageMembers(ctxRequest, telemetry.PROPAGATED_BAGGAGE_MEMBERS...)
+	if tenantId := c.Get("X-Tenant-Id"); tenantId != "" {
+		ctxRequest = telemetry.WithBaggageMember(ctxRequest, telemetry.BAGGAGE_TENANT_ID, tenantId)
+	}
+	ctxRequest = telemetry.WithBaggageMember(ctxRequest, telemetry.BAGGAGE_USER_ID, userId)
+	ctx, span := tp.GetTracer().Start(ctxRequest, "calculateScore", oteltrace.WithAttributes(
 		attribute.String("req.userId", userId),
 		attribute.String("req.bankingInstitutionId", bankingInstitutionId),
 	))
+	defer span.End()
 
 	prop := propagation.TraceContext{}
 	carrier := propagation.MapCarrier{}
 	prop.Inject(ctx, carrier)
-	tracingInformation := map[string]interface{}{
-		"traceparent": carrier["traceparent"],
+	tracingInformation := banking_data.TracingInformation{
+		Traceparent: carrier["traceparent"],
+		Tracestate:  carrier["tracestate"],
 	}
 
-	err := bankingClient.Send(&banking_gateway.BankingGatewayRequest{
+	err := bankingClient.Send(ctx, &banking_gateway.BankingGatewayRequest{
+		Version:              banking_data.SCHEMA_VERSION,
 		UserId:               userId,
 		BankingInstitutionId: bankingInstitutionId,
-		BankingCredentials:   make(map[string]string),
 		TracingInformation:   tracingInformation,
+		BypassCache:          c.Query("refresh") == "true",
 	})
 	if err != nil {
+		// No response would come back, don't wait for one
 		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	res, _ := bankingClient.Recv()
-	fmt.Println(res)
-	span.End()
+	// The request context is done once the server shuts down
+	res, err := bankingClient.Recv(c.Context())
+	var bankingErr *banking_gateway.BankingGatewayError
+	if errors.As(err, &bankingErr) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, bankingErr.Code)
+		status := fiber.StatusUnprocessableEntity
+		if bankingErr.Retryable {
+			status = fiber.StatusServiceUnavailable
+		}
+		return c.Status(status).JSON(bankingErr)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	log.Println(fmt.Sprintf("Banking score userId=%s score=%v", userId, res))
 	return c.SendStatus(200)
 }
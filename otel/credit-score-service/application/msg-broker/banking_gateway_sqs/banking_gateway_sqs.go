@@ -1,16 +1,18 @@
 package banking_gateway_sqs
 
 import (
+	"common/sqs_broker"
+	"common/telemetry"
 	"context"
 	"credit-score-service/application/tracing"
 	banking_gateway "credit-score-service/core/baking_gateway"
-	"credit-score-service/core/credit_score"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-	"reflect"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,31 +22,59 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/codes"
 
 	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
-const (
-	VISIBILITY_TIMEOUT = int32(15)
-)
-
 var (
 	opsProcessed = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "total_banking_requests_processed",
 		Help: "The total number of processed events for banking_requests",
 	})
+	opsQuarantined = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "total_banking_responses_quarantined",
+		Help: "The total number of banking responses moved to the dead letter queue",
+	}, []string{"reason"})
 	IsInitialized = false
-	IsHealthy     = false
 )
 
 type BankingGatewaySQSClient struct {
 	requestsQueueURL  *string
 	responsesQueueURL *string
-	api               *sqs.Client
+	api               sqs_broker.API
+	waitTimeSeconds   int32
+	visibilityTimeout int32
+	// deleter removes the responses once read, so they aren't handed out again
+	deleter     *sqs_broker.BatchDeleter
+	deadLetters *sqs_broker.DeadLetterQueue
+	// lastRecvFail is set by the receiving goroutine and read by the probes, 1 while receiving fails
+	lastRecvFail int32
+}
+
+// receivedMsg is a received response, err is set when its body is not a valid response
+type receivedMsg struct {
+	resp *banking_gateway.BankingGatesWayResponse
+	sqs_broker.ReceivedMessage
+	// producerCtx carries the span context and baggage of the producer of the message
+	producerCtx context.Context
+	err         error
 }
 
-func New() (banking_gateway.Client, error) {
+// int32FromEnv reads a number between min and max from the environment
+func int32FromEnv(name string, defaultValue, min, max int32) (int32, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || int32(parsed) < min || int32(parsed) > max {
+		return 0, errors.New(fmt.Sprintf("Invalid %s %q, expected a number from %d to %d", name, value, min, max))
+	}
+	return int32(parsed), nil
+}
+
+func New() (*BankingGatewaySQSClient, error) {
 	endpointUrl := os.Getenv("ENDPOINT_URL")
 	var cfg aws.Config
 	var err error
@@ -64,8 +94,11 @@ func New() (banking_gateway.Client, error) {
 		return nil, errors.New(fmt.Sprintf("Couldn't create credit score client: %v", err))
 	}
 
-	client := sqs.NewFromConfig(cfg)
+	return NewWith(sqs.NewFromConfig(cfg))
+}
 
+// NewWith resolves the queues with client, tests pass a fake API
+func NewWith(client sqs_broker.API) (*BankingGatewaySQSClient, error) {
 	requestsQueueName := os.Getenv("BANKING_REQUESTS_QUEUE_NAME")
 	reqQueueUrlOutput, err := client.GetQueueUrl(context.Background(), &sqs.GetQueueUrlInput{
 		QueueName: &requestsQueueName,
@@ -82,17 +115,51 @@ func New() (banking_gateway.Client, error) {
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Couldn't get url for queue %s: %v", responsesQueueName, err))
 	}
+
+	// Long polling waits up to 20 seconds for messages instead of returning empty right away
+	waitTimeSeconds, err := int32FromEnv("SQS_WAIT_TIME_SECONDS", 20, 0, 20)
+	if err != nil {
+		return nil, err
+	}
+	visibilityTimeout, err := int32FromEnv("SQS_VISIBILITY_TIMEOUT", sqs_broker.DEFAULT_VISIBILITY_TIMEOUT, 1, sqs_broker.MAX_SQS_VISIBILITY_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	// Without a dead letter queue malformed responses stay in their queue
+	var dlqURL *string
+	if dlqName := os.Getenv("BANKING_RESPONSES_DLQ_NAME"); dlqName != "" {
+		dlqUrlOutput, err := client.GetQueueUrl(context.Background(), &sqs.GetQueueUrlInput{
+			QueueName: &dlqName,
+		})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't get url for queue %s: %v", dlqName, err))
+		}
+		dlqURL = dlqUrlOutput.QueueUrl
+	}
 	IsInitialized = true
-	IsHealthy = true
 	return &BankingGatewaySQSClient{
 		requestsQueueURL:  reqQueueUrlOutput.QueueUrl,
 		responsesQueueURL: respQueueUrlOutput.QueueUrl,
 		api:               client,
+		waitTimeSeconds:   waitTimeSeconds,
+		visibilityTimeout: visibilityTimeout,
+		deleter:           sqs_broker.NewBatchDeleter(client, respQueueUrlOutput.QueueUrl),
+		deadLetters:       sqs_broker.NewDeadLetterQueue(client, respQueueUrlOutput.QueueUrl, dlqURL, opsQuarantined),
 	}, nil
 }
 
-func (c *BankingGatewaySQSClient) Send(resp *banking_gateway.BankingGatewayRequest) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+// IsReady is true once the queues are resolved
+func (c *BankingGatewaySQSClient) IsReady() bool {
+	return IsInitialized
+}
+
+// IsHealthy is false while receiving from the responses queue fails
+func (c *BankingGatewaySQSClient) IsHealthy() bool {
+	return atomic.LoadInt32(&c.lastRecvFail) == 0
+}
+
+func (c *BankingGatewaySQSClient) Send(ctx context.Context, resp *banking_gateway.BankingGatewayRequest) error {
+	ctxSend, cancel := context.WithTimeout(ctx, time.Second*15)
 	defer cancel()
 
 	data, err := json.Marshal(resp)
@@ -100,9 +167,11 @@ func (c *BankingGatewaySQSClient) Send(resp *banking_gateway.BankingGatewayReque
 		return errors.New(fmt.Sprintf("Cannot marshall message data: %v", err))
 	}
 	stringData := string(data)
-	_, err = c.api.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:    c.requestsQueueURL,
-		MessageBody: &stringData,
+	_, err = c.api.SendMessage(ctxSend, &sqs.SendMessageInput{
+		QueueUrl:                c.requestsQueueURL,
+		MessageBody:             &stringData,
+		MessageAttributes:       telemetry.InjectMessageAttributes(ctx, nil),
+		MessageSystemAttributes: telemetry.InjectMessageSystemAttributes(ctx),
 	})
 
 	if err != nil {
@@ -111,137 +180,105 @@ func (c *BankingGatewaySQSClient) Send(resp *banking_gateway.BankingGatewayReque
 	return nil
 }
 
-func (c *BankingGatewaySQSClient) processMsg(handlerFunc func(msg *banking_gateway.BankingGatesWayResponse) error, req *banking_gateway.BankingGatesWayResponse, receiptHandle *string, tp *tracing.TracingProvider) error {
-	if req != nil && len(req.Data) > 0 {
-		// Instrument SQS recv
-		traceContext := req.Data["tracingInformation"].(map[string]interface{})
-		prop := propagation.TraceContext{}
-		ctxCall := prop.Extract(context.Background(), propagation.MapCarrier{
-			"traceparent": traceContext["traceparent"].(string),
-		})
-		_, span := tp.GetTracer().Start(ctxCall, "processBankingResponse", oteltrace.WithAttributes(
-			attribute.String("req.userId", req.Data["userId"].(string)),
-			attribute.String("req.bankingInstitutionId", req.Data["bankingInstitutionId"].(string)),
-		))
-
-		defer span.End()
-
-		// Apply the function and then continue the process
-		if err := handlerFunc(req); err == nil {
-			ctxDelete, cancel := context.WithTimeout(ctxCall, time.Second*5)
-			defer cancel()
-			_, err = c.api.DeleteMessage(ctxDelete, &sqs.DeleteMessageInput{
-				QueueUrl:      c.responsesQueueURL,
-				ReceiptHandle: receiptHandle,
-			})
-
-			// Idempotent operation dead letter queues not needed
-			if err != nil {
-				span.RecordError(errors.New(fmt.Sprintf("Couldn't delete message %s: %v", *receiptHandle, err)))
-				fmt.Println(fmt.Sprintf("Couldn't delete message %s : %v", *receiptHandle, err))
-			}
-
-			opsProcessed.Inc()
-		} else {
-			span.RecordError(errors.New(fmt.Sprintf("Couldn't process message : %v", receiptHandle)))
-			fmt.Println(fmt.Sprintf("Couldn't process message %s : %v", *receiptHandle, err))
-		}
-		fmt.Println("finished recv")
-	}
-	return nil
-}
-
-// func (c *BankingGatewaySQSClient) Recv(handlerFunc func(msg *banking_gateway.BankingGatesWayResponse) error) error {
-//   ctx := context.Background()
-//   log.Println(fmt.Sprintf("Listening queue: %v", *c.requestsQueueURL))
-//   for {
-//     select {
-//     case <-ctx.Done():
-//       log.Println("Stopping polling because a context kill signal was sent")
-//       return nil
-//     default:
-//       tp := tracing.NewProvider()
-//       req, receiptHandle, err := c.recv()
-//       if err != nil && len(req.Data) > 0 {
-//         // Record error in a new span
-//         IsHealthy = false
-//         traceparent := req.Data["tracingInformation"].(string)
-//         prop := propagation.TraceContext{}
-//         ctxCall := prop.Extract(context.Background(), propagation.MapCarrier{
-//           "traceparent": traceparent,
-//         })
-//         _, span := tp.GetTracer().Start(ctxCall, "recvCalculateScore")
-//         log.Printf(fmt.Sprintf("Couldn't recieve message : %v", err))
-//         span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
-//       }
-//       // Handle process in a goroutine
-//       IsHealthy = true
-//       go c.processMsg(handlerFunc, req, receiptHandle, tp)
-//     }
-//   }
-// }
-
-func (c *BankingGatewaySQSClient) recv() (*banking_gateway.BankingGatesWayResponse, *string, error) {
+// recv returns the next response, if any
+func (c *BankingGatewaySQSClient) recv(ctx context.Context) (*receivedMsg, error) {
 	recvMsgInput := &sqs.ReceiveMessageInput{
 		MessageAttributeNames: []string{
 			string(types.QueueAttributeNameAll),
 		},
-		WaitTimeSeconds:   1,
-		QueueUrl:          c.responsesQueueURL,
-		VisibilityTimeout: VISIBILITY_TIMEOUT,
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeName(types.MessageSystemAttributeNameApproximateReceiveCount),
+			// Set by producers instrumented with X-Ray
+			types.QueueAttributeName(types.MessageSystemAttributeNameAWSTraceHeader),
+		},
+		// Recv hands out a single response, a batch would leave the rest invisible until their timeout
+		MaxNumberOfMessages: 1,
+		WaitTimeSeconds:     c.waitTimeSeconds,
+		QueueUrl:            c.responsesQueueURL,
+		VisibilityTimeout:   c.visibilityTimeout,
 	}
 
-	msgOutput, err := c.api.ReceiveMessage(context.TODO(), recvMsgInput)
+	msgOutput, err := c.api.ReceiveMessage(ctx, recvMsgInput)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if len(msgOutput.Messages) == 0 {
+		return nil, nil
 	}
 
-	if len(msgOutput.Messages) > 0 {
-		msg := msgOutput.Messages[0]
-		var req banking_gateway.BankingGatesWayResponse
-		if err := json.Unmarshal([]byte(*msg.Body), &req); err != nil || reflect.DeepEqual(req, credit_score.CreditScoreRequest{}) {
-			return nil, nil, errors.New(fmt.Sprintf("Unknown message format, cannot parse json: %v", *msg.Body))
-		}
-		return &req, msg.ReceiptHandle, nil
+	msg := msgOutput.Messages[0]
+	received := &receivedMsg{
+		ReceivedMessage: sqs_broker.NewReceivedMessage(msg),
+	}
+	var resp banking_gateway.BankingGatesWayResponse
+	if err := json.Unmarshal([]byte(received.Body), &resp); err != nil {
+		received.err = errors.New(fmt.Sprintf("Unknown message format, cannot parse the json body: %v", err))
+	} else if err := resp.Validate(); err != nil {
+		received.err = errors.New(fmt.Sprintf("Invalid banking data response %s: %v", received.MessageId, err))
 	} else {
-		return nil, nil, nil
+		received.resp = &resp
 	}
+	// Responses that fail validation may still carry the trace of their producer
+	received.producerCtx = telemetry.ExtractMessageContext(msg, resp.Data.TracingInformation.Traceparent, resp.Data.TracingInformation.Tracestate)
+	return received, nil
 }
 
-func (c *BankingGatewaySQSClient) Recv() (float64, error) {
-	log.Println(fmt.Sprintf("Listening queue: %v", *c.requestsQueueURL))
+func (c *BankingGatewaySQSClient) Recv(ctx context.Context) (float64, error) {
+	log.Println(fmt.Sprintf("Listening queue: %v", *c.responsesQueueURL))
 	tp := tracing.NewProvider()
-	var req *banking_gateway.BankingGatesWayResponse
+	var msg *receivedMsg
 	var err error
-	for req == nil {
-		req, _, err = c.recv()
+	for msg == nil {
+		msg, err = c.recv(ctx)
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != nil {
+			// Record error in a new span
+			atomic.StoreInt32(&c.lastRecvFail, 1)
+			_, span := tp.GetTracer().Start(context.Background(), "recvCalculateScore")
+			log.Printf(fmt.Sprintf("Couldn't recieve message : %v", err))
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+			span.End()
+			return 0, err
+		}
 	}
 
-	tracingInfo := req.Data["tracingInformation"].(map[string]interface{})
-	traceparent := tracingInfo["traceparent"].(string)
-	prop := propagation.TraceContext{}
-	ctxCall := prop.Extract(context.Background(), propagation.MapCarrier{
-		"traceparent": traceparent,
-	})
-
-	_, span := tp.GetTracer().Start(ctxCall, "recvCalculateScore")
+	ctxSpan, span := tp.GetTracer().Start(msg.producerCtx, "recvCalculateScore", oteltrace.WithAttributes(
+		attribute.Int("messaging.receive_count", msg.ReceiveCount),
+	))
 	defer span.End()
-	if err != nil && len(req.Data) > 0 {
-		// Record error in a new span
-		IsHealthy = false
-		log.Printf(fmt.Sprintf("Couldn't recieve message : %v", err))
-		span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+	atomic.StoreInt32(&c.lastRecvFail, 0)
+	if msg.err != nil {
+		// Retrying won't make the response valid, move it out of the way right away
+		log.Println(fmt.Sprintf("Couldn't recieve message : %v", msg.err))
+		span.RecordError(msg.err)
+		span.SetStatus(codes.Error, "invalid message")
+		c.deadLetters.Quarantine(ctxSpan, msg.ReceivedMessage, sqs_broker.QUARANTINE_MALFORMED, msg.err, c.deleter)
+		return 0, msg.err
+	}
+	// Every response is handed out once, it would otherwise come back once its visibility timeout expires
+	if err := c.deleter.Delete(msg.ReceiptHandle); err != nil {
+		span.RecordError(errors.New(fmt.Sprintf("Couldn't delete message %s : %v", *msg.ReceiptHandle, err)))
+		log.Println(fmt.Sprintf("Couldn't delete message %s : %v", *msg.ReceiptHandle, err))
+	}
+	opsProcessed.Inc()
+
+	req := msg.resp
+	if bankingErr := req.Data.Error; bankingErr != nil {
+		// The trace id points to the trace where the banking gateway failed
+		span.RecordError(bankingErr, oteltrace.WithAttributes(
+			attribute.String("error.code", bankingErr.Code),
+			attribute.Bool("error.retryable", bankingErr.Retryable),
+			attribute.String("error.traceId", bankingErr.TraceId),
+		))
+		span.SetStatus(codes.Error, bankingErr.Code)
+		return 0, fmt.Errorf("Banking gateway rejected the request: %w", bankingErr)
 	}
-	// Handle process in a goroutine
-	IsHealthy = true
 
-	scores := req.Data["scores"].(map[string]interface{})
 	var generalScore float64 = 0
-	for _, v := range scores {
-		monthlyScore := v.(map[string]interface{})
-		for _, score := range monthlyScore {
-			generalScore += score.(float64)
-		}
+	for _, periodScore := range req.Data.Scores {
+		generalScore += periodScore.Score
 	}
 	return generalScore, nil
 }
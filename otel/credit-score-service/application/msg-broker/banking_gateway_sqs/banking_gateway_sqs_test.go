@@ -0,0 +1,121 @@
+package banking_gateway_sqs
+
+import (
+	"common/banking_data"
+	"common/sqs_broker"
+	"common/sqs_broker/fake_sqs"
+	"context"
+	"credit-score-service/application/tracing"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+var (
+	requestsURL    = fake_sqs.URL("banking-requests")
+	responsesURL   = fake_sqs.URL("banking-responses")
+	deadLettersURL = fake_sqs.URL("banking-responses-dlq")
+)
+
+func newTestClient(t *testing.T) (*BankingGatewaySQSClient, *fake_sqs.SQS) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	t.Setenv("BANKING_REQUESTS_QUEUE_NAME", "banking-requests")
+	t.Setenv("BANKING_RESPONSES_QUEUE_NAME", "banking-responses")
+	t.Setenv("BANKING_RESPONSES_DLQ_NAME", "banking-responses-dlq")
+	t.Setenv("SQS_WAIT_TIME_SECONDS", "0")
+	tracing.NewProvider()
+	api := fake_sqs.New()
+	client, err := NewWith(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, api
+}
+
+func sendResponse(t *testing.T, api *fake_sqs.SQS, body string) {
+	if _, err := api.SendMessage(context.Background(), &sqs.SendMessageInput{
+		QueueUrl:    aws.String(responsesURL),
+		MessageBody: aws.String(body),
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func responseBody(data banking_data.BankingData) string {
+	data.Version = banking_data.SCHEMA_VERSION
+	data.UserId = "user"
+	data.BankingInstitutionId = "institution"
+	body, _ := json.Marshal(banking_data.BankingDataResponse{Data: data})
+	return string(body)
+}
+
+func TestSendPublishesTheRequest(t *testing.T) {
+	client, api := newTestClient(t)
+	err := client.Send(context.Background(), &banking_data.BankingDataRequest{
+		Version:              banking_data.SCHEMA_VERSION,
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := api.Messages(requestsURL); len(sent) != 1 {
+		t.Fatalf("expected one request, got %d", len(sent))
+	}
+}
+
+func TestRecvAddsTheScoresAndDeletesTheResponse(t *testing.T) {
+	client, api := newTestClient(t)
+	sendResponse(t, api, responseBody(banking_data.BankingData{
+		Scores: []banking_data.PeriodScore{{Year: 2022, Month: 1, Score: 1.5}, {Year: 2022, Month: 2, Score: 2}},
+	}))
+
+	score, err := client.Recv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != 3.5 {
+		t.Fatalf("expected the score 3.5, got %v", score)
+	}
+	if left := api.Messages(responsesURL); len(left) != 0 {
+		t.Fatalf("expected the response to be deleted, %d left", len(left))
+	}
+}
+
+func TestRecvReturnsTheBankingError(t *testing.T) {
+	client, api := newTestClient(t)
+	sendResponse(t, api, responseBody(banking_data.BankingData{
+		Error: &banking_data.BankingError{Code: "UNKNOWN_INSTITUTION", BankingInstitutionId: "institution"},
+	}))
+
+	_, err := client.Recv(context.Background())
+	var bankingErr *banking_data.BankingError
+	if !errors.As(err, &bankingErr) || bankingErr.Code != "UNKNOWN_INSTITUTION" {
+		t.Fatalf("expected the banking error, got %v", err)
+	}
+	if left := api.Messages(responsesURL); len(left) != 0 {
+		t.Fatalf("expected the response to be deleted, %d left", len(left))
+	}
+}
+
+func TestMalformedResponseIsQuarantined(t *testing.T) {
+	client, api := newTestClient(t)
+	sendResponse(t, api, `{"data":{"version":"0"}}`)
+
+	if _, err := client.Recv(context.Background()); err == nil {
+		t.Fatal("expected the malformed response to fail")
+	}
+	deadLetters := api.Messages(deadLettersURL)
+	if len(deadLetters) != 1 {
+		t.Fatalf("expected the response in the dead letter queue, got %d messages", len(deadLetters))
+	}
+	if reason := aws.ToString(deadLetters[0].MessageAttributes["FailureReason"].StringValue); reason != sqs_broker.QUARANTINE_MALFORMED {
+		t.Fatalf("expected the reason %s, got %s", sqs_broker.QUARANTINE_MALFORMED, reason)
+	}
+	if left := api.Messages(responsesURL); len(left) != 0 {
+		t.Fatalf("expected the quarantined response to be deleted, %d left", len(left))
+	}
+}
@@ -0,0 +1,69 @@
+// Package bolt_queue runs the messaging clients over the queues of a bbolt file, shared by the services of the machine
+package bolt_queue
+
+import (
+	"common/queue"
+	"common/queue/bolt_queue"
+	"credit-score-service/application/msg-broker/queue_client"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	DEFAULT_MAX_RECEIVE_COUNT = 5
+)
+
+// NewCreditScoreClient runs the client over the queues named by CREDIT_SCORE_REQUESTS_QUEUE_NAME,
+// CREDIT_SCORE_RESPONSES_QUEUE_NAME and CREDIT_SCORE_REQUESTS_DLQ_NAME in the file of BOLT_QUEUE_PATH.
+// BOLT_QUEUE_VISIBILITY_TIMEOUT is how long a received message stays invisible, BOLT_QUEUE_MAX_RECEIVE_COUNT
+// how many times it is received before moving to the dead letter queue.
+func NewCreditScoreClient() (*queue_client.CreditScoreClient, error) {
+	visibilityTimeout, err := queue_client.VisibilityTimeoutFromEnv("BOLT_QUEUE_VISIBILITY_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	maxReceiveCount := DEFAULT_MAX_RECEIVE_COUNT
+	if value := os.Getenv("BOLT_QUEUE_MAX_RECEIVE_COUNT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid BOLT_QUEUE_MAX_RECEIVE_COUNT %q, expected a positive number", value))
+		}
+		maxReceiveCount = parsed
+	}
+	store, err := bolt_queue.OpenFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	var deadLetters queue.Backend
+	if dlqName := os.Getenv("CREDIT_SCORE_REQUESTS_DLQ_NAME"); dlqName != "" {
+		deadLetters = store.Queue(dlqName)
+	}
+	return queue_client.NewCreditScoreClientWith(
+		store.Queue(queue_client.QueueName("CREDIT_SCORE_REQUESTS_QUEUE_NAME", queue_client.DEFAULT_CREDIT_SCORE_REQUESTS_QUEUE_NAME)),
+		store.Queue(queue_client.QueueName("CREDIT_SCORE_RESPONSES_QUEUE_NAME", queue_client.DEFAULT_CREDIT_SCORE_RESPONSES_QUEUE_NAME)),
+		deadLetters,
+		visibilityTimeout,
+		maxReceiveCount,
+	), nil
+}
+
+// NewBankingGatewayClient runs the client over the queues named by BANKING_REQUESTS_QUEUE_NAME and
+// BANKING_RESPONSES_QUEUE_NAME in the file of BOLT_QUEUE_PATH, the banking-gateway started with
+// MSG_BROKER=bolt and the same file answers them
+func NewBankingGatewayClient() (*queue_client.BankingGatewayClient, error) {
+	visibilityTimeout, err := queue_client.VisibilityTimeoutFromEnv("BOLT_QUEUE_VISIBILITY_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	store, err := bolt_queue.OpenFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return queue_client.NewBankingGatewayClientWith(
+		store.Queue(queue_client.QueueName("BANKING_REQUESTS_QUEUE_NAME", queue_client.DEFAULT_BANKING_REQUESTS_QUEUE_NAME)),
+		store.Queue(queue_client.QueueName("BANKING_RESPONSES_QUEUE_NAME", queue_client.DEFAULT_BANKING_RESPONSES_QUEUE_NAME)),
+		visibilityTimeout,
+	), nil
+}
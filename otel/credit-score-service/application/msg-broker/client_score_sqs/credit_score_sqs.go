@@ -1,6 +1,9 @@
 package client_score_sqs
 
 import (
+	"common/sqs_broker"
+	"common/telemetry"
+	"common/worker_pool"
 	"context"
 	"credit-score-service/application/tracing"
 	"credit-score-service/core/credit_score"
@@ -10,6 +13,8 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -19,12 +24,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 const (
-	VISIBILITY_TIMEOUT = int32(15)
+	// RECV_ERROR_BACKOFF keeps a failing queue from being polled in a tight loop
+	RECV_ERROR_BACKOFF = time.Second
 )
 
 var (
@@ -32,17 +39,62 @@ var (
 		Name: "total_credit_score_requests_processed",
 		Help: "The total number of processed events for credit scores",
 	})
+	opsQuarantined = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "total_credit_score_requests_quarantined",
+		Help: "The total number of credit score requests moved to the dead letter queue",
+	}, []string{"reason"})
 	IsInitialized = false
-	IsHealthy     = false
 )
 
 type CreditScoreSQSClient struct {
 	requestsQueueURL  *string
 	responsesQueueURL *string
-	api               *sqs.Client
+	api               sqs_broker.API
+	waitTimeSeconds   int32
+	maxMessages       int32
+	visibilityTimeout int32
+	maxProcessingTime time.Duration
+	maxReceiveCount   int32
+	deadLetters       *sqs_broker.DeadLetterQueue
+	// lastRecvFail is set by the receiving goroutine and read by the probes, 1 while receiving fails
+	lastRecvFail int32
 }
 
-func New() (credit_score.Client, error) {
+// receivedMsg is a message of a received batch, err is set when its body is not a valid request
+type receivedMsg struct {
+	req *credit_score.CreditScoreRequest
+	sqs_broker.ReceivedMessage
+	// producerCtx carries the span context and baggage of the producer of the message
+	producerCtx context.Context
+	err         error
+}
+
+// int32FromEnv reads a number between min and max from the environment
+func int32FromEnv(name string, defaultValue, min, max int32) (int32, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || int32(parsed) < min || int32(parsed) > max {
+		return 0, errors.New(fmt.Sprintf("Invalid %s %q, expected a number from %d to %d", name, value, min, max))
+	}
+	return int32(parsed), nil
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid %s %q, expected a positive duration", name, value))
+	}
+	return parsed, nil
+}
+
+func New() (*CreditScoreSQSClient, error) {
 	endpointUrl := os.Getenv("ENDPOINT_URL")
 	var cfg aws.Config
 	var err error
@@ -62,8 +114,11 @@ func New() (credit_score.Client, error) {
 		return nil, errors.New(fmt.Sprintf("Couldn't create credit score client: %v", err))
 	}
 
-	client := sqs.NewFromConfig(cfg)
+	return NewWith(sqs.NewFromConfig(cfg))
+}
 
+// NewWith resolves the queues with client, tests pass a fake API
+func NewWith(client sqs_broker.API) (*CreditScoreSQSClient, error) {
 	requestsQueueName := os.Getenv("CREDIT_SCORE_REQUESTS_QUEUE_NAME")
 	reqQueueUrlOutput, err := client.GetQueueUrl(context.Background(), &sqs.GetQueueUrlInput{
 		QueueName: &requestsQueueName,
@@ -80,17 +135,68 @@ func New() (credit_score.Client, error) {
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Couldn't get url for queue %s: %v", responsesQueueName, err))
 	}
+
+	// Long polling waits up to 20 seconds for messages instead of returning empty right away
+	waitTimeSeconds, err := int32FromEnv("SQS_WAIT_TIME_SECONDS", 20, 0, 20)
+	if err != nil {
+		return nil, err
+	}
+	maxMessages, err := int32FromEnv("SQS_MAX_MESSAGES", sqs_broker.MAX_BATCH_SIZE, 1, sqs_broker.MAX_BATCH_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	// The heartbeat extends the visibility timeout of a message until it is processed or SQS_MAX_PROCESSING_TIME passes
+	visibilityTimeout, err := int32FromEnv("SQS_VISIBILITY_TIMEOUT", sqs_broker.DEFAULT_VISIBILITY_TIMEOUT, 1, sqs_broker.MAX_SQS_VISIBILITY_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	maxProcessingTime, err := durationFromEnv("SQS_MAX_PROCESSING_TIME", sqs_broker.DEFAULT_MAX_PROCESSING_TIME)
+	if err != nil {
+		return nil, err
+	}
+	// Failed messages are retried until they have been received SQS_MAX_RECEIVE_COUNT times
+	maxReceiveCount, err := int32FromEnv("SQS_MAX_RECEIVE_COUNT", sqs_broker.DEFAULT_MAX_RECEIVE_COUNT, 1, 1000)
+	if err != nil {
+		return nil, err
+	}
+	// Without a dead letter queue failed messages stay in their queue
+	var dlqURL *string
+	if dlqName := os.Getenv("CREDIT_SCORE_REQUESTS_DLQ_NAME"); dlqName != "" {
+		dlqUrlOutput, err := client.GetQueueUrl(context.Background(), &sqs.GetQueueUrlInput{
+			QueueName: &dlqName,
+		})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Couldn't get url for queue %s: %v", dlqName, err))
+		}
+		dlqURL = dlqUrlOutput.QueueUrl
+	}
+	deadLetters := sqs_broker.NewDeadLetterQueue(client, reqQueueUrlOutput.QueueUrl, dlqURL, opsQuarantined)
 	IsInitialized = true
-	IsHealthy = true
 	return &CreditScoreSQSClient{
 		requestsQueueURL:  reqQueueUrlOutput.QueueUrl,
 		responsesQueueURL: respQueueUrlOutput.QueueUrl,
 		api:               client,
+		waitTimeSeconds:   waitTimeSeconds,
+		maxMessages:       maxMessages,
+		visibilityTimeout: visibilityTimeout,
+		maxProcessingTime: maxProcessingTime,
+		maxReceiveCount:   maxReceiveCount,
+		deadLetters:       deadLetters,
 	}, nil
 }
 
-func (c *CreditScoreSQSClient) Send(resp *credit_score.CreditScoreResponse) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+// IsReady is true once the queues are resolved
+func (c *CreditScoreSQSClient) IsReady() bool {
+	return IsInitialized
+}
+
+// IsHealthy is false while receiving from the requests queue fails
+func (c *CreditScoreSQSClient) IsHealthy() bool {
+	return atomic.LoadInt32(&c.lastRecvFail) == 0
+}
+
+func (c *CreditScoreSQSClient) Send(ctx context.Context, resp *credit_score.CreditScoreResponse) error {
+	ctxSend, cancel := context.WithTimeout(ctx, time.Second*15)
 	defer cancel()
 
 	data, err := json.Marshal(resp)
@@ -98,9 +204,11 @@ func (c *CreditScoreSQSClient) Send(resp *credit_score.CreditScoreResponse) erro
 		return errors.New(fmt.Sprintf("Cannot marshall message data: %v", err))
 	}
 	stringData := string(data)
-	_, err = c.api.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:    c.responsesQueueURL,
-		MessageBody: &stringData,
+	_, err = c.api.SendMessage(ctxSend, &sqs.SendMessageInput{
+		QueueUrl:                c.responsesQueueURL,
+		MessageBody:             &stringData,
+		MessageAttributes:       telemetry.InjectMessageAttributes(ctx, nil),
+		MessageSystemAttributes: telemetry.InjectMessageSystemAttributes(ctx),
 	})
 
 	if err != nil {
@@ -109,93 +217,209 @@ func (c *CreditScoreSQSClient) Send(resp *credit_score.CreditScoreResponse) erro
 	return nil
 }
 
-func (c *CreditScoreSQSClient) processMsg(handlerFunc func(msg *credit_score.CreditScoreRequest) error, req *credit_score.CreditScoreRequest, receiptHandle *string, tp *tracing.TracingProvider) error {
-	if req != nil {
-		// Instrument SQS recv
-		traceparent := req.TracingInformation["traceparent"].(string)
-		prop := propagation.TraceContext{}
-		ctxCall := prop.Extract(context.Background(), propagation.MapCarrier{
-			"traceparent": traceparent,
-		})
-		_, span := tp.GetTracer().Start(ctxCall, "calulateScore", oteltrace.WithAttributes(
-			attribute.String("userId", req.UserId),
-			attribute.String("bankingInstitutionId", req.BankingInstitutionId),
-		))
-
-		// Apply the function and then continue the process
-		if err := handlerFunc(req); err == nil {
-			ctxDelete, cancel := context.WithTimeout(ctxCall, time.Second*5)
-			defer cancel()
-			_, err = c.api.DeleteMessage(ctxDelete, &sqs.DeleteMessageInput{
-				QueueUrl:      c.requestsQueueURL,
-				ReceiptHandle: receiptHandle,
-			})
+func (c *CreditScoreSQSClient) processMsg(ctx context.Context, handlerFunc func(ctx context.Context, msg *credit_score.CreditScoreRequest) error, msg receivedMsg, deleter *sqs_broker.BatchDeleter, heartbeat *sqs_broker.VisibilityHeartbeat) error {
+	span := oteltrace.SpanFromContext(ctx)
+	defer span.End()
+	defer heartbeat.Stop()
 
-			// Idempotent operation dead letter queues not needed
-			if err != nil {
-				span.RecordError(errors.New(fmt.Sprintf("Couldn't delete message : %v", receiptHandle)))
-				fmt.Println(fmt.Sprintf("Couldn't delete message : %v", receiptHandle))
-			}
+	// The heartbeat stops extending the visibility at the deadline, stop working on the message by then
+	ctxHandler, cancel := context.WithDeadline(ctx, heartbeat.Deadline)
+	defer cancel()
 
-			opsProcessed.Inc()
-			span.End()
-		} else {
-			span.RecordError(errors.New(fmt.Sprintf("Couldn't process message : %v", receiptHandle)))
-			fmt.Println(fmt.Sprintf("Couldn't process message : %v", receiptHandle))
-			span.End()
+	// Apply the function and then continue the process
+	ctxHandler = credit_score.WithDelivery(ctxHandler, credit_score.Delivery{Attempt: msg.Attempts, MaxAttempts: int(c.maxReceiveCount)})
+	err := callHandler(ctxHandler, handlerFunc, msg.req)
+	heartbeat.Stop()
+	if err == nil {
+		if err := deleter.Delete(msg.ReceiptHandle); err != nil {
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't delete message %s : %v", *msg.ReceiptHandle, err)))
+			log.Println(fmt.Sprintf("Couldn't delete message %s : %v", *msg.ReceiptHandle, err))
+		}
+
+		opsProcessed.Inc()
+	} else {
+		span.RecordError(errors.New(fmt.Sprintf("Couldn't process message %s : %v", *msg.ReceiptHandle, err)))
+		log.Println(fmt.Sprintf("Couldn't process message %s : %v", *msg.ReceiptHandle, err))
+		if errors.Is(err, context.DeadlineExceeded) {
+			span.SetStatus(codes.Error, "processing timed out")
+		}
+		// The deadline of the handler may have passed, quarantine with the context of the span
+		if msg.Attempts >= int(c.maxReceiveCount) {
+			c.deadLetters.Quarantine(ctx, msg.ReceivedMessage, sqs_broker.QUARANTINE_MAX_RECEIVES, err, deleter)
 		}
 	}
 	return nil
 }
 
-func (c *CreditScoreSQSClient) Recv(handlerFunc func(msg *credit_score.CreditScoreRequest) error) error {
-	ctx := context.Background()
+// callHandler turns a panic of the handler into an error, so a poison message counts as a failed attempt
+func callHandler(ctx context.Context, handlerFunc func(ctx context.Context, msg *credit_score.CreditScoreRequest) error, req *credit_score.CreditScoreRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("handler panicked: %v", r))
+		}
+	}()
+	return handlerFunc(ctx, req)
+}
+
+func (c *CreditScoreSQSClient) Recv(ctx context.Context, handlerFunc func(ctx context.Context, msg *credit_score.CreditScoreRequest) error) error {
+	pool, err := worker_pool.NewFromEnv("credit_score_requests")
+	if err != nil {
+		return err
+	}
+	deleter := sqs_broker.NewBatchDeleter(c.api, c.requestsQueueURL)
+	tp := tracing.NewProvider()
 	log.Println(fmt.Sprintf("Listening queue: %v", *c.requestsQueueURL))
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Stopping polling because a context kill signal was sent")
-			return nil
-		default:
-			tp := tracing.NewProvider()
-			req, receiptHandle, err := c.recv()
+	for ctx.Err() == nil {
+		// Polling pauses while all the workers are busy and the queue is full
+		free, err := pool.WaitForCapacity(ctx)
+		if err != nil {
+			break
+		}
+		maxMessages := c.maxMessages
+		if int32(free) < maxMessages {
+			maxMessages = int32(free)
+		}
+		receivedAt := time.Now()
+		msgs, err := c.recv(ctx, maxMessages)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			// Record error in a new span
+			atomic.StoreInt32(&c.lastRecvFail, 1)
+			_, span := tp.GetTracer().Start(context.Background(), "receiveCalculateScore")
+			log.Printf(fmt.Sprintf("Couldn't recieve message : %v", err))
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+			span.End()
+			sleepCtx(ctx, RECV_ERROR_BACKOFF)
+			continue
+		}
+		atomic.StoreInt32(&c.lastRecvFail, 0)
+		if len(msgs) == 0 {
+			continue
+		}
+
+		// A batch mixes messages of several traces, the receive span links to every producer span
+		// and the process span of each message, child of its producer, links back to the receive span
+		producerLinks := make([]oteltrace.Link, 0, len(msgs))
+		for _, msg := range msgs {
+			if producer := oteltrace.SpanContextFromContext(msg.producerCtx); producer.IsValid() {
+				producerLinks = append(producerLinks, oteltrace.Link{SpanContext: producer})
+			}
+		}
+		_, recvSpan := tp.GetTracer().Start(context.Background(), "receiveCalculateScore",
+			oteltrace.WithTimestamp(receivedAt),
+			oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+			oteltrace.WithLinks(producerLinks...),
+			oteltrace.WithAttributes(
+				semconv.MessagingSystemKey.String("AmazonSQS"),
+				semconv.MessagingDestinationKey.String(*c.requestsQueueURL),
+				semconv.MessagingDestinationKindQueue,
+				semconv.MessagingOperationReceive,
+				attribute.Int("messaging.batch.message_count", len(msgs)),
+			),
+		)
+		recvLink := oteltrace.Link{SpanContext: recvSpan.SpanContext()}
+
+		for _, msg := range msgs {
+			msg := msg
+			attrs := []attribute.KeyValue{
+				semconv.MessagingSystemKey.String("AmazonSQS"),
+				semconv.MessagingDestinationKey.String(*c.requestsQueueURL),
+				semconv.MessagingOperationProcess,
+				semconv.MessagingMessageIDKey.String(msg.MessageId),
+			}
+			if msg.req != nil {
+				attrs = append(attrs,
+					attribute.String("userId", msg.req.UserId),
+					attribute.String("bankingInstitutionId", msg.req.BankingInstitutionId),
+				)
+			}
+			ctxSpan, span := tp.GetTracer().Start(msg.producerCtx, "calulateScore",
+				oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+				oteltrace.WithLinks(recvLink),
+				oteltrace.WithAttributes(attrs...),
+			)
+			if msg.err != nil {
+				// Retrying won't make the message valid, move it out of the way right away
+				log.Printf(fmt.Sprintf("Couldn't recieve message : %v", msg.err))
+				span.RecordError(msg.err)
+				span.SetStatus(codes.Error, "invalid message")
+				c.deadLetters.Quarantine(ctxSpan, msg.ReceivedMessage, sqs_broker.QUARANTINE_MALFORMED, msg.err, deleter)
+				span.End()
+				continue
+			}
+
+			// The message is kept invisible from the moment it's received, time queued in the pool counts too
+			heartbeat := sqs_broker.StartHeartbeat(ctxSpan, c.api, c.requestsQueueURL, msg.ReceiptHandle, c.visibilityTimeout, receivedAt, c.maxProcessingTime)
+
+			// Handle process in the pool, the span ends once the message is processed
+			err = pool.Submit(func() {
+				c.processMsg(ctxSpan, handlerFunc, msg, deleter, heartbeat)
+			})
 			if err != nil {
-				// Record error in a new span
-				IsHealthy = false
-				_, span := tp.GetTracer().Start(context.Background(), "calculateScore")
-				log.Printf(fmt.Sprintf("Couldn't recieve message : %v", err))
-				span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+				heartbeat.Stop()
+				// The message becomes visible again once the visibility timeout expires
+				log.Println(fmt.Sprintf("Couldn't schedule message %s : %v", *msg.ReceiptHandle, err))
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				span.End()
 			}
-			// Handle process in a goroutine
-			IsHealthy = true
-			go c.processMsg(handlerFunc, req, receiptHandle, tp)
 		}
+		recvSpan.End()
+	}
+
+	log.Println("Stopping polling because a context kill signal was sent, waiting for in-flight messages")
+	pool.Close()
+	deleter.Close()
+	return nil
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
 	}
 }
 
-func (c *CreditScoreSQSClient) recv() (*credit_score.CreditScoreRequest, *string, error) {
+func (c *CreditScoreSQSClient) recv(ctx context.Context, maxMessages int32) ([]receivedMsg, error) {
 	recvMsgInput := &sqs.ReceiveMessageInput{
 		MessageAttributeNames: []string{
 			string(types.QueueAttributeNameAll),
 		},
-		WaitTimeSeconds:   1,
-		QueueUrl:          c.requestsQueueURL,
-		VisibilityTimeout: VISIBILITY_TIMEOUT,
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeName(types.MessageSystemAttributeNameApproximateReceiveCount),
+			// Set by producers instrumented with X-Ray
+			types.QueueAttributeName(types.MessageSystemAttributeNameAWSTraceHeader),
+		},
+		MaxNumberOfMessages: maxMessages,
+		WaitTimeSeconds:     c.waitTimeSeconds,
+		QueueUrl:            c.requestsQueueURL,
+		VisibilityTimeout:   c.visibilityTimeout,
 	}
 
-	msgOutput, err := c.api.ReceiveMessage(context.TODO(), recvMsgInput)
+	msgOutput, err := c.api.ReceiveMessage(ctx, recvMsgInput)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if len(msgOutput.Messages) > 0 {
-		msg := msgOutput.Messages[0]
+	msgs := make([]receivedMsg, 0, len(msgOutput.Messages))
+	for _, msg := range msgOutput.Messages {
+		received := receivedMsg{
+			ReceivedMessage: sqs_broker.NewReceivedMessage(msg),
+		}
 		var req credit_score.CreditScoreRequest
-		if err := json.Unmarshal([]byte(*msg.Body), &req); err != nil || reflect.DeepEqual(req, credit_score.CreditScoreRequest{}) {
-			return nil, nil, errors.New(fmt.Sprintf("Unknown message format, cannot parse json: %v", *msg.Body))
+		if err := json.Unmarshal([]byte(received.Body), &req); err != nil || reflect.DeepEqual(req, credit_score.CreditScoreRequest{}) {
+			// The body may hold credentials, it is kept out of the error and the dead letter attributes
+			received.err = errors.New(fmt.Sprintf("Unknown message format, cannot parse the json body of %d bytes", len(received.Body)))
+		} else {
+			received.req = &req
 		}
-		return &req, msg.ReceiptHandle, nil
-	} else {
-		return nil, nil, nil
+		received.producerCtx = telemetry.ExtractMessageContext(msg, req.TracingInformation.Traceparent, req.TracingInformation.Tracestate)
+		msgs = append(msgs, received)
 	}
+	return msgs, nil
 }
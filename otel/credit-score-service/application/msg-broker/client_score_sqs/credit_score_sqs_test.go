@@ -0,0 +1,195 @@
+package client_score_sqs
+
+import (
+	"common/sqs_broker"
+	"common/sqs_broker/fake_sqs"
+	"common/telemetry"
+	"context"
+	"credit-score-service/application/tracing"
+	"credit-score-service/core/credit_score"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+var (
+	requestsURL    = fake_sqs.URL("credit-score-requests")
+	deadLettersURL = fake_sqs.URL("credit-score-requests-dlq")
+)
+
+// newTestClient resolves the queues of a fake SQS API, failed messages come back after a second
+func newTestClient(t *testing.T, maxReceiveCount string) (*CreditScoreSQSClient, *fake_sqs.SQS) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	t.Setenv("CREDIT_SCORE_REQUESTS_QUEUE_NAME", "credit-score-requests")
+	t.Setenv("CREDIT_SCORE_RESPONSES_QUEUE_NAME", "credit-score-responses")
+	t.Setenv("CREDIT_SCORE_REQUESTS_DLQ_NAME", "credit-score-requests-dlq")
+	t.Setenv("SQS_WAIT_TIME_SECONDS", "0")
+	t.Setenv("SQS_VISIBILITY_TIMEOUT", "1")
+	t.Setenv("SQS_MAX_RECEIVE_COUNT", maxReceiveCount)
+	tracing.NewProvider()
+	api := fake_sqs.New()
+	client, err := NewWith(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, api
+}
+
+func sendRequest(t *testing.T, api *fake_sqs.SQS, ctx context.Context, body string) {
+	_, err := api.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:                aws.String(requestsURL),
+		MessageBody:             aws.String(body),
+		MessageAttributes:       telemetry.InjectMessageAttributes(ctx, nil),
+		MessageSystemAttributes: telemetry.InjectMessageSystemAttributes(ctx),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func requestBody() string {
+	body, _ := json.Marshal(credit_score.CreditScoreRequest{
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	return string(body)
+}
+
+// delivery is a call of the handler
+type delivery struct {
+	lastAttempt bool
+	spanContext oteltrace.SpanContext
+}
+
+// recvUntil runs Recv with handler until done returns true
+func recvUntil(t *testing.T, client *CreditScoreSQSClient, handler func(ctx context.Context) error, done func() bool) []delivery {
+	var mu sync.Mutex
+	var deliveries []delivery
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Recv(ctx, func(ctx context.Context, req *credit_score.CreditScoreRequest) error {
+			mu.Lock()
+			deliveries = append(deliveries, delivery{
+				lastAttempt: credit_score.LastAttempt(ctx),
+				spanContext: oteltrace.SpanContextFromContext(ctx),
+			})
+			mu.Unlock()
+			return handler(ctx)
+		})
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the messages to be processed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]delivery(nil), deliveries...)
+}
+
+func queueLen(api *fake_sqs.SQS, url string, n int) func() bool {
+	return func() bool { return len(api.Messages(url)) == n }
+}
+
+func TestProcessedMessageIsDeleted(t *testing.T) {
+	client, api := newTestClient(t, "2")
+	sendRequest(t, api, context.Background(), requestBody())
+
+	deliveries := recvUntil(t, client, func(ctx context.Context) error { return nil }, queueLen(api, requestsURL, 0))
+	if len(deliveries) != 1 || deliveries[0].lastAttempt {
+		t.Fatalf("expected a single delivery before the last attempt, got %v", deliveries)
+	}
+	if !client.IsHealthy() {
+		t.Fatal("expected the client to be healthy")
+	}
+}
+
+func TestFailingMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	client, api := newTestClient(t, "2")
+	sendRequest(t, api, context.Background(), requestBody())
+
+	deliveries := recvUntil(t, client, func(ctx context.Context) error {
+		return errors.New("banking gateway unavailable")
+	}, queueLen(api, deadLettersURL, 1))
+
+	if len(deliveries) != 2 || deliveries[0].lastAttempt || !deliveries[1].lastAttempt {
+		t.Fatalf("expected the second delivery to be the last attempt, got %v", deliveries)
+	}
+	deadLetter := api.Messages(deadLettersURL)[0]
+	if reason := aws.ToString(deadLetter.MessageAttributes["FailureReason"].StringValue); reason != sqs_broker.QUARANTINE_MAX_RECEIVES {
+		t.Fatalf("expected the reason %s, got %s", sqs_broker.QUARANTINE_MAX_RECEIVES, reason)
+	}
+	if left := api.Messages(requestsURL); len(left) != 0 {
+		t.Fatal("expected the quarantined message to leave the requests queue")
+	}
+}
+
+func TestMalformedMessageIsQuarantinedRightAway(t *testing.T) {
+	client, api := newTestClient(t, "2")
+	sendRequest(t, api, context.Background(), "{}")
+
+	deliveries := recvUntil(t, client, func(ctx context.Context) error { return nil }, queueLen(api, deadLettersURL, 1))
+
+	if len(deliveries) != 0 {
+		t.Fatalf("expected the handler not to run, it ran %d times", len(deliveries))
+	}
+	deadLetter := api.Messages(deadLettersURL)[0]
+	if reason := aws.ToString(deadLetter.MessageAttributes["FailureReason"].StringValue); reason != sqs_broker.QUARANTINE_MALFORMED {
+		t.Fatalf("expected the reason %s, got %s", sqs_broker.QUARANTINE_MALFORMED, reason)
+	}
+}
+
+func TestTimedOutMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	t.Setenv("SQS_MAX_PROCESSING_TIME", "100ms")
+	client, api := newTestClient(t, "1")
+	sendRequest(t, api, context.Background(), requestBody())
+
+	// The handler runs until its deadline, the context it got has expired by the time the message is quarantined
+	recvUntil(t, client, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, queueLen(api, deadLettersURL, 1))
+
+	if left := api.Messages(requestsURL); len(left) != 0 {
+		t.Fatal("expected the timed out message to leave the requests queue")
+	}
+}
+
+func TestTraceContextTravelsInTheMessageAttributes(t *testing.T) {
+	client, api := newTestClient(t, "2")
+	traceID, _ := oteltrace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := oteltrace.SpanIDFromHex("00f067aa0ba902b7")
+	producer := oteltrace.ContextWithSpanContext(context.Background(), oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: oteltrace.FlagsSampled,
+	}))
+	sendRequest(t, api, producer, requestBody())
+
+	deliveries := recvUntil(t, client, func(ctx context.Context) error { return nil }, queueLen(api, requestsURL, 0))
+	if got := deliveries[0].spanContext.TraceID(); got != traceID {
+		t.Fatalf("expected the handler to continue trace %s, got %s", traceID, got)
+	}
+}
+
+func TestFailingReceiveMakesTheClientUnhealthy(t *testing.T) {
+	client, api := newTestClient(t, "2")
+	api.FailReceive = errors.New("AWS.SimpleQueueService.NonExistentQueue")
+
+	recvUntil(t, client, func(ctx context.Context) error { return nil }, func() bool { return !client.IsHealthy() })
+}
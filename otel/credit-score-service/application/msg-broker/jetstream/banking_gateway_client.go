@@ -0,0 +1,152 @@
+package jetstream
+
+import (
+	"common/jetstream_broker"
+	"context"
+	"credit-score-service/application/tracing"
+	banking_gateway "credit-score-service/core/baking_gateway"
+	"credit-score-service/core/constants"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// BankingGatewayClient implements banking_gateway.Client over the subjects named by
+// BANKING_REQUESTS_QUEUE_NAME and BANKING_RESPONSES_QUEUE_NAME
+type BankingGatewayClient struct {
+	conn         *nats.Conn
+	js           nats.JetStreamContext
+	requests     string
+	responses    string
+	subscription *nats.Subscription
+	settings     jetstream_broker.Settings
+	// lastFetchFail is set by the fetching goroutine and read by the probes, 1 while fetching fails
+	lastFetchFail int32
+}
+
+func NewBankingGatewayClient() (*BankingGatewayClient, error) {
+	settings, err := jetstream_broker.SettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	conn, js, err := jetstream_broker.Connect()
+	if err != nil {
+		return nil, err
+	}
+	client := &BankingGatewayClient{
+		conn:      conn,
+		js:        js,
+		requests:  os.Getenv("BANKING_REQUESTS_QUEUE_NAME"),
+		responses: os.Getenv("BANKING_RESPONSES_QUEUE_NAME"),
+		settings:  settings,
+	}
+	if err := jetstream_broker.EnsureStream(js, client.requests); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.subscription, err = jetstream_broker.Subscribe(js, client.responses, constants.APP_NAME, settings.AckWait)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// IsReady is true while the connection is open, it may be reconnecting
+func (c *BankingGatewayClient) IsReady() bool {
+	return !c.conn.IsClosed()
+}
+
+// IsHealthy is false while disconnected or fetching from the responses stream fails
+func (c *BankingGatewayClient) IsHealthy() bool {
+	return c.conn.IsConnected() && atomic.LoadInt32(&c.lastFetchFail) == 0
+}
+
+// Send propagates the trace context and baggage of ctx in the headers, falling back to the tracing
+// information of the request when ctx has no span
+func (c *BankingGatewayClient) Send(ctx context.Context, req *banking_gateway.BankingGatewayRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot marshall message data: %v", err))
+	}
+	if !oteltrace.SpanContextFromContext(ctx).IsValid() {
+		ctx = propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{
+			"traceparent": req.TracingInformation.Traceparent,
+			"tracestate":  req.TracingInformation.Tracestate,
+		})
+	}
+	return jetstream_broker.Publish(ctx, c.js, c.requests, data, nil)
+}
+
+// Recv waits for the next response until ctx is done
+func (c *BankingGatewayClient) Recv(ctx context.Context) (float64, error) {
+	tp := tracing.NewProvider()
+	var msg *nats.Msg
+	for msg == nil {
+		ctxFetch, cancel := context.WithTimeout(ctx, c.settings.FetchWait)
+		msgs, err := c.subscription.Fetch(1, nats.Context(ctxFetch))
+		cancel()
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err != nil && !jetstream_broker.IsFetchTimeout(err) {
+			// Record error in a new span
+			atomic.StoreInt32(&c.lastFetchFail, 1)
+			_, span := tp.GetTracer().Start(context.Background(), "recvCalculateScore")
+			log.Println(fmt.Sprintf("Couldn't recieve message : %v", err))
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+			span.End()
+			return 0, err
+		}
+		atomic.StoreInt32(&c.lastFetchFail, 0)
+		if len(msgs) > 0 {
+			msg = msgs[0]
+		}
+	}
+	// Every response is handed out once, a malformed one wouldn't get better on redelivery
+	if err := msg.AckSync(); err != nil {
+		log.Println(fmt.Sprintf("Couldn't ack message %s : %v", jetstream_broker.MessageId(msg), err))
+	}
+
+	var resp banking_gateway.BankingGatesWayResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return 0, errors.New(fmt.Sprintf("Unknown message format, cannot parse the json body: %v", err))
+	}
+	ctxProducer := jetstream_broker.ProducerContext(msg, resp.Data.TracingInformation.Traceparent, resp.Data.TracingInformation.Tracestate)
+	_, span := tp.GetTracer().Start(ctxProducer, "recvCalculateScore", oteltrace.WithAttributes(
+		attribute.Int("messaging.receive_count", jetstream_broker.ReceiveCount(msg)),
+	))
+	defer span.End()
+
+	if err := resp.Validate(); err != nil {
+		newErr := errors.New(fmt.Sprintf("Invalid banking data response %s: %v", jetstream_broker.MessageId(msg), err))
+		span.RecordError(newErr)
+		return 0, newErr
+	}
+
+	if bankingErr := resp.Data.Error; bankingErr != nil {
+		// The trace id points to the trace where the banking gateway failed
+		span.RecordError(bankingErr, oteltrace.WithAttributes(
+			attribute.String("error.code", bankingErr.Code),
+			attribute.Bool("error.retryable", bankingErr.Retryable),
+			attribute.String("error.traceId", bankingErr.TraceId),
+		))
+		span.SetStatus(codes.Error, bankingErr.Code)
+		return 0, fmt.Errorf("Banking gateway rejected the request: %w", bankingErr)
+	}
+
+	var generalScore float64 = 0
+	for _, periodScore := range resp.Data.Scores {
+		generalScore += periodScore.Score
+	}
+	return generalScore, nil
+}
@@ -0,0 +1,249 @@
+package jetstream
+
+import (
+	"common/banking_data"
+	"common/jetstream_broker"
+	"context"
+	"credit-score-service/application/tracing"
+	"credit-score-service/core/credit_score"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	TEST_ACK_WAIT          = 300 * time.Millisecond
+	TEST_MAX_RECEIVE_COUNT = 3
+)
+
+// runTestServer runs a JetStream server of its own and points the clients to it
+func runTestServer(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsserver.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	t.Setenv("NATS_URL", srv.ClientURL())
+	t.Setenv("CREDIT_SCORE_REQUESTS_QUEUE_NAME", "credit-score-requests")
+	t.Setenv("CREDIT_SCORE_RESPONSES_QUEUE_NAME", "credit-score-responses")
+	t.Setenv("CREDIT_SCORE_REQUESTS_DLQ_NAME", "credit-score-requests-dlq")
+	t.Setenv("BANKING_REQUESTS_QUEUE_NAME", "banking-requests")
+	t.Setenv("BANKING_RESPONSES_QUEUE_NAME", "banking-responses")
+	t.Setenv("JETSTREAM_ACK_WAIT", TEST_ACK_WAIT.String())
+	t.Setenv("JETSTREAM_FETCH_WAIT", "50ms")
+	t.Setenv("JETSTREAM_MAX_RECEIVE_COUNT", strconv.Itoa(TEST_MAX_RECEIVE_COUNT))
+	tracing.NewProvider()
+}
+
+func newTestClient(t *testing.T) *CreditScoreClient {
+	runTestServer(t)
+	client, err := NewCreditScoreClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.conn.Close)
+	return client
+}
+
+func publishRequest(t *testing.T, client *CreditScoreClient, body []byte) {
+	if err := jetstream_broker.Publish(context.Background(), client.js, client.requests, body, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func requestBody() []byte {
+	body, _ := json.Marshal(credit_score.CreditScoreRequest{
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	return body
+}
+
+// recvUntil runs Recv with handler until it was called n times, it returns whether each call was the last attempt
+func recvUntil(t *testing.T, client *CreditScoreClient, handler func(ctx context.Context) error, n int) []bool {
+	var mu sync.Mutex
+	var lastAttempts []bool
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Recv(ctx, func(ctx context.Context, req *credit_score.CreditScoreRequest) error {
+			mu.Lock()
+			lastAttempts = append(lastAttempts, credit_score.LastAttempt(ctx))
+			mu.Unlock()
+			return handler(ctx)
+		})
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		calls := len(lastAttempts)
+		mu.Unlock()
+		if calls >= n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %d deliveries", calls)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]bool(nil), lastAttempts...)
+}
+
+// waitForEmptyStream waits until the acks reach the server, acked and terminated messages leave a work queue
+func waitForEmptyStream(t *testing.T, js nats.JetStreamContext, queueName string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := js.StreamInfo(jetstream_broker.StreamName(queueName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.State.Msgs == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the messages of %s to be acknowledged", queueName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fetchOne reads the next message of the queue
+func fetchOne(t *testing.T, js nats.JetStreamContext, queueName string) *nats.Msg {
+	sub, err := js.PullSubscribe(queueName, "test", nats.BindStream(jetstream_broker.StreamName(queueName)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+	if err != nil {
+		t.Fatalf("expected a message in %s: %v", queueName, err)
+	}
+	return msgs[0]
+}
+
+func TestAckedMessageIsNotRedelivered(t *testing.T) {
+	client := newTestClient(t)
+	publishRequest(t, client, requestBody())
+
+	recvUntil(t, client, func(ctx context.Context) error { return nil }, 1)
+	waitForEmptyStream(t, client.js, client.requests)
+}
+
+func TestFailingMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	client := newTestClient(t)
+	publishRequest(t, client, requestBody())
+
+	lastAttempts := recvUntil(t, client, func(ctx context.Context) error {
+		return errors.New("banking gateway unavailable")
+	}, TEST_MAX_RECEIVE_COUNT)
+	waitForEmptyStream(t, client.js, client.requests)
+
+	if lastAttempts[0] || !lastAttempts[TEST_MAX_RECEIVE_COUNT-1] {
+		t.Fatalf("expected only the last delivery to be the last attempt, got %v", lastAttempts)
+	}
+	header := fetchOne(t, client.js, client.deadLetters).Header
+	if header.Get("FailureReason") != QUARANTINE_MAX_RECEIVES || header.Get("ReceiveCount") != strconv.Itoa(TEST_MAX_RECEIVE_COUNT) {
+		t.Fatalf("unexpected dead letter headers %v", header)
+	}
+}
+
+func TestMalformedMessageIsQuarantinedRightAway(t *testing.T) {
+	client := newTestClient(t)
+	publishRequest(t, client, []byte("{}"))
+
+	var handled int32
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Recv(ctx, func(ctx context.Context, req *credit_score.CreditScoreRequest) error {
+			atomic.AddInt32(&handled, 1)
+			return nil
+		})
+	}()
+	waitForEmptyStream(t, client.js, client.requests)
+	cancel()
+	<-stopped
+
+	if atomic.LoadInt32(&handled) != 0 {
+		t.Fatal("expected the handler not to run")
+	}
+	header := fetchOne(t, client.js, client.deadLetters).Header
+	if header.Get("FailureReason") != QUARANTINE_MALFORMED {
+		t.Fatalf("unexpected dead letter headers %v", header)
+	}
+}
+
+func TestTimedOutMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	t.Setenv("JETSTREAM_MAX_PROCESSING_TIME", "100ms")
+	client := newTestClient(t)
+	publishRequest(t, client, requestBody())
+
+	// The handler runs until its deadline, the context it got has expired by the time the message is quarantined
+	recvUntil(t, client, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, TEST_MAX_RECEIVE_COUNT)
+	waitForEmptyStream(t, client.js, client.requests)
+
+	if header := fetchOne(t, client.js, client.deadLetters).Header; header.Get("FailureReason") != QUARANTINE_MAX_RECEIVES {
+		t.Fatalf("unexpected dead letter headers %v", header)
+	}
+}
+
+func TestBankingGatewayClientReadsTheResponse(t *testing.T) {
+	runTestServer(t)
+	client, err := NewBankingGatewayClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.conn.Close)
+
+	err = client.Send(context.Background(), &banking_data.BankingDataRequest{
+		Version:              banking_data.SCHEMA_VERSION,
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchOne(t, client.js, client.requests)
+
+	body, _ := json.Marshal(banking_data.BankingDataResponse{Data: banking_data.BankingData{
+		Version:              banking_data.SCHEMA_VERSION,
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+		Scores:               []banking_data.PeriodScore{{Year: 2022, Month: 1, Score: 1.5}, {Year: 2022, Month: 2, Score: 2}},
+	}})
+	if err := jetstream_broker.Publish(context.Background(), client.js, client.responses, body, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	score, err := client.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != 3.5 {
+		t.Fatalf("expected the score 3.5, got %v", score)
+	}
+	waitForEmptyStream(t, client.js, client.responses)
+}
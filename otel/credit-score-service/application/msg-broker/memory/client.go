@@ -0,0 +1,59 @@
+// Package memory runs the messaging clients over queues living in the process, they only last as long as the
+// process so producers and consumers must share it.
+package memory
+
+import (
+	"common/queue"
+	"common/queue/memory_queue"
+	"credit-score-service/application/msg-broker/queue_client"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	DEFAULT_MAX_RECEIVE_COUNT = 5
+)
+
+// NewCreditScoreClient runs over the in-process queues named by CREDIT_SCORE_REQUESTS_QUEUE_NAME,
+// CREDIT_SCORE_RESPONSES_QUEUE_NAME and CREDIT_SCORE_REQUESTS_DLQ_NAME. MEMORY_MAX_RECEIVE_COUNT is how many
+// times a message is received before moving to the dead letter queue.
+func NewCreditScoreClient() (*queue_client.CreditScoreClient, error) {
+	visibilityTimeout, err := queue_client.VisibilityTimeoutFromEnv("MEMORY_VISIBILITY_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	maxReceiveCount := DEFAULT_MAX_RECEIVE_COUNT
+	if value := os.Getenv("MEMORY_MAX_RECEIVE_COUNT"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid MEMORY_MAX_RECEIVE_COUNT %q, expected a positive number", value))
+		}
+		maxReceiveCount = parsed
+	}
+	var deadLetters queue.Backend
+	if dlqName := os.Getenv("CREDIT_SCORE_REQUESTS_DLQ_NAME"); dlqName != "" {
+		deadLetters = memory_queue.GetQueue(dlqName)
+	}
+	return queue_client.NewCreditScoreClientWith(
+		memory_queue.GetQueue(queue_client.QueueName("CREDIT_SCORE_REQUESTS_QUEUE_NAME", queue_client.DEFAULT_CREDIT_SCORE_REQUESTS_QUEUE_NAME)),
+		memory_queue.GetQueue(queue_client.QueueName("CREDIT_SCORE_RESPONSES_QUEUE_NAME", queue_client.DEFAULT_CREDIT_SCORE_RESPONSES_QUEUE_NAME)),
+		deadLetters,
+		visibilityTimeout,
+		maxReceiveCount,
+	), nil
+}
+
+// NewBankingGatewayClient runs over the in-process queues named by BANKING_REQUESTS_QUEUE_NAME and BANKING_RESPONSES_QUEUE_NAME
+func NewBankingGatewayClient() (*queue_client.BankingGatewayClient, error) {
+	visibilityTimeout, err := queue_client.VisibilityTimeoutFromEnv("MEMORY_VISIBILITY_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	return queue_client.NewBankingGatewayClientWith(
+		memory_queue.GetQueue(queue_client.QueueName("BANKING_REQUESTS_QUEUE_NAME", queue_client.DEFAULT_BANKING_REQUESTS_QUEUE_NAME)),
+		memory_queue.GetQueue(queue_client.QueueName("BANKING_RESPONSES_QUEUE_NAME", queue_client.DEFAULT_BANKING_RESPONSES_QUEUE_NAME)),
+		visibilityTimeout,
+	), nil
+}
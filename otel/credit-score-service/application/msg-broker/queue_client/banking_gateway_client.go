@@ -0,0 +1,140 @@
+package queue_client
+
+import (
+	"common/queue"
+	"context"
+	"credit-score-service/application/tracing"
+	banking_gateway "credit-score-service/core/baking_gateway"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_BANKING_REQUESTS_QUEUE_NAME  = "banking-requests"
+	DEFAULT_BANKING_RESPONSES_QUEUE_NAME = "banking-responses"
+)
+
+// BankingGatewayClient implements banking_gateway.Client over backend queues
+type BankingGatewayClient struct {
+	requests          queue.Backend
+	responses         queue.Backend
+	visibilityTimeout time.Duration
+	// lastRecvFail is set by the receiving goroutine and read by the probes, 1 while receiving fails
+	lastRecvFail int32
+}
+
+// NewBankingGatewayClientWith sends to requests and consumes responses
+func NewBankingGatewayClientWith(requests, responses queue.Backend, visibilityTimeout time.Duration) *BankingGatewayClient {
+	return &BankingGatewayClient{
+		requests:          requests,
+		responses:         responses,
+		visibilityTimeout: visibilityTimeout,
+	}
+}
+
+// IsReady is always true, a backend that can't be reached fails to receive instead
+func (c *BankingGatewayClient) IsReady() bool {
+	return true
+}
+
+// IsHealthy is false while receiving from the responses queue fails
+func (c *BankingGatewayClient) IsHealthy() bool {
+	return atomic.LoadInt32(&c.lastRecvFail) == 0
+}
+
+// Requests is the queue Send produces to
+func (c *BankingGatewayClient) Requests() queue.Backend {
+	return c.requests
+}
+
+// Responses is the queue Recv consumes, to answer requests from the same process
+func (c *BankingGatewayClient) Responses() queue.Backend {
+	return c.responses
+}
+
+// Send propagates the trace context and baggage of ctx in the headers, falling back to the tracing
+// information of the request when ctx has no span
+func (c *BankingGatewayClient) Send(ctx context.Context, req *banking_gateway.BankingGatewayRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot marshall message data: %v", err))
+	}
+	if !oteltrace.SpanContextFromContext(ctx).IsValid() {
+		ctx = propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{
+			"traceparent": req.TracingInformation.Traceparent,
+			"tracestate":  req.TracingInformation.Tracestate,
+		})
+	}
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+	if _, err := c.requests.Send(data, headers); err != nil {
+		return errors.New(fmt.Sprintf("Cannot send message to %s: %v", c.requests.Name(), err))
+	}
+	return nil
+}
+
+func (c *BankingGatewayClient) Recv(ctx context.Context) (float64, error) {
+	tp := tracing.NewProvider()
+	msgs, err := c.responses.Receive(ctx, 1, c.visibilityTimeout)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		// Record error in a new span
+		atomic.StoreInt32(&c.lastRecvFail, 1)
+		_, span := tp.GetTracer().Start(context.Background(), "recvCalculateScore")
+		log.Println(fmt.Sprintf("Couldn't recieve message : %v", err))
+		span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+		span.End()
+		return 0, err
+	}
+	atomic.StoreInt32(&c.lastRecvFail, 0)
+	msg := msgs[0]
+	// Every response is handed out once, a malformed one wouldn't get better on redelivery
+	if err := c.responses.Delete(msg.ReceiptHandle); err != nil {
+		log.Println(fmt.Sprintf("Couldn't delete message %s : %v", msg.Id, err))
+	}
+
+	var resp banking_gateway.BankingGatesWayResponse
+	if err := json.Unmarshal(msg.Body, &resp); err != nil {
+		return 0, errors.New(fmt.Sprintf("Unknown message format, cannot parse the json body: %v", err))
+	}
+	ctxProducer := producerContext(msg.Headers, resp.Data.TracingInformation.Traceparent, resp.Data.TracingInformation.Tracestate)
+	_, span := tp.GetTracer().Start(ctxProducer, "recvCalculateScore", oteltrace.WithAttributes(
+		attribute.Int("messaging.receive_count", msg.ReceiveCount),
+	))
+	defer span.End()
+
+	if err := resp.Validate(); err != nil {
+		newErr := errors.New(fmt.Sprintf("Invalid banking data response %s: %v", msg.Id, err))
+		span.RecordError(newErr)
+		return 0, newErr
+	}
+
+	if bankingErr := resp.Data.Error; bankingErr != nil {
+		// The trace id points to the trace where the banking gateway failed
+		span.RecordError(bankingErr, oteltrace.WithAttributes(
+			attribute.String("error.code", bankingErr.Code),
+			attribute.Bool("error.retryable", bankingErr.Retryable),
+			attribute.String("error.traceId", bankingErr.TraceId),
+		))
+		span.SetStatus(codes.Error, bankingErr.Code)
+		return 0, fmt.Errorf("Banking gateway rejected the request: %w", bankingErr)
+	}
+
+	var generalScore float64 = 0
+	for _, periodScore := range resp.Data.Scores {
+		generalScore += periodScore.Score
+	}
+	return generalScore, nil
+}
@@ -0,0 +1,196 @@
+package queue_client
+
+import (
+	"common/banking_data"
+	"common/queue/memory_queue"
+	"context"
+	"credit-score-service/application/tracing"
+	"credit-score-service/core/credit_score"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// newTestClient runs over queues of its own, so tests don't share messages
+func newTestClient(t *testing.T, visibilityTimeout time.Duration, maxReceiveCount int) (*CreditScoreClient, *memory_queue.Queue) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	tracing.NewProvider()
+	name := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	dlq := memory_queue.GetQueue(name + "-dlq")
+	client := NewCreditScoreClientWith(
+		memory_queue.GetQueue(name+"-requests"),
+		memory_queue.GetQueue(name+"-responses"),
+		dlq,
+		visibilityTimeout,
+		maxReceiveCount,
+	)
+	return client, dlq
+}
+
+func sendRequest(t *testing.T, client *CreditScoreClient, body []byte, headers map[string]string) {
+	if _, err := client.Requests().Send(body, headers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func requestBody() []byte {
+	body, _ := json.Marshal(credit_score.CreditScoreRequest{
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	return body
+}
+
+// recvUntil runs Recv until done is closed or the deadline passes
+func recvUntil(t *testing.T, client *CreditScoreClient, done <-chan struct{}, handler func(ctx context.Context, req *credit_score.CreditScoreRequest) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		client.Recv(ctx, handler)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the messages to be processed")
+	}
+	cancel()
+	<-stopped
+}
+
+// waitForLen closes the returned channel once the queue holds n messages
+func waitForLen(q *memory_queue.Queue, n int) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for q.Len() != n {
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+	return done
+}
+
+func TestFailingMessageMovesToTheDeadLetterQueue(t *testing.T) {
+	client, dlq := newTestClient(t, 20*time.Millisecond, 3)
+	sendRequest(t, client, requestBody(), nil)
+
+	attempts := make(chan struct{}, 10)
+	recvUntil(t, client, waitForLen(dlq, 1), func(ctx context.Context, req *credit_score.CreditScoreRequest) error {
+		attempts <- struct{}{}
+		return errors.New("banking gateway unavailable")
+	})
+
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts before the quarantine, got %d", len(attempts))
+	}
+	msgs, err := dlq.Receive(context.Background(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := msgs[0].Headers
+	if headers["FailureReason"] != QUARANTINE_MAX_RECEIVES || headers["Attempts"] != "3" || headers["ReceiveCount"] != "3" {
+		t.Fatalf("unexpected dead letter headers %v", headers)
+	}
+	if client.Requests().(*memory_queue.Queue).Len() != 0 {
+		t.Fatal("expected the quarantined message to leave the requests queue")
+	}
+}
+
+func TestMalformedMessageIsQuarantinedRightAway(t *testing.T) {
+	client, dlq := newTestClient(t, time.Minute, 3)
+	sendRequest(t, client, []byte("{}"), nil)
+
+	handled := make(chan struct{}, 1)
+	recvUntil(t, client, waitForLen(dlq, 1), func(ctx context.Context, req *credit_score.CreditScoreRequest) error {
+		handled <- struct{}{}
+		return nil
+	})
+
+	if len(handled) != 0 {
+		t.Fatal("expected the handler not to run")
+	}
+	msgs, err := dlq.Receive(context.Background(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := msgs[0].Headers["FailureReason"]; reason != QUARANTINE_MALFORMED {
+		t.Fatalf("expected the reason %s, got %s", QUARANTINE_MALFORMED, reason)
+	}
+}
+
+func TestTraceContextTravelsInTheHeaders(t *testing.T) {
+	client, _ := newTestClient(t, time.Minute, 3)
+	traceID, _ := oteltrace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := oteltrace.SpanIDFromHex("00f067aa0ba902b7")
+	producer := oteltrace.ContextWithSpanContext(context.Background(), oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: oteltrace.FlagsSampled,
+	}))
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(producer, headers)
+	sendRequest(t, client, requestBody(), headers)
+
+	received := make(chan oteltrace.SpanContext, 1)
+	done := make(chan struct{})
+	recvUntil(t, client, done, func(ctx context.Context, req *credit_score.CreditScoreRequest) error {
+		received <- oteltrace.SpanContextFromContext(ctx)
+		close(done)
+		return client.Send(ctx, &credit_score.CreditScoreResponse{Score: 1})
+	})
+
+	if got := (<-received).TraceID(); got != traceID {
+		t.Fatalf("expected the handler to continue trace %s, got %s", traceID, got)
+	}
+	msgs, err := client.Responses().Receive(context.Background(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(msgs[0].Headers))
+	if got := oteltrace.SpanContextFromContext(response).TraceID(); got != traceID {
+		t.Fatalf("expected the response to carry trace %s, got %s", traceID, got)
+	}
+}
+
+func TestBankingGatewayClientReadsTheResponse(t *testing.T) {
+	name := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	client := NewBankingGatewayClientWith(memory_queue.GetQueue(name+"-requests"), memory_queue.GetQueue(name+"-responses"), time.Minute)
+	err := client.Send(context.Background(), &banking_data.BankingDataRequest{
+		Version:              banking_data.SCHEMA_VERSION,
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Requests().(*memory_queue.Queue).Len() != 1 {
+		t.Fatal("expected the request to be queued")
+	}
+
+	body, _ := json.Marshal(banking_data.BankingDataResponse{Data: banking_data.BankingData{
+		Version:              banking_data.SCHEMA_VERSION,
+		UserId:               "user",
+		BankingInstitutionId: "institution",
+		Scores:               []banking_data.PeriodScore{{Year: 2022, Month: 1, Score: 1.5}, {Year: 2022, Month: 2, Score: 2}},
+	}})
+	if _, err := client.Responses().Send(body, nil); err != nil {
+		t.Fatal(err)
+	}
+	score, err := client.Recv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != 3.5 {
+		t.Fatalf("expected the score 3.5, got %v", score)
+	}
+	if client.Responses().(*memory_queue.Queue).Len() != 0 {
+		t.Fatal("expected the response to be deleted")
+	}
+}
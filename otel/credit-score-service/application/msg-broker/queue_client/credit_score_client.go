@@ -0,0 +1,289 @@
+// Package queue_client implements the messaging clients over queue backends, the ones living in the process
+// or the durable ones of the machine.
+package queue_client
+
+import (
+	"common/queue"
+	"common/telemetry"
+	"common/worker_pool"
+	"context"
+	"credit-score-service/application/tracing"
+	"credit-score-service/core/credit_score"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_CREDIT_SCORE_REQUESTS_QUEUE_NAME  = "credit-score-requests"
+	DEFAULT_CREDIT_SCORE_RESPONSES_QUEUE_NAME = "credit-score-responses"
+	DEFAULT_VISIBILITY_TIMEOUT                = time.Second * 15
+	MAX_MESSAGES                              = 10
+	// RECV_ERROR_BACKOFF keeps a failing backend from being polled in a tight loop
+	RECV_ERROR_BACKOFF = time.Second
+
+	// Quarantine reasons, sent as the FailureReason header of the dead letter
+	QUARANTINE_MALFORMED       = "malformed"
+	QUARANTINE_MAX_RECEIVES    = "max_receives_exceeded"
+	MAX_FAILURE_MESSAGE_LENGTH = 1024
+)
+
+// CreditScoreClient implements credit_score.Client over backend queues, messages failing maxReceiveCount
+// times move to the dead letter queue when there is one
+type CreditScoreClient struct {
+	requests          queue.Backend
+	responses         queue.Backend
+	deadLetters       queue.Backend
+	visibilityTimeout time.Duration
+	maxReceiveCount   int
+	// lastRecvFail is set by the receiving goroutine and read by the probes, 1 while receiving fails
+	lastRecvFail int32
+	redactor     *telemetry.Redactor
+}
+
+// NewCreditScoreClientWith consumes requests and sends to responses, deadLetters may be nil
+func NewCreditScoreClientWith(requests, responses, deadLetters queue.Backend, visibilityTimeout time.Duration, maxReceiveCount int) *CreditScoreClient {
+	return &CreditScoreClient{
+		requests:          requests,
+		responses:         responses,
+		deadLetters:       deadLetters,
+		visibilityTimeout: visibilityTimeout,
+		maxReceiveCount:   maxReceiveCount,
+		redactor:          telemetry.NewRedactorFromEnv(),
+	}
+}
+
+// QueueName reads the name of a queue from the environment
+func QueueName(name, defaultName string) string {
+	if queueName := os.Getenv(name); queueName != "" {
+		return queueName
+	}
+	return defaultName
+}
+
+// VisibilityTimeoutFromEnv reads how long a received message stays invisible from the variable name
+func VisibilityTimeoutFromEnv(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return DEFAULT_VISIBILITY_TIMEOUT, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid %s %q, expected a positive duration", name, value))
+	}
+	return parsed, nil
+}
+
+// IsReady is always true, a backend that can't be reached fails to receive instead
+func (c *CreditScoreClient) IsReady() bool {
+	return true
+}
+
+// IsHealthy is false while receiving from the requests queue fails
+func (c *CreditScoreClient) IsHealthy() bool {
+	return atomic.LoadInt32(&c.lastRecvFail) == 0
+}
+
+// Requests is the queue Recv consumes, to send requests from the same process
+func (c *CreditScoreClient) Requests() queue.Backend {
+	return c.requests
+}
+
+// Responses is the queue Send produces to
+func (c *CreditScoreClient) Responses() queue.Backend {
+	return c.responses
+}
+
+func (c *CreditScoreClient) Send(ctx context.Context, resp *credit_score.CreditScoreResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot marshall message data: %v", err))
+	}
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+	if _, err := c.responses.Send(data, headers); err != nil {
+		return errors.New(fmt.Sprintf("Cannot send message to %s: %v", c.responses.Name(), err))
+	}
+	return nil
+}
+
+// producerContext extracts the trace and baggage of the producer from the headers, falling back to the tracing
+// information of the body for messages sent without headers
+func producerContext(headers map[string]string, traceparent, tracestate string) context.Context {
+	carrier := propagation.MapCarrier(headers)
+	if carrier.Get("traceparent") == "" {
+		carrier = propagation.MapCarrier{
+			"traceparent": traceparent,
+			"tracestate":  tracestate,
+		}
+	}
+	return otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+}
+
+func (c *CreditScoreClient) Recv(ctx context.Context, handlerFunc func(ctx context.Context, msg *credit_score.CreditScoreRequest) error) error {
+	pool, err := worker_pool.NewFromEnv("credit_score_requests")
+	if err != nil {
+		return err
+	}
+	tp := tracing.NewProvider()
+	log.Println(fmt.Sprintf("Listening %s queue: %s", c.requests.System(), c.requests.Name()))
+	for ctx.Err() == nil {
+		// Receiving pauses while all the workers are busy and the queue is full
+		free, err := pool.WaitForCapacity(ctx)
+		if err != nil {
+			break
+		}
+		if free > MAX_MESSAGES {
+			free = MAX_MESSAGES
+		}
+		msgs, err := c.requests.Receive(ctx, free, c.visibilityTimeout)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			// Record error in a new span
+			atomic.StoreInt32(&c.lastRecvFail, 1)
+			_, span := tp.GetTracer().Start(context.Background(), "receiveCalculateScore")
+			log.Println(fmt.Sprintf("Couldn't recieve message : %v", err))
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't recieve message : %v", err)))
+			span.End()
+			sleepCtx(ctx, RECV_ERROR_BACKOFF)
+			continue
+		}
+		atomic.StoreInt32(&c.lastRecvFail, 0)
+
+		for _, msg := range msgs {
+			msg := msg
+			var req credit_score.CreditScoreRequest
+			var reqErr error
+			if err := json.Unmarshal(msg.Body, &req); err != nil || reflect.DeepEqual(req, credit_score.CreditScoreRequest{}) {
+				reqErr = errors.New(fmt.Sprintf("Unknown message format, cannot parse the json body of %d bytes", len(msg.Body)))
+			}
+
+			ctxProducer := producerContext(msg.Headers, req.TracingInformation.Traceparent, req.TracingInformation.Tracestate)
+			ctxSpan, span := tp.GetTracer().Start(ctxProducer, "calulateScore",
+				oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+				oteltrace.WithAttributes(
+					semconv.MessagingSystemKey.String(c.requests.System()),
+					semconv.MessagingDestinationKey.String(c.requests.Name()),
+					semconv.MessagingOperationProcess,
+					semconv.MessagingMessageIDKey.String(msg.Id),
+					attribute.Int("messaging.receive_count", msg.ReceiveCount),
+					attribute.String("userId", req.UserId),
+					attribute.String("bankingInstitutionId", req.BankingInstitutionId),
+				),
+			)
+			if reqErr != nil {
+				// Retrying won't make the message valid, move it out of the way right away
+				log.Println(fmt.Sprintf("Couldn't recieve message : %v", reqErr))
+				span.RecordError(reqErr)
+				span.SetStatus(codes.Error, "invalid message")
+				c.quarantine(msg, QUARANTINE_MALFORMED, reqErr)
+				span.End()
+				continue
+			}
+
+			err = pool.Submit(func() {
+				defer span.End()
+				c.processMsg(ctxSpan, handlerFunc, msg, &req)
+			})
+			if err != nil {
+				// The message becomes visible again once the visibility timeout expires
+				log.Println(fmt.Sprintf("Couldn't schedule message %s : %v", msg.Id, err))
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				span.End()
+			}
+		}
+	}
+
+	log.Println("Stopping receiving because a context kill signal was sent, waiting for in-flight messages")
+	pool.Close()
+	return nil
+}
+
+// processMsg leaves failed messages invisible, they are redelivered once the visibility timeout expires
+func (c *CreditScoreClient) processMsg(ctx context.Context, handlerFunc func(ctx context.Context, msg *credit_score.CreditScoreRequest) error, msg queue.Message, req *credit_score.CreditScoreRequest) {
+	span := oteltrace.SpanFromContext(ctx)
+	err := callHandler(ctx, handlerFunc, req)
+	if err == nil {
+		if err := c.requests.Delete(msg.ReceiptHandle); err != nil {
+			span.RecordError(errors.New(fmt.Sprintf("Couldn't delete message %s : %v", msg.Id, err)))
+			log.Println(fmt.Sprintf("Couldn't delete message %s : %v", msg.Id, err))
+		}
+		return
+	}
+	span.RecordError(errors.New(fmt.Sprintf("Couldn't process message %s : %v", msg.Id, err)))
+	log.Println(fmt.Sprintf("Couldn't process message %s : %v", msg.Id, err))
+	if msg.Attempts >= c.maxReceiveCount {
+		c.quarantine(msg, QUARANTINE_MAX_RECEIVES, err)
+	}
+}
+
+// quarantine moves the message to the dead letter queue, without one it comes back once its visibility timeout expires
+func (c *CreditScoreClient) quarantine(msg queue.Message, reason string, cause error) {
+	if c.deadLetters == nil {
+		log.Println(fmt.Sprintf("No dead letter queue configured, message %s stays in its queue", msg.Id))
+		return
+	}
+	if _, err := c.deadLetters.Send(msg.Body, deadLetterHeaders(msg, c.requests.Name(), reason, c.redactor.String(cause.Error()))); err != nil {
+		log.Println(fmt.Sprintf("Couldn't quarantine message %s : %v", msg.Id, err))
+		return
+	}
+	if err := c.requests.Delete(msg.ReceiptHandle); err != nil {
+		log.Println(fmt.Sprintf("Couldn't delete quarantined message %s : %v", msg.Id, err))
+		return
+	}
+	log.Println(fmt.Sprintf("Quarantined message %s reason=%s attempts=%d", msg.Id, reason, msg.Attempts))
+}
+
+// deadLetterHeaders adds the reason of the quarantine to the headers of the message
+func deadLetterHeaders(msg queue.Message, sourceQueue, reason, failure string) map[string]string {
+	if len(failure) > MAX_FAILURE_MESSAGE_LENGTH {
+		failure = failure[:MAX_FAILURE_MESSAGE_LENGTH]
+	}
+	headers := make(map[string]string, len(msg.Headers)+6)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers["FailureReason"] = reason
+	headers["FailureMessage"] = failure
+	headers["SourceQueue"] = sourceQueue
+	headers["SourceMessageId"] = msg.Id
+	headers["ReceiveCount"] = strconv.Itoa(msg.ReceiveCount)
+	headers["Attempts"] = strconv.Itoa(msg.Attempts)
+	return headers
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// callHandler turns a panic of the handler into an error, so a poison message counts as a failed attempt
+func callHandler(ctx context.Context, handlerFunc func(ctx context.Context, msg *credit_score.CreditScoreRequest) error, req *credit_score.CreditScoreRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("handler panicked: %v", r))
+		}
+	}()
+	return handlerFunc(ctx, req)
+}
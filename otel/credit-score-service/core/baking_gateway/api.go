@@ -1,19 +1,21 @@
 package banking_gateway
 
-type BankingGatewayRequest struct {
-	UserId               string                 `json:"userId"`
-	BankingInstitutionId string                 `json:"bankingInstitutionId"`
-	BankingCredentials   map[string]string      `json:"bankingCredentials"`
-	Span                 string                 `json:"span"`
-	TracingInformation   map[string]interface{} `json:"tracingInformation"`
-}
+import (
+	"common/banking_data"
+	"context"
+)
 
-type BankingGatesWayResponse struct {
-	Data map[string]interface{} `json:"data"`
-}
+type BankingGatewayRequest = banking_data.BankingDataRequest
+
+type BankingGatesWayResponse = banking_data.BankingDataResponse
+
+// BankingGatewayError is the error Recv returns when the banking gateway couldn't fetch the banking data
+type BankingGatewayError = banking_data.BankingError
 
 type Client interface {
-	Send(resp *BankingGatewayRequest) error
+	// Send propagates the trace context and baggage of ctx along with the request
+	Send(ctx context.Context, resp *BankingGatewayRequest) error
 	// Recv(handlerFunc func(msg *BankingGatesWayResponse) error) error
-	Recv() (float64, error)
+	// Recv waits for the next response until ctx is done
+	Recv(ctx context.Context) (float64, error)
 }
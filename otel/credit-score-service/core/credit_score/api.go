@@ -1,18 +1,46 @@
 package credit_score
 
+import (
+	"common/banking_data"
+	"context"
+)
+
 type CreditScoreRequest struct {
-	UserId               string                 `json:"userId"`
-	BankingInstitutionId string                 `json:"bankingInstitutionId"`
-	BankingCredentials   map[string]string      `json:"bankingCredentials"`
-	Span                 string                 `json:"span"`
-	TracingInformation   map[string]interface{} `json:"tracingInformation"`
+	UserId                string                          `json:"userId"`
+	BankingInstitutionId  string                          `json:"bankingInstitutionId"`
+	BankingCredentials    map[string]string               `json:"bankingCredentials"`
+	BankingCredentialsRef string                          `json:"bankingCredentialsRef"`
+	BypassCache           bool                            `json:"bypassCache"`
+	Span                  string                          `json:"span"`
+	TracingInformation    banking_data.TracingInformation `json:"tracingInformation"`
 }
 
 type CreditScoreResponse struct {
 	Score int `json:"score"`
 }
 
+type deliveryKey struct{}
+
+// Delivery tells the handler which attempt at the message it runs, a failed attempt is retried until MaxAttempts
+type Delivery struct {
+	Attempt     int
+	MaxAttempts int
+}
+
+func WithDelivery(ctx context.Context, delivery Delivery) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, delivery)
+}
+
+// LastAttempt is true when a failure won't be retried, as it is for clients that don't set the delivery
+func LastAttempt(ctx context.Context) bool {
+	delivery, ok := ctx.Value(deliveryKey{}).(Delivery)
+	return !ok || delivery.Attempt >= delivery.MaxAttempts
+}
+
 type Client interface {
-	Recv(handlerFunc func(msg *CreditScoreRequest) error) error
-	Send(resp *CreditScoreResponse) error
+	// Recv stops polling once ctx is done and returns after the messages already received are processed,
+	// the handler gets the trace context and baggage of the producer of each message, and with the SQS and JetStream
+	// clients its processing deadline and its Delivery
+	Recv(ctx context.Context, handlerFunc func(ctx context.Context, msg *CreditScoreRequest) error) error
+	Send(ctx context.Context, resp *CreditScoreResponse) error
 }
@@ -1,24 +1,48 @@
 package usecases
 
 import (
+	"common/banking_data"
+	"common/vault"
+	"context"
 	banking_gateway "credit-score-service/core/baking_gateway"
 	"credit-score-service/core/credit_score"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 )
 
-func CalculateScoreHandler(creditScoreClient credit_score.Client, bankingGatewayClient banking_gateway.Client) error {
-	go creditScoreClient.Recv(func(msg *credit_score.CreditScoreRequest) error {
-		log.Println(fmt.Sprintf("Calculate Score Request Recieved: %v", msg.UserId))
-		err := bankingGatewayClient.Send(&banking_gateway.BankingGatewayRequest{
-			UserId:               msg.UserId,
-			BankingInstitutionId: msg.BankingInstitutionId,
-			BankingCredentials:   msg.BankingCredentials,
-			Span:                 msg.Span,
-			TracingInformation:   msg.TracingInformation,
+// CalculateScoreHandler consumes the credit score requests until ctx is done
+func CalculateScoreHandler(ctx context.Context, creditScoreClient credit_score.Client, bankingGatewayClient banking_gateway.Client, credentialsVault vault.Vault) error {
+	return creditScoreClient.Recv(ctx, func(ctx context.Context, msg *credit_score.CreditScoreRequest) error {
+		log.Println(fmt.Sprintf("Calculate Score Request Recieved userId=%v", msg.UserId))
+		credentialsRef, err := storeCredentials(credentialsVault, msg)
+		if err != nil {
+			return err
+		}
+		err = bankingGatewayClient.Send(ctx, &banking_gateway.BankingGatewayRequest{
+			Version:               banking_data.SCHEMA_VERSION,
+			UserId:                msg.UserId,
+			BankingInstitutionId:  msg.BankingInstitutionId,
+			BankingCredentialsRef: credentialsRef,
+			BypassCache:           msg.BypassCache,
+			Span:                  msg.Span,
+			TracingInformation:    msg.TracingInformation,
 		})
 		return err
 	})
+}
 
-	return nil
+// storeCredentials keeps clear text credentials in the vault, so only their reference is sent to the banking gateway
+func storeCredentials(credentialsVault vault.Vault, msg *credit_score.CreditScoreRequest) (string, error) {
+	if msg.BankingCredentialsRef != "" || len(msg.BankingCredentials) == 0 {
+		return msg.BankingCredentialsRef, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ref, err := credentialsVault.Store(ctx, msg.BankingCredentials)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Couldn't store banking credentials of user %s: %v", msg.UserId, err))
+	}
+	return ref, nil
 }
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"common/vault"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"credit-score-service/application/controllers"
 	"credit-score-service/application/msg-broker/banking_gateway_sqs"
+	"credit-score-service/application/msg-broker/bolt_queue"
 	"credit-score-service/application/msg-broker/client_score_sqs"
+	"credit-score-service/application/msg-broker/jetstream"
+	"credit-score-service/application/msg-broker/memory"
 	"credit-score-service/application/tracing"
 
 	_ "credit-score-service/application/docs"
 
+	banking_gateway "credit-score-service/core/baking_gateway"
+	"credit-score-service/core/credit_score"
 	"credit-score-service/core/usecases"
 
 	swagger "github.com/arsmn/fiber-swagger/v2"
@@ -20,9 +33,101 @@ import (
 	_ "go.uber.org/automaxprocs"
 )
 
+const (
+	// DEFAULT_SHUTDOWN_TIMEOUT stays below the 30s grace period of docker and kubernetes
+	DEFAULT_SHUTDOWN_TIMEOUT = 25 * time.Second
+	TRACER_FLUSH_TIMEOUT     = 5 * time.Second
+	DEFAULT_PORT             = "8080"
+)
+
+// listenAddress reads PORT, so both services can run on the same machine
+func listenAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":" + DEFAULT_PORT
+}
+
+// shutdownTimeout reads SHUTDOWN_TIMEOUT, how long in-flight messages have to finish once a stop signal arrives
+func shutdownTimeout() time.Duration {
+	value := os.Getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid SHUTDOWN_TIMEOUT %q: %v", value, err))
+	}
+	return timeout
+}
+
+// creditScoreBroker and bankingGatewayBroker are message broker clients the probes can check
+type creditScoreBroker interface {
+	credit_score.Client
+	controllers.HealthReporter
+}
+
+type bankingGatewayBroker interface {
+	banking_gateway.Client
+	controllers.HealthReporter
+}
+
+// newBrokerClients builds the clients of the broker set in MSG_BROKER, "sqs" (the default), "nats", "bolt" or "memory".
+// The memory broker only reaches producers and consumers of this process, the dev command runs both services in
+// one process over it. The bolt broker reaches those of this machine.
+func newBrokerClients() (creditScoreBroker, bankingGatewayBroker, error) {
+	switch backend := os.Getenv("MSG_BROKER"); backend {
+	case "", "sqs":
+		clientScoreClient, err := client_score_sqs.New()
+		if err != nil {
+			return nil, nil, err
+		}
+		bankingClient, err := banking_gateway_sqs.New()
+		if err != nil {
+			return nil, nil, err
+		}
+		return clientScoreClient, bankingClient, nil
+	case "nats":
+		clientScoreClient, err := jetstream.NewCreditScoreClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		bankingClient, err := jetstream.NewBankingGatewayClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		return clientScoreClient, bankingClient, nil
+	case "bolt":
+		clientScoreClient, err := bolt_queue.NewCreditScoreClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		bankingClient, err := bolt_queue.NewBankingGatewayClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		return clientScoreClient, bankingClient, nil
+	case "memory":
+		clientScoreClient, err := memory.NewCreditScoreClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		bankingClient, err := memory.NewBankingGatewayClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		return clientScoreClient, bankingClient, nil
+	default:
+		return nil, nil, errors.New(fmt.Sprintf("Unknown message broker %s", backend))
+	}
+}
+
 func main() {
 	tp := tracing.NewProvider()
-	defer tp.ShuwDownTracer()
+	drainTimeout := shutdownTimeout()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
 	app := fiber.New(fiber.Config{})
 	app.Use(recover.New())
@@ -34,15 +139,51 @@ func main() {
 	app.Get("/score", controllers.GetUserBankingScore)
 
 	// Init the consumer
-	clientScoreClient, err := client_score_sqs.New()
+	clientScoreClient, bankingClient, err := newBrokerClients()
 	if err != nil {
 		log.Fatal(err)
 	}
+	controllers.Setup(bankingClient, clientScoreClient, bankingClient)
 
-	bankingClient, err := banking_gateway_sqs.New()
+	credentialsVault, err := vault.New()
 	if err != nil {
 		log.Fatal(err)
 	}
-	usecases.CalculateScoreHandler(clientScoreClient, bankingClient)
-	log.Fatal(app.Listen(":8080"))
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		if err := usecases.CalculateScoreHandler(ctx, clientScoreClient, bankingClient, credentialsVault); err != nil {
+			log.Println(fmt.Sprintf("Credit score requests consumer stopped: %v", err))
+		}
+	}()
+
+	go func() {
+		if err := app.Listen(listenAddress()); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Println("Shutdown signal received")
+	case <-consumerDone:
+		log.Println("Credit score requests consumer exited, shutting down")
+	}
+	// A second signal kills the process right away
+	stop()
+
+	ctxDrain, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := app.Shutdown(); err != nil {
+		log.Println(fmt.Sprintf("Error shutting down the http server: %v", err))
+	}
+	select {
+	case <-consumerDone:
+	case <-ctxDrain.Done():
+		log.Println(fmt.Sprintf("In-flight messages didn't finish within %v, they will be redelivered", drainTimeout))
+	}
+
+	ctxFlush, cancelFlush := context.WithTimeout(context.Background(), TRACER_FLUSH_TIMEOUT)
+	defer cancelFlush()
+	tp.ShuwDownTracer(ctxFlush)
 }
@@ -0,0 +1,173 @@
+// Command dev runs the credit score service and the banking gateway in a single process over the in-memory
+// queues, so the whole pipeline runs without localstack or any other container.
+package main
+
+import (
+	"common/vault"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	bank_impl "banking-gateway/application/banking_info_providers"
+	gateway_memory "banking-gateway/application/msg-broker/memory"
+	gateway_tracing "banking-gateway/application/tracing"
+	gateway_usecases "banking-gateway/core/usecases"
+
+	"credit-score-service/application/controllers"
+	"credit-score-service/application/msg-broker/memory"
+	"credit-score-service/application/tracing"
+	"credit-score-service/core/usecases"
+
+	"github.com/gofiber/adaptor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	DEFAULT_SHUTDOWN_TIMEOUT = 25 * time.Second
+	TRACER_FLUSH_TIMEOUT     = 5 * time.Second
+	DEFAULT_PORT             = "8080"
+)
+
+// listenAddress reads PORT
+func listenAddress() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":" + DEFAULT_PORT
+}
+
+// shutdownTimeout reads SHUTDOWN_TIMEOUT, how long in-flight messages have to finish once a stop signal arrives
+func shutdownTimeout() time.Duration {
+	value := os.Getenv("SHUTDOWN_TIMEOUT")
+	if value == "" {
+		return DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid SHUTDOWN_TIMEOUT %q: %v", value, err))
+	}
+	return timeout
+}
+
+// useEphemeralVaultKey gives the file vault a key of this process unless one is configured, both services share
+// the process so the key never has to leave it, and the credentials stored by a previous run can't be read
+func useEphemeralVaultKey() error {
+	if backend := os.Getenv("CREDENTIALS_VAULT"); backend != "" && backend != "file" {
+		return nil
+	}
+	if os.Getenv("CREDENTIALS_VAULT_KEY") != "" || os.Getenv("CREDENTIALS_VAULT_KEY_FILE") != "" {
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return errors.New(fmt.Sprintf("Couldn't generate the credentials vault key: %v", err))
+	}
+	return os.Setenv("CREDENTIALS_VAULT_KEY", base64.StdEncoding.EncodeToString(key))
+}
+
+func main() {
+	// Each service exports its spans under its own name
+	tp := tracing.NewProvider()
+	gatewayTp := gateway_tracing.NewProvider()
+	drainTimeout := shutdownTimeout()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	app := fiber.New(fiber.Config{})
+	app.Use(recover.New())
+
+	app.Get("/healthz", controllers.Healthz)
+	app.Get("/readiness", controllers.ReadinessProbe)
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+	app.Get("/score", controllers.GetUserBankingScore)
+
+	// Both services read the same queue names, so the clients of each side meet on the same in-memory queues
+	clientScoreClient, err := memory.NewCreditScoreClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	bankingClient, err := memory.NewBankingGatewayClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	gatewayClient, err := gateway_memory.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	controllers.Setup(bankingClient, clientScoreClient, bankingClient, gatewayClient)
+
+	registry, err := bank_impl.NewRegistryFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The credit score service stores the credentials the gateway resolves, they share the vault
+	if err := useEphemeralVaultKey(); err != nil {
+		log.Fatal(err)
+	}
+	credentialsVault, err := vault.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	creditScoreDone := make(chan struct{})
+	go func() {
+		defer close(creditScoreDone)
+		if err := usecases.CalculateScoreHandler(ctx, clientScoreClient, bankingClient, credentialsVault); err != nil {
+			log.Println(fmt.Sprintf("Credit score requests consumer stopped: %v", err))
+		}
+	}()
+	gatewayDone := make(chan struct{})
+	go func() {
+		defer close(gatewayDone)
+		if err := gateway_usecases.BankingInstitutionReqConsumer(ctx, gatewayClient, registry, credentialsVault); err != nil {
+			log.Println(fmt.Sprintf("Banking requests consumer stopped: %v", err))
+		}
+	}()
+
+	go func() {
+		if err := app.Listen(listenAddress()); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Println("Shutdown signal received")
+	case <-creditScoreDone:
+		log.Println("Credit score requests consumer exited, shutting down")
+	case <-gatewayDone:
+		log.Println("Banking requests consumer exited, shutting down")
+	}
+	// A second signal kills the process right away
+	stop()
+
+	ctxDrain, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := app.Shutdown(); err != nil {
+		log.Println(fmt.Sprintf("Error shutting down the http server: %v", err))
+	}
+	for _, done := range []chan struct{}{creditScoreDone, gatewayDone} {
+		select {
+		case <-done:
+		case <-ctxDrain.Done():
+		}
+	}
+	if ctxDrain.Err() != nil {
+		log.Println(fmt.Sprintf("In-flight messages didn't finish within %v, they are lost with the in-memory queues", drainTimeout))
+	}
+
+	ctxFlush, cancelFlush := context.WithTimeout(context.Background(), TRACER_FLUSH_TIMEOUT)
+	defer cancelFlush()
+	tp.ShuwDownTracer(ctxFlush)
+	gatewayTp.ShuwDownTracer(ctxFlush)
+}
@@ -0,0 +1,18 @@
+#!/bin/env bash
+
+# Generates the key of the file credentials vault used when running the services locally, both services read it
+# from CREDENTIALS_VAULT_KEY_FILE, by default vault.key in CREDENTIALS_VAULT_DIR
+set -e
+
+VAULT_DIR=${CREDENTIALS_VAULT_DIR:-/tmp/banking-credentials}
+KEY_FILE=${CREDENTIALS_VAULT_KEY_FILE:-$VAULT_DIR/vault.key}
+
+if [ -f "$KEY_FILE" ]; then
+  echo "The vault key $KEY_FILE already exists"
+  exit 0
+fi
+
+umask 077
+mkdir -p "$(dirname "$KEY_FILE")"
+head -c 32 /dev/urandom | base64 > "$KEY_FILE"
+echo "Generated the vault key $KEY_FILE"
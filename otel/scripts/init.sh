@@ -7,3 +7,12 @@ aws --endpoint-url=http://localstack:4566 sqs create-queue --queue-name banking-
 
 aws --endpoint-url=http://localstack:4566 sqs create-queue --queue-name credit-score-requests
 aws --endpoint-url=http://localstack:4566 sqs create-queue --queue-name credit-score-responses
+
+# Dead letter queues of the consumers, they keep the messages that couldn't be processed
+aws --endpoint-url=http://localstack:4566 sqs create-queue --queue-name banking-requests-dlq
+aws --endpoint-url=http://localstack:4566 sqs create-queue --queue-name credit-score-requests-dlq
+aws --endpoint-url=http://localstack:4566 sqs create-queue --queue-name banking-responses-dlq
+
+# Key of the banking credentials vault
+KEY_ID=$(aws --endpoint-url=http://localstack:4566 kms create-key --description "banking credentials" --query KeyMetadata.KeyId --output text)
+aws --endpoint-url=http://localstack:4566 kms create-alias --alias-name alias/banking-credentials --target-key-id "$KEY_ID"